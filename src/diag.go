@@ -0,0 +1,55 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the gating decision of the factory diagnostics result, in the result report
+var diagGate *rplib.DiagGate
+
+// checkFactoryDiag() reads the factory diagnostics result in config.yaml from
+// the writable installer media (the factory tools write it there, not in the
+// payload mounted on RECO_ROOT_DIR), and returns false if the unit didn't pass the diagnostics and the result
+// is not skipped. There is no gating if no result is configured.
+func checkFactoryDiag() bool {
+	path := configs.Recovery.FactoryDiagResult
+	if path == "" {
+		return true
+	}
+	skip, _ := strconv.ParseBool(configs.Recovery.SkipFactoryDiagResult)
+	diagGate = rplib.GateDiagResult(path, sourceRwDir, efivars, configs.Recovery.FactoryDiagResultFormat, skip)
+	log.Printf("factory diagnostics result %s: %q, error: %q, skip: %v, install: %v",
+		diagGate.Source, diagGate.Result, diagGate.Error, diagGate.Skipped, diagGate.Install)
+
+	if !diagGate.Install {
+		reason := diagGate.Result
+		if diagGate.Error != "" {
+			reason = diagGate.Error
+		}
+		stageErrors = append(stageErrors, fmt.Errorf("Factory diagnostics not passed: %s", reason))
+	}
+	return diagGate.Install
+}
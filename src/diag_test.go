@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type DiagSuite struct {
+	oldConfigs     rplib.ConfigRecovery
+	oldSourceRwDir string
+	oldStageErrors []error
+	oldDiagGate    *rplib.DiagGate
+}
+
+var _ = Suite(&DiagSuite{})
+
+func (s *DiagSuite) SetUpTest(c *C) {
+	s.oldConfigs, s.oldSourceRwDir = configs, sourceRwDir
+	s.oldStageErrors, s.oldDiagGate = stageErrors, diagGate
+	stageErrors = nil
+}
+
+func (s *DiagSuite) TearDownTest(c *C) {
+	configs, sourceRwDir = s.oldConfigs, s.oldSourceRwDir
+	stageErrors, diagGate = s.oldStageErrors, s.oldDiagGate
+}
+
+// The result is read from the installer media, and not from the payload
+// mounted on RECO_ROOT_DIR.
+func (s *DiagSuite) TestCheckFactoryDiagSourceRwDir(c *C) {
+	sourceRwDir = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(sourceRwDir, "factory"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sourceRwDir, "factory", "diag.json"), []byte(`{"result": "PASS"}`), 0644), IsNil)
+	_, err := os.Stat(filepath.Join(RECO_ROOT_DIR, "factory", "diag.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	configs.Recovery.FactoryDiagResult = "factory/diag.json"
+	configs.Recovery.FactoryDiagResultFormat = rplib.DIAG_FORMAT_JSON
+	c.Check(checkFactoryDiag(), Equals, true)
+	c.Check(diagGate.Result, Equals, rplib.DIAG_RESULT_PASS)
+	c.Check(stageErrors, HasLen, 0)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(sourceRwDir, "factory", "diag.json"), []byte(`{"result": "FAIL"}`), 0644), IsNil)
+	c.Check(checkFactoryDiag(), Equals, false)
+	c.Check(diagGate.Result, Equals, "FAIL")
+	c.Check(stageErrors, HasLen, 1)
+}
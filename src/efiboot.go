@@ -0,0 +1,227 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// easier for function mocking
+var efivars = rplib.NewEfivars()
+
+// efiLoader() returns the removable media loader path of the arch
+func efiLoader() string {
+	switch configs.Configs.Arch {
+	case "arm64":
+		return "\\EFI\\BOOT\\BOOTAA64.EFI"
+	case "arm", "armhf":
+		return "\\EFI\\BOOT\\BOOTARM.EFI"
+	}
+	return "\\EFI\\BOOT\\BOOTX64.EFI"
+}
+
+// addBootEntry() creates the Boot#### entry for the loader on the
+// partition nr of the target disk, if the same entry doesn't exist.
+func addBootEntry(parts *Partitions, entry string, nr int, loader string) (uint16, error) {
+	hd, err := rplib.GptPartition(parts.TargetDevPath, nr, rplib.LogicalBlockSize(parts.TargetDevPath))
+	if err != nil {
+		return 0, err
+	}
+	opt := rplib.NewEfiLoadOption(entry, hd, loader)
+
+	entries, err := efivars.BootEntries()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.Option.Description == entry && bytes.Equal(e.Option.DevicePath, opt.DevicePath) {
+			log.Printf("Boot%04X already exists: %s", e.Num, e.Option)
+			return e.Num, nil
+		}
+	}
+	return efivars.CreateBootEntry(opt)
+}
+
+// systemBootEntry() returns the boot entry of the installed system
+func systemBootEntry() string {
+	if recoveryOs == rplib.RECOVERY_OS_UBUNTU_CORE {
+		return rplib.BOOT_ENTRY_SNAPPY
+	}
+	return rplib.BOOT_ENTRY_UBUNTU_CLASSIC
+}
+
+// bootEntries() returns the boot entries addBootEntries() creates for the
+// partitions: the recovery, and the system if the target has system-boot.
+func bootEntries(parts *Partitions) []string {
+	entries := []string{rplib.BOOT_ENTRY_RECOVERY}
+	if parts.Sysboot_nr > 0 {
+		entries = append(entries, systemBootEntry())
+	}
+	return entries
+}
+
+// checkBootPolicy() checks the boot entries in the boot section of
+// config.yaml are created on the installed disk, before the disk is touched.
+// The new partition table of prepareRecoveryPart() has no system-boot, so
+// only the recovery entry is created.
+func checkBootPolicy() error {
+	entries := bootEntries(&Partitions{Recovery_nr: 1, Sysboot_nr: -1})
+	for _, entry := range []string{configs.Boot.First, configs.Boot.Next} {
+		if entry == "" {
+			continue
+		}
+		found := false
+		for _, e := range entries {
+			found = found || e == entry
+		}
+		if !found {
+			return fmt.Errorf("Boot entry %q is not created by the installer for %s, only %q", entry, recoveryOs, entries)
+		}
+	}
+	return nil
+}
+
+// AddBootEntries() adds the UEFI boot entries of the installed partitions
+func AddBootEntries(parts *Partitions) error {
+	if configs.Configs.Bootloader != "grub" || !rplib.IsEfiBoot() {
+		return nil
+	}
+	return addBootEntries(parts)
+}
+
+// addBootEntries() adds the recovery entry, and the system entry if the
+// target has system-boot. Without system-boot, the system is booted by the
+// default entry of the recovery grub until the factory install creates it.
+func addBootEntries(parts *Partitions) error {
+	if _, err := addBootEntry(parts, rplib.BOOT_ENTRY_RECOVERY, parts.Recovery_nr, efiLoader()); err != nil {
+		return err
+	}
+	if parts.Sysboot_nr <= 0 {
+		return nil
+	}
+	_, err := addBootEntry(parts, systemBootEntry(), parts.Sysboot_nr, efiLoader())
+	return err
+}
+
+// partitionSignatures() returns the GPT partition GUIDs of the disks
+func partitionSignatures(disks []string) map[[16]byte]bool {
+	sigs := map[[16]byte]bool{}
+	for _, disk := range disks {
+		hds, err := rplib.GptPartitions(disk, rplib.LogicalBlockSize(disk))
+		if err != nil {
+			continue
+		}
+		for _, hd := range hds {
+			sigs[hd.Signature] = true
+		}
+	}
+	return sigs
+}
+
+// isInstallerEntry() returns true for the entries created by installers,
+// with the removable media loader of this arch
+func isInstallerEntry(opt *rplib.EfiLoadOption) bool {
+	switch opt.Description {
+	case rplib.BOOT_ENTRY_RECOVERY, rplib.BOOT_ENTRY_SNAPPY, rplib.BOOT_ENTRY_UBUNTU_CLASSIC:
+		return opt.HardDrive != nil && strings.EqualFold(opt.FilePath, efiLoader())
+	}
+	return false
+}
+
+// ApplyBootPolicy() applies the boot section of config.yaml after install:
+// removes the stale installer entries pointing at the partitions of the
+// target disk which were removed by the install (oldSigs are the partition
+// GUIDs before the install), moves the configured entry on the target disk
+// first in BootOrder, and sets the one-shot BootNext. The entries of other
+// disks, e.g. unplugged USB disks, are kept.
+func ApplyBootPolicy(parts *Partitions, oldSigs map[[16]byte]bool) error {
+	if configs.Configs.Bootloader != "grub" || !rplib.IsEfiBoot() {
+		return nil
+	}
+	return applyBootPolicy(parts, oldSigs)
+}
+
+func applyBootPolicy(parts *Partitions, oldSigs map[[16]byte]bool) error {
+	entries, err := efivars.BootEntries()
+	if err != nil {
+		return err
+	}
+
+	target := partitionSignatures([]string{parts.TargetDevPath})
+	if configs.Boot.RemoveStale {
+		for _, e := range entries {
+			if !isInstallerEntry(e.Option) {
+				continue
+			}
+			sig := e.Option.HardDrive.Signature
+			if oldSigs[sig] && !target[sig] {
+				log.Printf("remove stale Boot%04X: %s", e.Num, e.Option)
+				if err = efivars.DeleteBootEntry(e.Num); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	findEntry := func(entry string) (uint16, error) {
+		for _, e := range entries {
+			if e.Option.Description == entry && e.Option.HardDrive != nil && target[e.Option.HardDrive.Signature] {
+				return e.Num, nil
+			}
+		}
+		return 0, fmt.Errorf("Boot entry %q on %s not found", entry, parts.TargetDevPath)
+	}
+
+	if configs.Boot.First != "" {
+		num, err := findEntry(configs.Boot.First)
+		if err != nil {
+			return err
+		}
+		order, err := efivars.BootOrder()
+		if err != nil {
+			return err
+		}
+		newOrder := []uint16{num}
+		for _, n := range order {
+			if n != num {
+				newOrder = append(newOrder, n)
+			}
+		}
+		if err = efivars.SetBootOrder(newOrder); err != nil {
+			return err
+		}
+	}
+
+	if configs.Boot.Next != "" {
+		num, err := findEntry(configs.Boot.Next)
+		if err != nil {
+			return err
+		}
+		if err = efivars.SetBootNext(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
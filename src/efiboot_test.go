@@ -0,0 +1,188 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type EfibootSuite struct {
+	oldEfivars    *rplib.Efivars
+	oldConfigs    rplib.ConfigRecovery
+	oldRecoveryOs string
+}
+
+var _ = Suite(&EfibootSuite{})
+
+func (s *EfibootSuite) SetUpTest(c *C) {
+	s.oldEfivars, s.oldConfigs, s.oldRecoveryOs = efivars, configs, recoveryOs
+	efivars = &rplib.Efivars{Dir: c.MkDir()}
+}
+
+func (s *EfibootSuite) TearDownTest(c *C) {
+	efivars, configs, recoveryOs = s.oldEfivars, s.oldConfigs, s.oldRecoveryOs
+}
+
+// makeGptDisk() creates a disk image with the GPT partitions 1 to n, each
+// with a unique partition GUID of the 15 bytes prefix guid.
+func makeGptDisk(c *C, n int, guid string) string {
+	img := filepath.Join(c.MkDir(), "disk.img")
+	dat := make([]byte, 34*512)
+	copy(dat[512:], "EFI PART")
+	binary.LittleEndian.PutUint64(dat[512+72:], 2)
+	binary.LittleEndian.PutUint32(dat[512+80:], 128)
+	binary.LittleEndian.PutUint32(dat[512+84:], 128)
+	for i := 0; i < n; i++ {
+		entry := dat[2*512+i*128:]
+		copy(entry[16:32], guid)
+		entry[31] = byte('1' + i)
+		binary.LittleEndian.PutUint64(entry[32:], uint64(2048*(i+1)))
+		binary.LittleEndian.PutUint64(entry[40:], uint64(2048*(i+2)-1))
+	}
+	c.Assert(ioutil.WriteFile(img, dat, 0644), IsNil)
+	return img
+}
+
+func (s *EfibootSuite) TestCheckBootPolicy(c *C) {
+	recoveryOs = rplib.RECOVERY_OS_UBUNTU_CORE
+	configs.Boot.First, configs.Boot.Next = rplib.BOOT_ENTRY_RECOVERY, rplib.BOOT_ENTRY_RECOVERY
+	c.Assert(checkBootPolicy(), IsNil)
+	configs.Boot.First, configs.Boot.Next = "", ""
+	c.Assert(checkBootPolicy(), IsNil)
+
+	// the new partition table has no system-boot, no system entry
+	configs.Boot.First = rplib.BOOT_ENTRY_SNAPPY
+	c.Assert(checkBootPolicy(), ErrorMatches, `Boot entry "ubuntu_core" is not created by the installer for .*, only \["factory_restore"\]`)
+	recoveryOs = rplib.RECOVERY_OS_UBUNTU_CLASSIC
+	configs.Boot.First, configs.Boot.Next = rplib.BOOT_ENTRY_RECOVERY, rplib.BOOT_ENTRY_UBUNTU_CLASSIC
+	c.Assert(checkBootPolicy(), ErrorMatches, `Boot entry "ubuntu" is not created by the installer for .*`)
+}
+
+// The system entry is only created on system-boot, never on the recovery
+func (s *EfibootSuite) TestAddBootEntries(c *C) {
+	recoveryOs = rplib.RECOVERY_OS_UBUNTU_CLASSIC
+	parts := &Partitions{TargetDevPath: makeGptDisk(c, 2, "part-guid-00000"), Recovery_nr: 1, Sysboot_nr: -1}
+	c.Assert(addBootEntries(parts), IsNil)
+	entries, err := efivars.BootEntries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Check(entries[0].Option.Description, Equals, rplib.BOOT_ENTRY_RECOVERY)
+
+	parts.Sysboot_nr = 2
+	c.Assert(addBootEntries(parts), IsNil)
+	entries, err = efivars.BootEntries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	for _, e := range entries {
+		if e.Option.Description == rplib.BOOT_ENTRY_UBUNTU_CLASSIC {
+			c.Check(e.Option.HardDrive.PartitionNumber, Equals, uint32(2))
+		}
+	}
+}
+
+// Every boot entry accepted by checkBootPolicy() is created by
+// addBootEntries(), and found by applyBootPolicy().
+func (s *EfibootSuite) TestApplyBootPolicy(c *C) {
+	for _, t := range []struct {
+		os, entry string
+		sysboot   int
+	}{
+		{rplib.RECOVERY_OS_UBUNTU_CORE, rplib.BOOT_ENTRY_RECOVERY, -1},
+		{rplib.RECOVERY_OS_UBUNTU_CLASSIC, rplib.BOOT_ENTRY_RECOVERY, -1},
+		{rplib.RECOVERY_OS_UBUNTU_CLASSIC, rplib.BOOT_ENTRY_UBUNTU_CLASSIC, 2},
+	} {
+		efivars = &rplib.Efivars{Dir: c.MkDir()}
+		recoveryOs = t.os
+		configs.Boot.First, configs.Boot.Next = t.entry, t.entry
+		parts := &Partitions{TargetDevPath: makeGptDisk(c, 2, "part-guid-00000"), Recovery_nr: 1, Sysboot_nr: t.sysboot}
+		if t.sysboot <= 0 {
+			c.Assert(checkBootPolicy(), IsNil)
+		}
+		c.Assert(addBootEntries(parts), IsNil)
+		c.Assert(applyBootPolicy(parts, nil), IsNil)
+
+		entries, err := efivars.BootEntries()
+		c.Assert(err, IsNil)
+		order, err := efivars.BootOrder()
+		c.Assert(err, IsNil)
+		_, next, err := efivars.ReadVar("BootNext")
+		c.Assert(err, IsNil)
+		found := false
+		for _, e := range entries {
+			if e.Option.Description != t.entry {
+				continue
+			}
+			found = true
+			c.Check(order[0], Equals, e.Num, Commentf("%s", t.entry))
+			c.Check(next, DeepEquals, []byte{byte(e.Num), 0})
+			nr := uint32(1)
+			if t.entry != rplib.BOOT_ENTRY_RECOVERY {
+				nr = uint32(t.sysboot)
+			}
+			c.Check(e.Option.HardDrive.PartitionNumber, Equals, nr)
+		}
+		c.Check(found, Equals, true, Commentf("%s", t.entry))
+	}
+}
+
+// Only the installer entries of the partitions removed from the target disk
+// are stale, the entries of other disks and other loaders are kept.
+func (s *EfibootSuite) TestApplyBootPolicyRemoveStale(c *C) {
+	recoveryOs = rplib.RECOVERY_OS_UBUNTU_CLASSIC
+	configs.Boot.RemoveStale = true
+
+	old := &Partitions{TargetDevPath: makeGptDisk(c, 2, "old-guid-000000"), Recovery_nr: 1, Sysboot_nr: 2}
+	c.Assert(addBootEntries(old), IsNil)
+	usb := &Partitions{TargetDevPath: makeGptDisk(c, 2, "usb-guid-000000"), Recovery_nr: 1, Sysboot_nr: 2}
+	c.Assert(addBootEntries(usb), IsNil)
+	_, err := addBootEntry(old, rplib.BOOT_ENTRY_UBUNTU_CLASSIC, 1, "\\EFI\\ubuntu\\shimx64.efi")
+	c.Assert(err, IsNil)
+	_, err = addBootEntry(old, "Windows Boot Manager", 1, "\\EFI\\Microsoft\\Boot\\bootmgfw.efi")
+	c.Assert(err, IsNil)
+	oldSigs := partitionSignatures([]string{old.TargetDevPath})
+
+	// the target disk gets new partition GUIDs by the install, the USB disk is unplugged
+	parts := &Partitions{TargetDevPath: makeGptDisk(c, 2, "new-guid-000000"), Recovery_nr: 1, Sysboot_nr: -1}
+	c.Assert(addBootEntries(parts), IsNil)
+	c.Assert(applyBootPolicy(parts, oldSigs), IsNil)
+
+	entries, err := efivars.BootEntries()
+	c.Assert(err, IsNil)
+	kept := []string{}
+	for _, e := range entries {
+		kept = append(kept, fmt.Sprintf("%s %s", e.Option.HardDrive.Signature[:3], e.Option.Description))
+	}
+	sort.Strings(kept)
+	c.Check(kept, DeepEquals, []string{
+		"new factory_restore",
+		"old Windows Boot Manager",
+		"old ubuntu",
+		"usb factory_restore",
+		"usb ubuntu",
+	})
+}
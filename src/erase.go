@@ -0,0 +1,100 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+func eraseWith(method string, device string) error {
+	switch method {
+	case rplib.ERASE_METHOD_NVME:
+		return rplib.NvmeFormat(device)
+	case rplib.ERASE_METHOD_ATA:
+		return rplib.AtaSecurityErase(device)
+	case rplib.ERASE_METHOD_EMMC:
+		return rplib.EmmcSecureTrim(device)
+	case rplib.ERASE_METHOD_OVERWRITE:
+		return rplib.Overwrite(device, configs.Erase.Passes)
+	}
+	return fmt.Errorf("Unknown erase method: %s", method)
+}
+
+// EraseTarget() wipes the whole target disk with the configured method.
+// If the hardware erase fails, it falls back to multi-pass overwrite.
+// A signed erase certificate is written to the OEM log dir for every run.
+func EraseTarget(parts *Partitions) error {
+	if parts.SourceDevPath == parts.TargetDevPath {
+		return fmt.Errorf("The source device and target device are same")
+	}
+
+	key, err := rplib.LoadSigningKey(configs.Erase.SigningKey)
+	if err != nil {
+		return fmt.Errorf("Load erase signing key failed: %v", err)
+	}
+
+	method := configs.Erase.Method
+	if method == rplib.ERASE_METHOD_AUTO {
+		method = rplib.EraseMethodFor(parts.TargetDevPath)
+	}
+
+	cert := rplib.EraseCertificate{
+		Device: parts.TargetDevPath,
+		Serial: rplib.DeviceSerial(parts.TargetDevPath),
+		Method: method,
+		Start:  time.Now().UTC(),
+	}
+
+	log.Printf("Erase %s (serial: %s) with method: %s", cert.Device, cert.Serial, method)
+	err = eraseWith(method, parts.TargetDevPath)
+	if err != nil && method != rplib.ERASE_METHOD_OVERWRITE {
+		log.Printf("Erase with %s failed: %v, fallback to %s", method, err, rplib.ERASE_METHOD_OVERWRITE)
+		cert.Method = fmt.Sprintf("%s,%s", method, rplib.ERASE_METHOD_OVERWRITE)
+		err = eraseWith(rplib.ERASE_METHOD_OVERWRITE, parts.TargetDevPath)
+	}
+
+	cert.End = time.Now().UTC()
+	cert.Result = rplib.ERASE_RESULT_PASS
+	if err != nil {
+		cert.Result = rplib.ERASE_RESULT_FAIL
+		cert.Error = err.Error()
+	}
+
+	if serr := cert.Sign(key); serr != nil {
+		return serr
+	}
+	logDir := filepath.Join(sourceRwDir, configs.Recovery.OemLogDir)
+	if serr := os.MkdirAll(logDir, 0755); serr != nil {
+		return serr
+	}
+	certFile := filepath.Join(logDir, fmt.Sprintf("erase-%s-%s.json", parts.TargetDevNode, cert.Start.Format("20060102T150405Z")))
+	if serr := cert.Save(certFile); serr != nil {
+		return serr
+	}
+	log.Printf("Erase certificate saved: %s", certFile)
+
+	return err
+}
@@ -20,11 +20,9 @@
 package main
 
 import (
-	"fmt"
 	"log"
 	"os"
 	"os/exec"
-	"strings"
 
 	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
 )
@@ -35,16 +33,6 @@ func mib2Blocks(size int) int {
 	return s
 }
 
-func fmtPartPath(devPath string, nr int) string {
-	var partPath string
-	if strings.Contains(devPath, "mmcblk") || strings.Contains(devPath, "mapper/") || strings.Contains(devPath, "nvme") || strings.Contains(devPath, "md126") {
-		partPath = fmt.Sprintf("%sp%d", devPath, nr)
-	} else {
-		partPath = fmt.Sprintf("%s%d", devPath, nr)
-	}
-	return partPath
-}
-
 func usbhid() {
 	log.Println("Load hid-generic and usbhid drivers for usb keyboard")
 
@@ -0,0 +1,99 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+var targetImage = flag.String("target-image", "", "Install to the disk image file instead of a disk")
+var targetSize = flag.String("size", "", "Size of the disk image file with K, M, G suffix, e.g. 16G")
+var compress = flag.String("compress", "", "Compress the disk image file after install: gzip or xz")
+
+// checkImageFlags() checks the flags of the disk image install
+func checkImageFlags() error {
+	if *targetImage == "" {
+		if *targetSize != "" || *compress != "" {
+			return fmt.Errorf("-size and -compress need -target-image")
+		}
+		return nil
+	}
+	if *targetSize == "" {
+		return fmt.Errorf("-target-image needs -size")
+	}
+	switch *compress {
+	case rplib.COMPRESS_NONE, rplib.COMPRESS_GZIP, rplib.COMPRESS_XZ:
+	default:
+		return fmt.Errorf("Unsupported compression: %q", *compress)
+	}
+	return nil
+}
+
+// installToImage() creates the sparse image file, attaches it to a loop
+// device as the target disk, and runs the install. The loop device is always
+// detached, the image is compressed only if the install succeeds.
+func installToImage(installerLabel string) (code int) {
+	size, err := rplib.ParseGadgetSize(*targetSize)
+	if err != nil {
+		log.Println("Invalid image size:", err)
+		return -1
+	}
+	if err = rplib.CreateSparseImage(*targetImage, size); err != nil {
+		log.Println("Create target image failed:", err)
+		return -1
+	}
+	loop, err := rplib.LoopAttach(*targetImage)
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	configs.Recovery.RecoveryDevice = loop
+
+	detached := false
+	defer func() {
+		if !detached {
+			// the partitions of the loop device may be still mounted
+			mounts.UnmountAll()
+			rplib.LoopDetach(loop)
+		}
+	}()
+
+	if code = install(installerLabel); code != 0 {
+		return code
+	}
+
+	rplib.Shellexec("sync")
+	detached = true
+	if err = rplib.LoopDetach(loop); err != nil {
+		log.Println(err)
+		return -1
+	}
+	file, err := rplib.CompressImage(*targetImage, *compress)
+	if err != nil {
+		log.Println(err)
+		return -1
+	}
+	log.Printf("target image %s created", file)
+	return 0
+}
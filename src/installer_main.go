@@ -36,14 +36,19 @@ var commitstamp string
 var build_date string
 
 const (
-	RECO_ROOT_DIR    = "/run/recovery/"
-	CONFIG_YAML      = RECO_ROOT_DIR + "recovery/config.yaml"
-	RECO_TAR_MNT_DIR = "/tmp/recoMnt/"
-	SYSBOOT_MNT_DIR  = "/tmp/system-boot/"
+	RECO_ROOT_DIR = "/run/recovery/"
+	CONFIG_YAML   = RECO_ROOT_DIR + "recovery/config.yaml"
+	GADGET_DIR    = RECO_ROOT_DIR + "recovery/gadget/"
+	GADGET_YAML   = GADGET_DIR + "meta/gadget.yaml"
 )
 
 var configs rplib.ConfigRecovery
 
+var mounts = rplib.NewMountManager()
+
+var privateMountNs = flag.Bool("private-mount-ns", false, "Run in a private mount namespace, the mounts are not visible to the host")
+var eraseConfirm = flag.Bool("erase-confirm", false, "Confirm to erase all data on the target disk when erase is enabled in config.yaml")
+
 func parseConfigs(configFilePath string) {
 	var configPath string
 	if "" == configFilePath {
@@ -70,30 +75,200 @@ var getPartitions = GetPartitions
 
 func main() {
 	flag.Parse()
-	if len(flag.Args()) != 1 {
+	// "install" is the optional command before the flags:
+	// install -target-image out.img -size 16G [INSTALLER_LABEL]
+	if flag.Arg(0) == "install" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	// INSTALLER_LABEL is optional with -target-image, from config.yaml
+	if len(flag.Args()) > 1 || (len(flag.Args()) == 0 && *targetImage == "") {
 		log.Panicf(fmt.Sprintf("Need a argument of [INSTALLER_LABEL]. Current arguments: %v", flag.Args()))
 	}
+	err := checkImageFlags()
+	if err != nil {
+		log.Panicf(err.Error())
+	}
 	InstallerLabel := flag.Arg(0)
-	log.Printf("INSTALLER_LABEL: %s", InstallerLabel)
+	if InstallerLabel != "" {
+		log.Printf("INSTALLER_LABEL: %s", InstallerLabel)
+	}
+
+	if *privateMountNs && !rplib.InPrivateMountNamespace() {
+		code, err := rplib.ExecInPrivateMountNamespace()
+		if err != nil {
+			log.Println("Run in private mount namespace failed:", err)
+		}
+		os.Exit(code)
+	}
+	os.Exit(run(InstallerLabel))
+}
+
+// run() runs the installer and returns the exit code.
+// All mounts are unmounted when it returns or panics.
+func run(InstallerLabel string) int {
+	defer mounts.UnmountAll()
 
-	// setup if now is ubuntu server curtin image
-	err := envForUbuntuClassic()
+	// find and mount the installer media
+	err := mountSource(InstallerLabel)
 	if err != nil {
-		os.Exit(-1)
+		log.Println("Mount installer media failed:", err)
+		return -1
 	}
 
 	parseConfigs(CONFIG_YAML)
+	if InstallerLabel == "" {
+		InstallerLabel = configs.Recovery.InstallerFsLabel
+		if InstallerLabel == "" {
+			log.Println("No INSTALLER_LABEL argument, and no installerfslabel in config.yaml")
+			return -1
+		}
+		log.Printf("INSTALLER_LABEL: %s, from config.yaml", InstallerLabel)
+	} else if configs.Recovery.InstallerFsLabel != "" && configs.Recovery.InstallerFsLabel != InstallerLabel {
+		log.Printf("INSTALLER_LABEL %s is not the installerfslabel %s in config.yaml", InstallerLabel, configs.Recovery.InstallerFsLabel)
+	}
+
+	// fail before touching the target disk or image if a snap to seed is missing
+	if err := checkSeedSnaps(); err != nil {
+		log.Println(err)
+		stageErrors = append(stageErrors, err)
+		reportResult(-1)
+		return -1
+	}
+
+	if *targetImage != "" {
+		if configs.Targets.Policy != "" {
+			log.Println("-target-image can't be used with targets in config.yaml")
+			return -1
+		}
+		if configs.Configs.Writable.Key == rplib.KEY_SOURCE_TPM {
+			log.Println("-target-image can't be used with the writable key in TPM")
+			return -1
+		}
+		return installToImage(InstallerLabel)
+	}
+	if configs.Targets.Policy != "" && configs.Configs.Writable.Layout == rplib.WRITABLE_LAYOUT_LUKS_LVM {
+		log.Println("targets in config.yaml can't be used with the luks-lvm writable layout, the volume group names conflict")
+		return -1
+	}
+	if configs.Targets.Policy != "" && (configs.Boot.First != "" || configs.Boot.Next != "" || configs.Boot.RemoveStale) {
+		log.Println("targets in config.yaml can't be used with the boot section, no boot entry is created for the targets")
+		return -1
+	}
+	// the operator confirms the erase on the command line, before the UI and
+	// before any target disk is touched
+	if configs.Erase.Enable && !*eraseConfirm {
+		err := fmt.Errorf("Erase is enabled in config.yaml, but not confirmed with -erase-confirm")
+		log.Println(err)
+		stageErrors = append(stageErrors, err)
+		reportResult(-1)
+		return -1
+	}
+
+	startUI()
+	// refuse to install the units which failed the factory diagnostics
+	if !checkFactoryDiag() {
+		log.Println("Install refused by the factory diagnostics result")
+		reportResult(-1)
+		return -1
+	}
+	// fail before touching the target disk if the boot policy can't apply
+	if err := checkBootPolicy(); err != nil {
+		log.Println(err)
+		stageErrors = append(stageErrors, err)
+		reportResult(-1)
+		return -1
+	}
 
+	// the end user confirms the factory restore from the recovery boot entry
+	if recoveryType() == rplib.FACTORY_RESTORE {
+		if !confirmRestore() {
+			log.Println("Factory restore cancelled")
+			return 0
+		}
+		restoreConfirmed = true
+	}
+	code := install(InstallerLabel)
+	reportResult(code)
+	return code
+}
+
+// install() installs the recovery partition to the target disk,
+// and returns the exit code.
+func install(InstallerLabel string) int {
 	// Find boot device, all other partiitons info
 	parts, err := getPartitions(InstallerLabel)
 	if err != nil {
 		log.Panicf("Installer partition not found, error: %s\n", err)
 	}
+	// the partitions of the target disk before the install, for the stale boot entries
+	oldSigs := partitionSignatures([]string{parts.TargetDevPath})
+
+	// install to multiple targets at once
+	if configs.Targets.Policy != "" {
+		return installMulti(parts)
+	}
+
+	// confirm the target disk with the operator before wiping it
+	if *targetImage == "" && !confirmTargets([]string{parts.TargetDevPath}) {
+		return -1
+	}
+	eraseStage := configs.Erase.Enable && *targetImage == ""
+	stages := []string{UI_STAGE_RECOVERY}
+	if eraseStage {
+		stages = append([]string{UI_STAGE_ERASE}, stages...)
+	}
+	if configs.Configs.Writable.Layout != "" {
+		stages = append(stages, UI_STAGE_WRITABLE)
+	}
+	if *targetImage == "" {
+		stages = append(stages, UI_STAGE_BOOT)
+	}
+	ui.SetStages(stages...)
+
+	// wipe the target disk for refurbishment, the new image file is empty
+	if eraseStage {
+		err = runStage(UI_STAGE_ERASE, func() error { return EraseTarget(parts) })
+		if err != nil {
+			log.Println("Erase target failed:", err)
+			return -1
+		}
+	}
 
 	// copy from installer to recovery partition
-	err = CopyRecoveryPart(parts)
+	err = runStage(UI_STAGE_RECOVERY, func() error { return CopyRecoveryPart(parts) })
+	if err != nil {
+		return -1
+	}
+
+	// create the writable partition with the layout in config.yaml
+	if configs.Configs.Writable.Layout != "" {
+		err = runStage(UI_STAGE_WRITABLE, func() error { return CreateWritable(parts) })
+		if err != nil {
+			log.Println("Create writable partition failed:", err)
+			return -1
+		}
+	}
+
+	// the boot entries of the disk image are not for this machine
+	if *targetImage != "" {
+		return 0
+	}
+
+	err = runStage(UI_STAGE_BOOT, func() error {
+		// add the UEFI boot entry of the recovery partition
+		if err := AddBootEntries(parts); err != nil {
+			log.Println("Add boot entries failed:", err)
+			return err
+		}
+		// set the boot order for the next boot
+		if err := ApplyBootPolicy(parts, oldSigs); err != nil {
+			log.Println("Apply boot policy failed:", err)
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		os.Exit(-1)
+		return -1
 	}
-	os.Exit(0)
+	return 0
 }
@@ -0,0 +1,129 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// BIOS boot partition (in MiB) for the grub core image of legacy boot. It is
+// the last GPT entry, so the recovery and writable keep their numbers.
+const (
+	BIOS_BOOT_NR    = 128
+	BIOS_BOOT_BEGIN = 1
+	BIOS_BOOT_END   = 2
+	BIOS_BOOT_NAME  = "BIOS Boot"
+	BIOS_BOOT_TYPE  = "EF02"
+	GRUB_BOOT_IMG   = "pc-boot.img"
+	GRUB_CORE_IMG   = "pc-core.img"
+)
+
+// the grub images of legacy boot on the payload without a gadget (classic)
+const BIOS_BOOT_DIR = RECO_ROOT_DIR + "recovery/bios/"
+
+// bootMode() returns the boot mode in config.yaml, or detects it
+// from the firmware the installer booted with.
+func bootMode() string {
+	if configs.Configs.BootMode != "" {
+		return configs.Configs.BootMode
+	}
+	if configs.Configs.Arch == "amd64" && configs.Configs.Bootloader == "grub" && !rplib.IsEfiBoot() {
+		return rplib.BOOT_MODE_LEGACY
+	}
+	return rplib.BOOT_MODE_UEFI
+}
+
+func needBiosBoot() bool {
+	mode := bootMode()
+	return mode == rplib.BOOT_MODE_LEGACY || mode == rplib.BOOT_MODE_HYBRID
+}
+
+// biosBootVolume() is the same layout of grub pc images as the pc gadget:
+// boot.img in the mbr, and core.img in the BIOS boot partition with
+// its LBA written in boot.img.
+func biosBootVolume() *rplib.GadgetVolume {
+	return &rplib.GadgetVolume{
+		Schema: "gpt",
+		Structure: []rplib.VolumeStructure{
+			{
+				Name:    "mbr",
+				Type:    "mbr",
+				Size:    fmt.Sprintf("%d", rplib.MBR_BOOTCODE_SIZE),
+				Content: []rplib.VolumeContent{{Image: GRUB_BOOT_IMG}},
+			},
+			{
+				Name:        BIOS_BOOT_NAME,
+				Type:        "DA,21686148-6449-6E6F-744E-656564454649",
+				Offset:      fmt.Sprintf("%dM", BIOS_BOOT_BEGIN),
+				OffsetWrite: "mbr+92",
+				Size:        fmt.Sprintf("%dM", BIOS_BOOT_END-BIOS_BOOT_BEGIN),
+				Content:     []rplib.VolumeContent{{Image: GRUB_CORE_IMG}},
+			},
+		},
+	}
+}
+
+// biosBootImageDir() returns the payload dir with the grub images of legacy
+// boot: the gadget of ubuntu core, or BIOS_BOOT_DIR.
+func biosBootImageDir() (string, error) {
+	for _, dir := range []string{GADGET_DIR, BIOS_BOOT_DIR} {
+		found := true
+		for _, img := range []string{GRUB_BOOT_IMG, GRUB_CORE_IMG} {
+			if _, err := os.Stat(filepath.Join(dir, img)); err != nil {
+				found = false
+			}
+		}
+		if found {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("grub %s and %s for %s boot not found in %s or %s of the payload", GRUB_BOOT_IMG, GRUB_CORE_IMG, bootMode(), GADGET_DIR, BIOS_BOOT_DIR)
+}
+
+// createBiosBootPart() creates the BIOS boot partition before the recovery
+// partition, with the number BIOS_BOOT_NR which parted can't choose.
+func createBiosBootPart(parts *Partitions) {
+	rplib.Shellexec("sgdisk",
+		fmt.Sprintf("--new=%d:%dM:+%dM", BIOS_BOOT_NR, BIOS_BOOT_BEGIN, BIOS_BOOT_END-BIOS_BOOT_BEGIN),
+		fmt.Sprintf("--typecode=%d:%s", BIOS_BOOT_NR, BIOS_BOOT_TYPE),
+		fmt.Sprintf("--change-name=%d:%s", BIOS_BOOT_NR, BIOS_BOOT_NAME),
+		parts.TargetDevPath)
+}
+
+// writeBiosBootImages() writes grub boot.img and core.img for legacy boot,
+// unless the gadget volume already has them.
+func writeBiosBootImages(parts *Partitions) error {
+	if gadgetHasMbr() {
+		return nil
+	}
+	dir, err := biosBootImageDir()
+	if err != nil {
+		return err
+	}
+	log.Printf("write grub %s and %s of %s to %s for %s boot", GRUB_BOOT_IMG, GRUB_CORE_IMG, dir, parts.TargetDevPath, bootMode())
+	// core.img goes into the BIOS boot partition, only the recovery is protected
+	recovery := []rplib.PartitionExtent{{Name: configs.Recovery.FsLabel, Start: parts.Recovery_start, End: parts.Recovery_end}}
+	return rplib.WriteRawContent(parts.TargetDevPath, biosBootVolume(), dir, recovery)
+}
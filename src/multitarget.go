@@ -0,0 +1,260 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// targetResult is the install status of one target disk in multi-target install
+type targetResult struct {
+	Disk       string
+	Err        error
+	Start, End time.Time
+
+	parts        *Partitions
+	recoveryPath string
+	recoMnt      string
+}
+
+// selectTargets() returns the target disk paths by the policy in config.yaml
+func selectTargets(parts *Partitions) ([]string, error) {
+	disks := []string{}
+	switch configs.Targets.Policy {
+	case rplib.TARGET_POLICY_LIST:
+		seen := map[string]bool{}
+		for _, dev := range configs.Targets.Devices {
+			node := rplib.DiskNode(dev)
+			if node == parts.SourceDevNode {
+				return nil, fmt.Errorf("Target %s is the installer media", dev)
+			}
+			if !seen[node] {
+				seen[node] = true
+				disks = append(disks, "/dev/"+node)
+			}
+		}
+	case rplib.TARGET_POLICY_ALL:
+		nodes, err := rplib.ListDisks()
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			if node != parts.SourceDevNode {
+				disks = append(disks, "/dev/"+node)
+			}
+		}
+		if configs.Targets.Count > 0 {
+			if len(disks) < configs.Targets.Count {
+				return nil, fmt.Errorf("Only %d target disks found %v, %d required", len(disks), disks, configs.Targets.Count)
+			}
+			disks = disks[:configs.Targets.Count]
+		}
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("No target disk found")
+	}
+	return disks, nil
+}
+
+// parallel() runs the step on all the targets not failed yet concurrently.
+// The error or panic of the step fails only that target.
+func parallel(results []*targetResult, step func(r *targetResult) error) {
+	var wg sync.WaitGroup
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(r *targetResult) {
+			defer wg.Done()
+			defer func() {
+				if p := recover(); p != nil {
+					r.Err = fmt.Errorf("%v", p)
+				}
+				if r.Err != nil {
+					log.Printf("install to %s failed: %v", r.Disk, r.Err)
+				}
+			}()
+			r.Err = step(r)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// copyToTargets() copies the recovery data to the mounted recovery partitions
+// of the targets, reading the source once. It returns the checksums of the
+// copied files to verify, or nil if the copy failed.
+func copyToTargets(results []*targetResult) map[string]string {
+	src := RECO_ROOT_DIR
+	if u := payloadUrl(); u != "" {
+		mnt, cleanup, err := mountNetworkPayload(u)
+		if err != nil {
+			for _, r := range results {
+				if r.Err == nil {
+					r.Err = err
+				}
+			}
+			return nil
+		}
+		defer cleanup()
+		src = mnt
+	}
+
+	active := []*targetResult{}
+	dsts := []string{}
+	for _, r := range results {
+		if r.Err == nil {
+			active = append(active, r)
+			dsts = append(dsts, r.recoMnt)
+		}
+	}
+	log.Printf("copy %s to %d targets", src, len(dsts))
+	manifest, errs := rplib.CopyTreeMulti(src, dsts)
+	for i, r := range active {
+		r.Err = errs[i]
+	}
+	return manifest
+}
+
+// verifyTarget() remounts the recovery partition to read the data back from
+// the disk, verifies it, copies the gadget content over it, and sets the
+// recovery type.
+func verifyTarget(r *targetResult, manifest map[string]string) error {
+	rplib.Shellexec("sync")
+	if manifest != nil {
+		err := mounts.UnmountOnly(r.recoMnt)
+		r.recoMnt = ""
+		if err != nil {
+			return err
+		}
+		if r.recoMnt, err = mounts.MountTemp(r.recoveryPath, "vfat", 0, ""); err != nil {
+			return err
+		}
+		log.Printf("verify %s", r.Disk)
+		if err = rplib.VerifyTree(r.recoMnt, manifest); err != nil {
+			return err
+		}
+	}
+
+	if err := populateRecoveryContent(r.recoMnt); err != nil {
+		return err
+	}
+	// set target bootloader env to factory_install
+	return setRecoveryType(r.recoMnt, rplib.FACTORY_INSTALL)
+}
+
+// prepareTarget() wipes the target disk for refurbishment if the erase is
+// enabled, creates the recovery partition and mounts it.
+func prepareTarget(r *targetResult) error {
+	if configs.Erase.Enable {
+		if err := EraseTarget(r.parts); err != nil {
+			return err
+		}
+	}
+	var err error
+	if r.recoveryPath, err = prepareRecoveryPart(r.parts); err != nil {
+		return err
+	}
+	r.recoMnt, err = mounts.MountTemp(r.recoveryPath, "vfat", 0, "")
+	return err
+}
+
+// the install steps of installMulti(), easier for function mocking
+var targetSteps = struct {
+	prepare  func(r *targetResult) error
+	copy     func(results []*targetResult) map[string]string
+	verify   func(r *targetResult, manifest map[string]string) error
+	writable func(r *targetResult) error
+}{
+	prepare:  prepareTarget,
+	copy:     copyToTargets,
+	verify:   verifyTarget,
+	writable: func(r *targetResult) error { return CreateWritable(r.parts) },
+}
+
+// installMulti() installs the recovery partition to all the target disks
+// selected by the policy at once, and reports the result of each disk.
+// A failed disk doesn't stop the others. No UEFI boot entry is created: the
+// targets are for other machines, booted by the removable media loader.
+func installMulti(parts *Partitions) int {
+	disks, err := selectTargets(parts)
+	if err != nil {
+		log.Println("Select target disks failed:", err)
+		return -1
+	}
+	// the missing gadget content is reported before the disks are touched
+	if err = checkRecoveryContent(); err != nil {
+		log.Println("Check gadget content failed:", err)
+		return -1
+	}
+	log.Printf("install to %d targets: %v", len(disks), disks)
+	if !confirmTargets(disks) {
+		return -1
+	}
+
+	results := []*targetResult{}
+	for _, disk := range disks {
+		p := *parts
+		setTargetDev(&p, disk)
+		results = append(results, &targetResult{Disk: p.TargetDevPath, Start: time.Now(), parts: &p})
+	}
+	// a stage per target in the UI
+	for _, r := range results {
+		ui.Start(r.Disk)
+	}
+
+	parallel(results, targetSteps.prepare)
+
+	manifest := targetSteps.copy(results)
+
+	parallel(results, func(r *targetResult) error {
+		return targetSteps.verify(r, manifest)
+	})
+
+	parallel(results, targetSteps.writable)
+
+	failed := 0
+	log.Println("Install summary:")
+	for _, r := range results {
+		if r.recoMnt != "" {
+			mounts.UnmountOnly(r.recoMnt)
+		}
+		r.End = time.Now()
+		status := "PASS"
+		if r.Err != nil {
+			status = fmt.Sprintf("FAIL (%v)", r.Err)
+			stageErrors = append(stageErrors, fmt.Errorf("%s: %v", r.Disk, r.Err))
+			failed++
+		}
+		ui.Done(r.Disk, r.Err)
+		log.Printf("  %s: %s, %v", r.Disk, status, r.End.Sub(r.Start).Round(time.Second))
+	}
+	log.Printf("%d of %d targets installed", len(results)-failed, len(results))
+
+	if failed > 0 {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,209 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type MultiTargetSuite struct {
+	oldConfigs     rplib.ConfigRecovery
+	oldSysClass    string
+	oldStageErrors []error
+	oldSteps       struct {
+		prepare  func(r *targetResult) error
+		copy     func(results []*targetResult) map[string]string
+		verify   func(r *targetResult, manifest map[string]string) error
+		writable func(r *targetResult) error
+	}
+}
+
+var _ = Suite(&MultiTargetSuite{})
+
+func (s *MultiTargetSuite) SetUpTest(c *C) {
+	s.oldConfigs, s.oldSysClass, s.oldStageErrors = configs, rplib.SysClassBlockDir, stageErrors
+	s.oldSteps = targetSteps
+	rplib.SysClassBlockDir = filepath.Join(c.MkDir(), "sys/class/block")
+	stageErrors = nil
+}
+
+func (s *MultiTargetSuite) TearDownTest(c *C) {
+	configs, rplib.SysClassBlockDir, stageErrors = s.oldConfigs, s.oldSysClass, s.oldStageErrors
+	targetSteps = s.oldSteps
+}
+
+// addDisk() adds the disk of size sectors, or the partition nr of the disk,
+// to the fake sysfs
+func addDisk(c *C, node string, size int, disk string, nr int) {
+	dir := filepath.Join(rplib.SysClassBlockDir, node)
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	if disk != "" {
+		c.Assert(os.Symlink(dir, filepath.Join(rplib.SysClassBlockDir, disk, node)), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "partition"), []byte(strconv.Itoa(nr)+"\n"), 0644), IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "size"), []byte(strconv.Itoa(size)+"\n"), 0644), IsNil)
+}
+
+func (s *MultiTargetSuite) TestSelectTargetsList(c *C) {
+	parts := &Partitions{SourceDevNode: "vda"}
+	configs.Targets.Policy = rplib.TARGET_POLICY_LIST
+	configs.Targets.Devices = []string{"/dev/vdb", "/dev/vdc", "/dev/vdb"}
+	disks, err := selectTargets(parts)
+	c.Assert(err, IsNil)
+	c.Assert(disks, DeepEquals, []string{"/dev/vdb", "/dev/vdc"})
+
+	configs.Targets.Devices = []string{"/dev/vdb", "/dev/vda"}
+	_, err = selectTargets(parts)
+	c.Assert(err, ErrorMatches, "Target /dev/vda is the installer media")
+}
+
+func (s *MultiTargetSuite) TestSelectTargetsAll(c *C) {
+	addDisk(c, "sda", 8, "", 0)
+	addDisk(c, "sda1", 4, "sda", 1)
+	addDisk(c, "sdb", 8, "", 0)
+	addDisk(c, "sdc", 8, "", 0)
+	// a card reader without card
+	addDisk(c, "sdd", 0, "", 0)
+	parts := &Partitions{SourceDevNode: "sda"}
+
+	configs.Targets.Policy = rplib.TARGET_POLICY_ALL
+	disks, err := selectTargets(parts)
+	c.Assert(err, IsNil)
+	c.Assert(disks, DeepEquals, []string{"/dev/sdb", "/dev/sdc"})
+
+	configs.Targets.Count = 1
+	disks, err = selectTargets(parts)
+	c.Assert(err, IsNil)
+	c.Assert(disks, DeepEquals, []string{"/dev/sdb"})
+
+	configs.Targets.Count = 3
+	_, err = selectTargets(parts)
+	c.Assert(err, ErrorMatches, `Only 2 target disks found \[/dev/sdb /dev/sdc\], 3 required`)
+
+	parts.SourceDevNode = "sdb"
+	configs.Targets.Count = 0
+	os.RemoveAll(filepath.Join(rplib.SysClassBlockDir, "sda"))
+	os.RemoveAll(filepath.Join(rplib.SysClassBlockDir, "sdc"))
+	_, err = selectTargets(parts)
+	c.Assert(err, ErrorMatches, "No target disk found")
+}
+
+// fakeTargets() fakes the install steps of installMulti() on the directories
+// of the targets, the prepare of the target fail fails.
+func fakeTargets(c *C, fail string) (dirs map[string]string, done map[string][]string) {
+	src := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(src, "recovery"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "recovery/config.yaml"), []byte("project: pc\n"), 0644), IsNil)
+
+	dirs = map[string]string{}
+	done = map[string][]string{}
+	var lock sync.Mutex
+	record := func(step string, r *targetResult) {
+		lock.Lock()
+		defer lock.Unlock()
+		done[step] = append(done[step], r.Disk)
+		sort.Strings(done[step])
+	}
+	targetSteps.prepare = func(r *targetResult) error {
+		if r.Disk == fail {
+			return errors.New("prepare failed")
+		}
+		lock.Lock()
+		dirs[r.Disk] = c.MkDir()
+		lock.Unlock()
+		record("prepare", r)
+		return nil
+	}
+	targetSteps.copy = func(results []*targetResult) map[string]string {
+		active := []*targetResult{}
+		dsts := []string{}
+		for _, r := range results {
+			if r.Err == nil {
+				active = append(active, r)
+				dsts = append(dsts, dirs[r.Disk])
+			}
+		}
+		manifest, errs := rplib.CopyTreeMulti(src, dsts)
+		for i, r := range active {
+			r.Err = errs[i]
+		}
+		return manifest
+	}
+	targetSteps.verify = func(r *targetResult, manifest map[string]string) error {
+		record("verify", r)
+		return rplib.VerifyTree(dirs[r.Disk], manifest)
+	}
+	targetSteps.writable = func(r *targetResult) error {
+		record("writable", r)
+		return nil
+	}
+	return dirs, done
+}
+
+// A failed target doesn't stop the others, and is reported
+func (s *MultiTargetSuite) TestInstallMultiOneFailed(c *C) {
+	configs.Targets.Policy = rplib.TARGET_POLICY_LIST
+	configs.Targets.Devices = []string{"/dev/vdb", "/dev/vdc", "/dev/vdd"}
+	_, done := fakeTargets(c, "/dev/vdc")
+
+	c.Assert(installMulti(&Partitions{SourceDevNode: "vda"}), Equals, -1)
+	c.Check(done["prepare"], DeepEquals, []string{"/dev/vdb", "/dev/vdd"})
+	c.Check(done["verify"], DeepEquals, []string{"/dev/vdb", "/dev/vdd"})
+	c.Check(done["writable"], DeepEquals, []string{"/dev/vdb", "/dev/vdd"})
+	c.Assert(stageErrors, HasLen, 1)
+	c.Check(stageErrors[0], ErrorMatches, "/dev/vdc: prepare failed")
+}
+
+// A target failed in the copy is not verified nor gets the writable
+func (s *MultiTargetSuite) TestInstallMultiCopyFailed(c *C) {
+	configs.Targets.Policy = rplib.TARGET_POLICY_LIST
+	configs.Targets.Devices = []string{"/dev/vdb", "/dev/vdc"}
+	dirs, done := fakeTargets(c, "")
+	copyAll := targetSteps.copy
+	targetSteps.copy = func(results []*targetResult) map[string]string {
+		// a file in the way of the directory fails the copy
+		c.Assert(ioutil.WriteFile(filepath.Join(dirs["/dev/vdc"], "recovery"), []byte("file"), 0644), IsNil)
+		return copyAll(results)
+	}
+
+	c.Assert(installMulti(&Partitions{SourceDevNode: "vda"}), Equals, -1)
+	c.Check(done["verify"], DeepEquals, []string{"/dev/vdb"})
+	c.Check(done["writable"], DeepEquals, []string{"/dev/vdb"})
+	c.Assert(stageErrors, HasLen, 1)
+	c.Check(stageErrors[0], ErrorMatches, "/dev/vdc: .*not a directory")
+
+	stageErrors = nil
+	targetSteps.copy = copyAll
+	c.Assert(installMulti(&Partitions{SourceDevNode: "vda"}), Equals, 0)
+	c.Assert(stageErrors, HasLen, 0)
+}
@@ -0,0 +1,115 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the kernel command line option of the payload url, overrides config.yaml
+const PAYLOAD_URL_CMDLINE = "oem-installer.payload-url"
+
+// payloadUrl() returns the http payload url of the kernel command line or config.yaml
+func payloadUrl() string {
+	if u := rplib.CmdlineValue(PAYLOAD_URL_CMDLINE); u != "" {
+		return u
+	}
+	return configs.Recovery.PayloadUrl
+}
+
+// copyNetworkPayload() copies the network payload to the recovery partition mounted on dst
+func copyNetworkPayload(payloadUrl string, dst string) error {
+	mnt, cleanup, err := mountNetworkPayload(payloadUrl)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	rplib.Shellcmd(fmt.Sprintf("rsync -aH %s/ %s", mnt, dst))
+	return nil
+}
+
+// mountNetworkPayload() downloads the payload to the cache dir on the
+// installer media (or a temporary dir if no cache), and mounts it read-only.
+// It returns the mount point, and the cleanup function to unmount it and
+// remove the temporary download.
+func mountNetworkPayload(payloadUrl string) (string, func(), error) {
+	u, err := url.Parse(payloadUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", nil, fmt.Errorf("Invalid payload url: %q", payloadUrl)
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return "", nil, fmt.Errorf("No payload file name in url: %q", payloadUrl)
+	}
+
+	var dir string
+	cleanups := []func(){}
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			cleanups[i]()
+		}
+	}
+	if configs.Recovery.PayloadCacheDir != "" {
+		dir = filepath.Join(sourceRwDir, configs.Recovery.PayloadCacheDir)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return "", nil, err
+		}
+	} else {
+		if dir, err = ioutil.TempDir("", "oem-installer-payload-"); err != nil {
+			return "", nil, err
+		}
+		cleanups = append(cleanups, func() { os.RemoveAll(dir) })
+	}
+
+	file := filepath.Join(dir, name)
+	log.Printf("download payload %s to %s", payloadUrl, file)
+	logProgress := rplib.LogProgress(name)
+	uiProgress := ui.DownloadProgress(UI_STAGE_RECOVERY)
+	err = rplib.DownloadFile(payloadUrl, file, configs.Recovery.PayloadSha256, func(done, total int64) {
+		logProgress(done, total)
+		uiProgress(done, total)
+	})
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	mnt, err := ioutil.TempDir("", "oem-installer-mnt-")
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	cleanups = append(cleanups, func() { os.Remove(mnt) })
+	if err = rplib.MountImageReadOnly(file, mnt, mounts); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	cleanups = append(cleanups, func() { mounts.Unmount(mnt) })
+	return mnt, cleanup, nil
+}
@@ -28,7 +28,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 
 	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
 )
@@ -94,47 +94,54 @@ const (
 	SwapLabel     = "swap"
 )
 
+// the time to wait the partition device node after partitioning
+const PART_WAIT_TIMEOUT = 30 * time.Second
+
+// FindPart() finds the only partition with the filesystem label.
+// It fails if the label is not found, or found on more than one partition.
 func FindPart(Label string) (devNode string, devPath string, partNr int, err error) {
-	partNr = -1
-	cmd := exec.Command("findfs", fmt.Sprintf("LABEL=%s", Label))
-	out, err := cmd.Output()
+	return FindPartOn(Label, "")
+}
+
+// FindPartOn() finds the partition with the filesystem label on the disk node,
+// or on any disk if diskNode is empty.
+func FindPartOn(Label string, diskNode string) (devNode string, devPath string, partNr int, err error) {
+	found, err := rplib.FindPartsByLabel(Label)
 	if err != nil {
-		return
-	}
-	fullPath := strings.TrimSpace(string(out[:]))
-
-	if strings.Contains(fullPath, "/dev/") == false {
-		err = errors.New(fmt.Sprintf("Label of %q not found", Label))
-		return
-	}
-	devPath = fullPath
-
-	// The devPath is with partiion /dev/sdX1 or /dev/mmcblkXp1
-	// Here to remove the partition information
-	for {
-		if _, err := strconv.Atoi(string(devPath[len(devPath)-1])); err == nil {
-			devPath = devPath[:len(devPath)-1]
-		} else {
-			part_nr := strings.TrimPrefix(fullPath, devPath)
-			if partNr, err = strconv.Atoi(part_nr); err != nil {
-				err = errors.New("Unknown error while FindPart")
-				return "", "", -1, err
-			}
-			if devPath[len(devPath)-1] == 'p' {
-				devPath = devPath[:len(devPath)-1]
-			}
-			break
+		return "", "", -1, err
+	}
+
+	matches := []rplib.PartInfo{}
+	for _, part := range found {
+		if diskNode == "" || part.DiskNode == diskNode {
+			matches = append(matches, part)
 		}
 	}
 
-	field := strings.Split(devPath, "/")
-	devNode = field[len(field)-1]
+	switch len(matches) {
+	case 0:
+		return "", "", -1, fmt.Errorf("Label of %q not found", Label)
+	case 1:
+		part := matches[0]
+		log.Printf("Label %q found: %s (disk: %s, partition: %d, UUID: %s)", Label, part.Path, part.DiskPath, part.Nr, part.UUID)
+		return part.DiskNode, part.DiskPath, part.Nr, nil
+	}
 
-	return
+	paths := []string{}
+	for _, part := range matches {
+		paths = append(paths, fmt.Sprintf("%s (UUID: %s)", part.Path, part.UUID))
+	}
+	return "", "", -1, fmt.Errorf("Label of %q found on more than one partition: %s", Label, strings.Join(paths, ", "))
+}
+
+// setTargetDev() sets the target to the whole disk of the device path,
+// which can be a partition or a symlink like /dev/disk/by-id/...
+func setTargetDev(parts *Partitions, devPath string) {
+	parts.TargetDevNode = rplib.DiskNode(devPath)
+	parts.TargetDevPath = filepath.Join("/dev", parts.TargetDevNode)
 }
 
 func FindTargetParts(parts *Partitions) error {
-	var devPath string
 	if parts.SourceDevNode == "" || parts.SourceDevPath == "" || parts.Recovery_nr == -1 {
 		return fmt.Errorf("Missing source recovery data")
 	}
@@ -143,114 +150,54 @@ func FindTargetParts(parts *Partitions) error {
 	// it would use is as recovery device.
 	// Or it would find out the recovery device
 	if configs.Recovery.RecoveryDevice != "" {
-		parts.TargetDevPath = configs.Recovery.RecoveryDevice
-		parts.TargetDevNode = filepath.Base(parts.TargetDevPath)
-	} else {
-		// target disk might raid devices (/dev/md126)
-		if _, err := os.Stat("/sys/block/md126/dev"); err == nil {
-			log.Println("found raid devices enabled in BIOS")
-			dat := []byte("")
-			dat, err := ioutil.ReadFile("/sys/block/md126/dev")
-			if err != nil {
+		setTargetDev(parts, configs.Recovery.RecoveryDevice)
+		if rplib.IsLoop(parts.TargetDevPath) {
+			// the partitions of the image file need the loop partition scan
+			if err := rplib.LoopEnablePartScan(parts.TargetDevPath); err != nil {
 				return err
 			}
-			dat_str := strings.TrimSpace(string(dat))
-			blockDevice := rplib.Realpath(fmt.Sprintf("/dev/block/%s", dat_str))
-			if blockDevice != parts.SourceDevPath {
-				parts.TargetDevPath = blockDevice
-				parts.TargetDevNode = filepath.Base(parts.TargetDevPath)
-				return nil
-			}
 		}
+		return nil
+	}
 
-		// target disk might be emmc
-		if devPath == "" {
-			blockArray, _ := filepath.Glob("/sys/block/mmcblk*")
-			for _, block := range blockArray {
-				dat := []byte("")
-				dat, err := ioutil.ReadFile(filepath.Join(block, "dev"))
-				if err != nil {
-					return err
-				}
-				dat_str := strings.TrimSpace(string(dat))
-				blockDevice := rplib.Realpath(fmt.Sprintf("/dev/block/%s", dat_str))
-				if blockDevice != parts.SourceDevPath {
-					devPath = blockDevice
-					if devPath == "/dev/mmcblk0" {
-						parts.TargetDevPath = devPath
-						parts.TargetDevNode = filepath.Base(parts.TargetDevPath)
-						return nil
-					}
-					break
-				}
-			}
-		}
+	// target disk might be raid array (md, or Intel RST IMSM/DDF volume)
+	if err := rplib.AssembleRaid(configs.Configs.RaidAssemble); err != nil {
+		log.Println("Assemble raid failed:", err)
+	}
+	arrays, err := rplib.RaidTargets(parts.SourceDevNode)
+	if err != nil {
+		return err
+	}
+	if len(arrays) > 0 {
+		log.Printf("found raid array %s (%s, %s), members: %v", arrays[0].Node, arrays[0].Level, arrays[0].Metadata, arrays[0].Members)
+		setTargetDev(parts, arrays[0].Node)
+		return nil
+	}
 
-		// target disk might be scsi disk
-		if devPath == "" {
-			blockArray, _ := filepath.Glob("/sys/block/sd*")
-			for _, block := range blockArray {
-				dat := []byte("")
-				dat, err := ioutil.ReadFile(filepath.Join(block, "dev"))
-				if err != nil {
-					return err
-				}
-				dat_str := strings.TrimSpace(string(dat))
-				blockDevice := rplib.Realpath(fmt.Sprintf("/dev/block/%s", dat_str))
-
-				if blockDevice != parts.SourceDevPath {
-					devPath = blockDevice
-					break
-				}
+	// target disk might be emmc, scsi disk or nvme disk,
+	// the member disks of raid arrays are skipped
+	members := rplib.MdMemberDisks()
+	for _, pattern := range []string{"mmcblk*", "sd*", "nvme*"} {
+		blockArray, _ := filepath.Glob(filepath.Join("/sys/block", pattern))
+		for _, block := range blockArray {
+			if members[filepath.Base(block)] {
+				log.Printf("skip raid member %s", filepath.Base(block))
+				continue
 			}
-		}
-
-		// target disk might be nvme disk
-		if devPath == "" {
-			blockArray, _ := filepath.Glob("/sys/block/nvme*")
-			for _, block := range blockArray {
-				dat := []byte("")
-				dat, err := ioutil.ReadFile(filepath.Join(block, "dev"))
-				if err != nil {
-					return err
-				}
-				dat_str := strings.TrimSpace(string(dat))
-				blockDevice := rplib.Realpath(fmt.Sprintf("/dev/block/%s", dat_str))
-
-				if blockDevice != parts.SourceDevPath {
-					devPath = blockDevice
-					break
-				}
+			dat, err := ioutil.ReadFile(filepath.Join(block, "dev"))
+			if err != nil {
+				return err
 			}
-		}
-
-		if devPath != "" {
-			// The devPath is with partiion for /dev/sdX1 or /dev/mmcblkXp1
-			// but without partition for /dev/nvmeXnX
-			// Here to remove the partition information
-			for {
-				if true == strings.Contains(devPath, "nvme") {
-					parts.TargetDevPath = devPath
-					parts.TargetDevNode = filepath.Base(parts.TargetDevPath)
-					break
-				}
-				if _, err := strconv.Atoi(string(devPath[len(devPath)-1])); err == nil {
-					devPath = devPath[:len(devPath)-1]
-				} else {
-					if devPath[len(devPath)-1] == 'p' {
-						devPath = devPath[:len(devPath)-1]
-					}
-					parts.TargetDevPath = devPath
-					parts.TargetDevNode = filepath.Base(parts.TargetDevPath)
-					break
-				}
+			dat_str := strings.TrimSpace(string(dat))
+			blockDevice := rplib.Realpath(fmt.Sprintf("/dev/block/%s", dat_str))
+			if blockDevice != parts.SourceDevPath {
+				setTargetDev(parts, blockDevice)
+				log.Println("debug: ", parts.TargetDevPath, parts.TargetDevNode)
+				return nil
 			}
-			log.Println("debug: ", parts.TargetDevPath, parts.TargetDevNode)
-		} else {
-			return fmt.Errorf("No target disk found")
 		}
 	}
-	return nil
+	return fmt.Errorf("No target disk found")
 }
 
 var parts Partitions
@@ -261,10 +208,15 @@ func GetPartitions(recoveryLabel string) (*Partitions, error) {
 	parts = Partitions{"", "", "", "", -1, -1, -1, -1, -1, 0, 20479, -1, -1, -1, -1, -1, -1, -1}
 
 	//The Sourec device which must has a recovery partition
-	parts.SourceDevNode, parts.SourceDevPath, parts.Recovery_nr, err = FindPart(recoveryLabel)
-	if err != nil {
-		err = errors.New(fmt.Sprintf("Recovery partition (LABEL=%s) not found", recoveryLabel))
-		return nil, err
+	//or the whole disk of the installer media (cdrom, iso hybrid disk)
+	if source != nil {
+		parts.SourceDevNode, parts.SourceDevPath, parts.Recovery_nr = source.DiskNode, source.DiskPath, source.Nr
+	} else {
+		parts.SourceDevNode, parts.SourceDevPath, parts.Recovery_nr, err = FindPart(recoveryLabel)
+		if err != nil {
+			err = errors.New(fmt.Sprintf("Recovery partition (LABEL=%s) not found: %v", recoveryLabel, err))
+			return nil, err
+		}
 	}
 
 	err = FindTargetParts(&parts)
@@ -275,23 +227,21 @@ func GetPartitions(recoveryLabel string) (*Partitions, error) {
 	}
 
 	//system-boot partition info
-	devnode, _, sysboot_nr, err := FindPart(SysbootLabel)
+	//Target system-boot must not source device in headless_installer mode
+	_, _, sysboot_nr, err := FindPartOn(SysbootLabel, parts.TargetDevNode)
 	if err == nil {
-		if parts.SourceDevNode != devnode {
-			//Target system-boot found and must not source device in headless_installer mode
-			parts.Sysboot_nr = sysboot_nr
-		}
+		parts.Sysboot_nr = sysboot_nr
 	}
 
 	//swap partition info
-	_, _, parts.Swap_nr, err = FindPart(SwapLabel)
+	_, _, parts.Swap_nr, err = FindPartOn(SwapLabel, parts.TargetDevNode)
 	if err != nil {
 		//Partition not found, keep value in '-1'
 		parts.Swap_nr = -1
 	}
 
 	//writable-boot partition info
-	_, _, parts.Writable_nr, err = FindPart(WritableLabel)
+	_, _, parts.Writable_nr, err = FindPartOn(WritableLabel, parts.TargetDevNode)
 	if err != nil {
 		//Partition not found, keep value in '-1'
 		parts.Writable_nr = -1
@@ -353,51 +303,267 @@ func GetPartitions(recoveryLabel string) (*Partitions, error) {
 }
 
 func CopyRecoveryPart(parts *Partitions) error {
+	// the missing gadget content is reported before the disk is touched
+	if err := checkRecoveryContent(); err != nil {
+		return err
+	}
+	recovery_path, err := prepareRecoveryPart(parts)
+	if err != nil {
+		return err
+	}
+
+	// Copy recovery data
+	recoMnt, err := mounts.MountTemp(recovery_path, "vfat", 0, "")
+	if err != nil {
+		return err
+	}
+	defer mounts.Unmount(recoMnt)
+	if u := payloadUrl(); u != "" {
+		err = copyNetworkPayload(u, recoMnt)
+		if err != nil {
+			return err
+		}
+	} else {
+		rplib.Shellcmd(fmt.Sprintf("rsync -aH %s %s", RECO_ROOT_DIR, recoMnt))
+	}
+	if err = populateRecoveryContent(recoMnt); err != nil {
+		return err
+	}
+	rplib.Shellexec("sync")
+
+	// set target bootloader env to factory_install
+	return setRecoveryType(recoMnt, rplib.FACTORY_INSTALL)
+}
+
+// prepareRecoveryPart() creates the partitions on the target disk, writes
+// the bootloader images, and formats the recovery partition. It returns the
+// recovery partition device path.
+func prepareRecoveryPart(parts *Partitions) (string, error) {
 	if parts.SourceDevPath == parts.TargetDevPath {
-		return fmt.Errorf("The source device and target device are same")
+		return "", fmt.Errorf("The source device and target device are same")
+	}
+
+	// the grub images of legacy boot are checked before touching the disk
+	if needBiosBoot() && !gadgetHasMbr() {
+		if _, err := biosBootImageDir(); err != nil {
+			return "", err
+		}
 	}
 
-	parts.Recovery_nr = 1
+	// the new partition table has no system-boot
+	parts.Recovery_nr, parts.Sysboot_nr = 1, -1
 	recoveryBegin := 4
 	if configs.Recovery.RecoverySize <= 0 {
-		return fmt.Errorf("Invalid recovery size: %d", configs.Recovery.RecoverySize)
+		return "", fmt.Errorf("Invalid recovery size: %d", configs.Recovery.RecoverySize)
 	}
 	recoveryEnd := recoveryBegin + configs.Recovery.RecoverySize
+	parts.Recovery_start = int64(recoveryBegin) * 1024 * 1024
+	parts.Recovery_end = int64(recoveryEnd) * 1024 * 1024
 
 	// Build Recovery Partition
-	recovery_path := fmtPartPath(parts.TargetDevPath, parts.Recovery_nr)
-	rplib.Shellexec("parted", "-ms", "-a", "optimal", parts.TargetDevPath,
+	args := []string{"-ms", "-a", "optimal", parts.TargetDevPath,
 		"unit", "MiB",
 		"mklabel", "gpt",
 		"mkpart", "primary", "fat32", fmt.Sprintf("%d", recoveryBegin), fmt.Sprintf("%d", recoveryEnd),
 		"name", fmt.Sprintf("%v", parts.Recovery_nr), configs.Recovery.FsLabel,
-		"set", fmt.Sprintf("%v", parts.Recovery_nr), "boot", "on",
-		"print")
-	exec.Command("partprobe").Run()
-	rplib.Shellexec("sleep", "2") //wait the partition presents
-	rplib.Shellexec("mkfs.vfat", "-F", "32", "-n", configs.Recovery.FsLabel, recovery_path)
+		"set", fmt.Sprintf("%v", parts.Recovery_nr), "boot", "on"}
+	rplib.Shellexec("parted", append(args, "print")...)
+	if needBiosBoot() {
+		// BIOS boot partition for grub core image, before the recovery partition
+		createBiosBootPart(parts)
+	}
 
-	// Copy recovery data
-	err := os.MkdirAll(RECO_TAR_MNT_DIR, 0755)
+	// wait the partitions present before using them
+	err := rplib.RereadPartitions(parts.TargetDevPath)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = syscall.Mount(recovery_path, RECO_TAR_MNT_DIR, "vfat", 0, "")
+	recovery_path, err := rplib.WaitPartition(parts.TargetDevPath, parts.Recovery_nr, PART_WAIT_TIMEOUT)
+	if err != nil {
+		return "", err
+	}
+	if needBiosBoot() {
+		_, err = rplib.WaitPartition(parts.TargetDevPath, BIOS_BOOT_NR, PART_WAIT_TIMEOUT)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Write the bootloader images outside of partitions
+	err = writeRawContent(parts)
+	if err != nil {
+		return "", err
+	}
+	if needBiosBoot() {
+		err = writeBiosBootImages(parts)
+		if err != nil {
+			return "", err
+		}
+	}
+	// FAT labels are upper-case, config.yaml may have it in lower-case
+	_, err = rplib.Format(recovery_path, rplib.FS_TYPE_VFAT_32, strings.ToUpper(configs.Recovery.FsLabel), rplib.FormatOptions{})
+	if err != nil {
+		return "", err
+	}
+	return recovery_path, nil
+}
+
+// setRecoveryType() sets recovery_type in the bootloader environment
+// of the partition mounted on mnt.
+func setRecoveryType(mnt string, recoveryType string) error {
+	if configs.Configs.Bootloader == "u-boot" {
+		file := filepath.Join(mnt, rplib.UBOOTENV_FILE)
+		// config.yaml first, then the uboot.env content in gadget.yaml
+		size, redundant := configs.Configs.UbootEnvSize, configs.Configs.UbootEnvRedundant
+		if gadgetInfo := loadGadget(); gadgetInfo != nil {
+			gadgetSize, gadgetRedundant, err := rplib.UbootenvGadget(gadgetInfo, configs.Recovery.FsLabel, GADGET_DIR)
+			if err != nil {
+				log.Println("uboot env in gadget.yaml:", err)
+			}
+			if size == 0 {
+				size = gadgetSize
+			}
+			redundant = redundant || gadgetRedundant
+		}
+		if size == 0 {
+			size = rplib.UbootenvSize(file)
+		}
+		redundFile := ""
+		if redundant {
+			redundFile = filepath.Join(mnt, rplib.UBOOTENV_REDUND_FILE)
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			log.Printf("create uboot env %s, size: %d", file, size)
+			if err = rplib.UbootenvCreate(file, redundFile, size); err != nil {
+				return err
+			}
+		}
+		return rplib.UbootenvSetRecoveryType(file, redundFile, size, recoveryType)
+	}
+
+	grubenv, err := findGrubenv(mnt)
 	if err != nil {
 		return err
 	}
-	defer syscall.Unmount(RECO_TAR_MNT_DIR, 0)
-	rplib.Shellcmd(fmt.Sprintf("rsync -aH %s %s", RECO_ROOT_DIR, RECO_TAR_MNT_DIR))
-	rplib.Shellexec("sync")
+	return rplib.GrubenvSetRecoveryType(grubenv, recoveryType)
+}
+
+// loadGadget() loads gadget.yaml of the ubuntu core recovery, or returns nil if not exist
+func loadGadget() *rplib.GadgetInfo {
+	if recoveryOs != rplib.RECOVERY_OS_UBUNTU_CORE {
+		return nil
+	}
+	if _, err := os.Stat(GADGET_YAML); err != nil {
+		return nil
+	}
 
-	// set target grubenv to factory_restore
-	if _, err = os.Stat(SYSBOOT_MNT_DIR + "EFI"); err == nil {
-		cmd := exec.Command("grub-editenv", filepath.Join(RECO_TAR_MNT_DIR, "EFI/ubuntu/grubenv"), "set", "recovery_type=factory_install")
-		cmd.Run()
-	} else if _, err = os.Stat(SYSBOOT_MNT_DIR + "efi"); err == nil {
-		cmd := exec.Command("grub-editenv", filepath.Join(RECO_TAR_MNT_DIR, "efi/ubuntu/grubenv"), "set", "recovery_type=factory_install")
-		cmd.Run()
+	var gadgetInfo rplib.GadgetInfo
+	if err := gadgetInfo.Load(GADGET_YAML); err != nil {
+		log.Println("Load gadget.yaml failed:", err)
+		return nil
 	}
+	return &gadgetInfo
+}
 
+// recoveryStructure() returns the recovery structure with content in gadget.yaml,
+// or nil if there is no gadget.yaml or no content.
+func recoveryStructure() *rplib.VolumeStructure {
+	gadgetInfo := loadGadget()
+	if gadgetInfo == nil {
+		return nil
+	}
+	st, err := gadgetInfo.GetStructurebyLabel(configs.Recovery.FsLabel)
+	if err != nil || len(st.Content) == 0 {
+		return nil
+	}
+	return st
+}
+
+// installerPartitions() returns the extents of the recovery partition, and
+// the BIOS boot partition unless its core.img comes from the gadget volume.
+func installerPartitions(parts *Partitions) []rplib.PartitionExtent {
+	extents := []rplib.PartitionExtent{{Name: configs.Recovery.FsLabel, Start: parts.Recovery_start, End: parts.Recovery_end}}
+	if needBiosBoot() && !gadgetHasMbr() {
+		extents = append(extents, rplib.PartitionExtent{Name: BIOS_BOOT_NAME, Start: BIOS_BOOT_BEGIN * 1024 * 1024, End: BIOS_BOOT_END * 1024 * 1024})
+	}
+	return extents
+}
+
+// checkRecoveryContent() checks the content sources of the recovery structure
+// in gadget.yaml are in the gadget.
+func checkRecoveryContent() error {
+	st := recoveryStructure()
+	if st == nil {
+		return nil
+	}
+	return st.CheckContent(GADGET_DIR)
+}
+
+// populateRecoveryContent() copies the content of the recovery structure in
+// gadget.yaml, e.g. the bootloader assets, over the recovery tree copied to
+// the recovery partition.
+func populateRecoveryContent(recoMnt string) error {
+	st := recoveryStructure()
+	if st == nil {
+		return nil
+	}
+	return st.PopulateContent(GADGET_DIR, recoMnt)
+}
+
+// writeRawContent() writes the bootloader images of the bare structures in
+// the gadget volume which has the recovery structure.
+func writeRawContent(parts *Partitions) error {
+	gadgetInfo := loadGadget()
+	if gadgetInfo == nil {
+		return nil
+	}
+	for name, vol := range gadgetInfo.Volumes {
+		for _, st := range vol.Structure {
+			if st.Label == configs.Recovery.FsLabel {
+				log.Printf("write raw content of volume %s to %s", name, parts.TargetDevPath)
+				return rplib.WriteRawContent(parts.TargetDevPath, &vol, GADGET_DIR, installerPartitions(parts))
+			}
+		}
+	}
 	return nil
 }
+
+// gadgetHasMbr() returns true if the gadget volume of the recovery has the mbr structure
+func gadgetHasMbr() bool {
+	gadgetInfo := loadGadget()
+	if gadgetInfo == nil {
+		return false
+	}
+	for _, vol := range gadgetInfo.Volumes {
+		hasRecovery, hasMbr := false, false
+		for _, st := range vol.Structure {
+			hasRecovery = hasRecovery || st.Label == configs.Recovery.FsLabel
+			hasMbr = hasMbr || st.Type == "mbr"
+		}
+		if hasRecovery {
+			return hasMbr
+		}
+	}
+	return false
+}
+
+// findGrubenv() returns the grubenv under EFI/ubuntu or efi/ubuntu of the mount point.
+// If there is no grubenv yet, a new one is created in the existing directory.
+func findGrubenv(mnt string) (string, error) {
+	dirs := []string{"EFI/ubuntu", "efi/ubuntu"}
+	for _, dir := range dirs {
+		grubenv := filepath.Join(mnt, dir, "grubenv")
+		if _, err := os.Stat(grubenv); err == nil {
+			return grubenv, nil
+		}
+	}
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(mnt, dir)); err == nil {
+			grubenv := filepath.Join(mnt, dir, "grubenv")
+			log.Printf("create grubenv %s", grubenv)
+			return grubenv, rplib.GrubenvCreate(grubenv)
+		}
+	}
+	return "", fmt.Errorf("No EFI/ubuntu or efi/ubuntu directory found in %s", mnt)
+}
@@ -0,0 +1,102 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// recoveryType() returns the recovery type of the recovery boot entry in
+// the kernel command line, or the type in config.yaml.
+func recoveryType() string {
+	if t := rplib.CmdlineValue(rplib.RECOVERY_TYPE_CMDLINE); t != "" {
+		return t
+	}
+	return configs.Recovery.Type
+}
+
+// hookPath() returns the path of the hook in config.yaml, relative to the
+// installer media if not absolute.
+func hookPath(hook string) string {
+	if filepath.IsAbs(hook) {
+		return hook
+	}
+	return filepath.Join(RECO_ROOT_DIR, hook)
+}
+
+// confirmRestore() asks the end user to confirm the factory restore: it
+// runs the prehook, shows the confirmation with a countdown which cancels
+// on timeout, and runs the posthook with the decision. The outcome is saved
+// in the OEM log dir. It returns true if the restore is confirmed and both
+// hooks succeeded.
+func confirmRestore() bool {
+	record := rplib.RestoreRecord{Start: time.Now().UTC(), Decision: rplib.RESTORE_CANCELLED}
+	defer saveRestoreRecord(&record)
+
+	if hook := configs.Recovery.RestoreConfirmPrehookFile; hook != "" {
+		if err := rplib.RunHook(hookPath(hook)); err != nil {
+			log.Println("Restore confirm prehook failed:", err)
+			record.Prehook = err.Error()
+			// the posthook still gets the cancel decision
+		}
+	}
+
+	if record.Prehook == "" {
+		message := []string{
+			"Factory restore will erase all data on this system,",
+			"and restore it to the factory image.",
+			"",
+		}
+		timeout := time.Duration(configs.Recovery.RestoreConfirmTimeoutSec) * time.Second
+		if ui.Confirm(message, "Restore?", timeout, false) {
+			record.Decision = rplib.RESTORE_CONFIRMED
+		}
+	}
+	log.Printf("factory restore %s", record.Decision)
+
+	if hook := configs.Recovery.RestoreConfirmPosthookFile; hook != "" {
+		if err := rplib.RunHook(hookPath(hook), record.Decision); err != nil {
+			log.Println("Restore confirm posthook failed:", err)
+			record.Posthook = err.Error()
+		}
+	}
+	return record.Decision == rplib.RESTORE_CONFIRMED && record.Posthook == ""
+}
+
+func saveRestoreRecord(record *rplib.RestoreRecord) {
+	record.End = time.Now().UTC()
+	logDir := filepath.Join(sourceRwDir, configs.Recovery.OemLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Println("Create log dir failed:", err)
+		return
+	}
+	file := filepath.Join(logDir, fmt.Sprintf("restore-%s.json", record.Start.Format("20060102T150405Z")))
+	if err := record.Save(file); err != nil {
+		log.Println("Save restore record failed:", err)
+		return
+	}
+	log.Printf("Restore record saved: %s", file)
+}
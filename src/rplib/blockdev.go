@@ -0,0 +1,278 @@
+package rplib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the sysfs and device directories, changed in tests
+var (
+	SysClassBlockDir = "/sys/class/block"
+	DevDir           = "/dev"
+)
+
+// PartInfo is a partition found in sysfs with its probed filesystem
+type PartInfo struct {
+	Node     string // sda1, nvme0n1p1
+	Path     string // /dev/sda1
+	DiskNode string // sda, nvme0n1
+	DiskPath string // /dev/sda
+	Nr       int
+	FsInfo
+}
+
+func readSysfsString(file string) (string, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(dat)), nil
+}
+
+func readSysfsInt(file string) (int, error) {
+	dat, err := readSysfsString(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(dat)
+}
+
+// PartitionOf() resolves the disk and partition number of the partition
+// node through the sysfs partition attribute and its parent directory.
+func PartitionOf(node string) (diskNode string, nr int, err error) {
+	entry := filepath.Join(SysClassBlockDir, filepath.Base(node))
+	nr, err = readSysfsInt(filepath.Join(entry, "partition"))
+	if err != nil {
+		return "", -1, fmt.Errorf("%s is not a partition: %v", node, err)
+	}
+	syspath, err := filepath.EvalSymlinks(entry)
+	if err != nil {
+		return "", -1, err
+	}
+	return filepath.Base(filepath.Dir(syspath)), nr, nil
+}
+
+// DiskNode() returns the whole disk node of the disk or partition path. The
+// symlinks like /dev/disk/by-id/... are resolved to the kernel name first.
+func DiskNode(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	node := filepath.Base(path)
+	if diskNode, _, err := PartitionOf(node); err == nil {
+		return diskNode
+	}
+	return node
+}
+
+// partitionName() returns the kernel name of the partition nr of the disk:
+// a "p" is inserted if the disk name ends with a digit (mmcblk0p1, nvme0n1p1,
+// md127p1, loop0p1, nbd0p1), otherwise the number is appended (sda1, vda1).
+func partitionName(diskNode string, nr int) string {
+	last := diskNode[len(diskNode)-1]
+	if last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", diskNode, nr)
+	}
+	return fmt.Sprintf("%s%d", diskNode, nr)
+}
+
+// PartitionPath() returns the device path of the partition nr of the disk.
+// The partition is looked up in sysfs under the disk, the partition name is
+// derived from the disk name if it doesn't exist yet. The device mapper
+// disks use the kpartx naming: /dev/mapper/<name>p<nr>.
+func PartitionPath(disk string, nr int) string {
+	if strings.HasPrefix(disk, "/dev/mapper/") {
+		return fmt.Sprintf("%sp%d", disk, nr)
+	}
+
+	diskNode := DiskNode(disk)
+	if node, found := sysfsPartition(diskNode, nr); found {
+		return filepath.Join(DevDir, node)
+	}
+	return filepath.Join(DevDir, partitionName(diskNode, nr))
+}
+
+// sysfsPartition() finds the partition nr under the disk in sysfs
+func sysfsPartition(diskNode string, nr int) (string, bool) {
+	entries, _ := ioutil.ReadDir(filepath.Join(SysClassBlockDir, diskNode))
+	for _, entry := range entries {
+		n, err := readSysfsInt(filepath.Join(SysClassBlockDir, diskNode, entry.Name(), "partition"))
+		if err == nil && n == nr {
+			return entry.Name(), true
+		}
+	}
+	return "", false
+}
+
+// the virtual block devices which are not target disks
+var virtualDiskPrefixes = []string{"loop", "ram", "zram", "dm-", "sr", "fd", "nbd"}
+
+// isMmcHwPartition() returns true for the eMMC hardware partitions: the boot
+// partitions (mmcblk0boot0, mmcblk0boot1) and the RPMB (mmcblk0rpmb). They
+// are not in the partition table, sysfs shows them as disks.
+func isMmcHwPartition(node string) bool {
+	return (strings.HasPrefix(node, "mmcblk") && strings.Contains(node, "boot")) || strings.HasSuffix(node, "rpmb")
+}
+
+// ListDisks() returns the disk nodes in sysfs, without the partitions, the
+// virtual devices, the eMMC hardware partitions, the md array members and the
+// disks of size 0 (e.g. card readers without card, md containers).
+func ListDisks() ([]string, error) {
+	entries, err := ioutil.ReadDir(SysClassBlockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	members := MdMemberDisks()
+	disks := []string{}
+	for _, entry := range entries {
+		node := entry.Name()
+		if _, err := os.Stat(filepath.Join(SysClassBlockDir, node, "partition")); err == nil || members[node] {
+			continue
+		}
+		virtual := false
+		for _, prefix := range virtualDiskPrefixes {
+			virtual = virtual || strings.HasPrefix(node, prefix)
+		}
+		if virtual || isMmcHwPartition(node) {
+			continue
+		}
+		if size, err := readSysfsInt(filepath.Join(SysClassBlockDir, node, "size")); err != nil || size == 0 {
+			continue
+		}
+		disks = append(disks, node)
+	}
+	return disks, nil
+}
+
+// ScanBlockDevices() lists all disks and partitions in sysfs and probes their
+// filesystems. The disks have Nr 0 and DiskNode of themselves, the devices
+// without a known filesystem have empty FsInfo.
+func ScanBlockDevices() ([]PartInfo, error) {
+	entries, err := ioutil.ReadDir(SysClassBlockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	devs := []PartInfo{}
+	for _, entry := range entries {
+		diskNode, nr := entry.Name(), 0
+		if _, err := os.Stat(filepath.Join(SysClassBlockDir, entry.Name(), "partition")); err == nil {
+			diskNode, nr, err = PartitionOf(entry.Name())
+			if err != nil {
+				log.Printf("ignore %s: %v", entry.Name(), err)
+				continue
+			}
+		}
+
+		dev := PartInfo{
+			Node:     entry.Name(),
+			Path:     filepath.Join(DevDir, entry.Name()),
+			DiskNode: diskNode,
+			DiskPath: filepath.Join(DevDir, diskNode),
+			Nr:       nr,
+		}
+		if info, err := ProbeFilesystem(dev.Path); err == nil {
+			dev.FsInfo = *info
+		}
+		devs = append(devs, dev)
+	}
+	return devs, nil
+}
+
+// ScanPartitions() lists all partitions in sysfs and probes their filesystems.
+// The partitions without a known filesystem have empty FsInfo.
+func ScanPartitions() ([]PartInfo, error) {
+	devs, err := ScanBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+	parts := []PartInfo{}
+	for _, dev := range devs {
+		if dev.Nr > 0 {
+			parts = append(parts, dev)
+		}
+	}
+	return parts, nil
+}
+
+// FindPartsByLabel() returns all the partitions with the filesystem label
+func FindPartsByLabel(label string) ([]PartInfo, error) {
+	parts, err := ScanPartitions()
+	if err != nil {
+		return nil, err
+	}
+	found := []PartInfo{}
+	for _, part := range parts {
+		if part.Type != "" && part.Label == label {
+			found = append(found, part)
+		}
+	}
+	return found, nil
+}
+
+// DiskInfo is the identity of a disk shown to the operator
+type DiskInfo struct {
+	Node   string
+	Model  string
+	Serial string
+	Size   int64 // in bytes
+}
+
+// vpdSerial() returns the serial number in the SCSI unit serial number VPD
+// page (0x80): the length at byte 3, the serial number from byte 4.
+func vpdSerial(file string) string {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil || len(dat) < 4 {
+		return ""
+	}
+	end := 4 + int(dat[3])
+	if end > len(dat) {
+		end = len(dat)
+	}
+	return strings.TrimSpace(string(bytes.TrimRight(dat[4:end], "\x00")))
+}
+
+// GetDiskInfo() reads the model, serial number and size of the disk in sysfs.
+// The model is "name" for mmc, the serial number of SCSI/SATA disks is in
+// the VPD page 0x80. The unknown fields are empty.
+func GetDiskInfo(node string) DiskInfo {
+	info := DiskInfo{Node: node}
+	device := filepath.Join(SysClassBlockDir, node, "device")
+	if sectors, err := readSysfsInt(filepath.Join(SysClassBlockDir, node, "size")); err == nil {
+		info.Size = int64(sectors) * 512
+	}
+	for _, attr := range []string{"model", "name"} {
+		if model, err := readSysfsString(filepath.Join(device, attr)); err == nil && model != "" {
+			info.Model = model
+			break
+		}
+	}
+	if serial, err := readSysfsString(filepath.Join(device, "serial")); err == nil && serial != "" {
+		info.Serial = serial
+	} else {
+		info.Serial = vpdSerial(filepath.Join(device, "vpd_pg80"))
+	}
+	return info
+}
+
+// HumanSize() returns the size in the decimal units of the disk labels
+func HumanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,211 @@
+package rplib_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type BlockdevSuite struct {
+	root                string
+	oldSysClass, oldDev string
+}
+
+var _ = Suite(&BlockdevSuite{})
+
+func (s *BlockdevSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	s.oldSysClass, s.oldDev = rplib.SysClassBlockDir, rplib.DevDir
+	rplib.SysClassBlockDir = filepath.Join(s.root, "sys/class/block")
+	rplib.DevDir = filepath.Join(s.root, "dev")
+	c.Assert(os.MkdirAll(rplib.SysClassBlockDir, 0755), IsNil)
+	c.Assert(os.MkdirAll(rplib.DevDir, 0755), IsNil)
+}
+
+func (s *BlockdevSuite) TearDownTest(c *C) {
+	rplib.SysClassBlockDir, rplib.DevDir = s.oldSysClass, s.oldDev
+}
+
+// addBlock() adds the disk or partition to the fake sysfs, and a device
+// node with a vfat boot sector if the label is not empty.
+func (s *BlockdevSuite) addBlock(c *C, disk string, node string, nr int, label string, volid uint32) {
+	syspath := filepath.Join(s.root, "sys/devices/pci0000:00/block", disk)
+	if node != disk {
+		syspath = filepath.Join(syspath, node)
+		c.Assert(os.MkdirAll(syspath, 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(syspath, "partition"), []byte(strconv.Itoa(nr)+"\n"), 0644), IsNil)
+	} else {
+		c.Assert(os.MkdirAll(syspath, 0755), IsNil)
+	}
+	c.Assert(os.Symlink(syspath, filepath.Join(rplib.SysClassBlockDir, node)), IsNil)
+
+	dev := make([]byte, 4096)
+	if label != "" {
+		copy(dev[0x52:], "FAT32   ")
+		dev[0x42] = 0x29
+		binary.LittleEndian.PutUint32(dev[0x43:], volid)
+		copy(dev[0x47:], label+"           "[len(label):])
+		dev[510], dev[511] = 0x55, 0xaa
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(rplib.DevDir, node), dev, 0644), IsNil)
+}
+
+func (s *BlockdevSuite) TestPartitionOf(c *C) {
+	s.addBlock(c, "nvme0n1", "nvme0n1", 0, "", 0)
+	s.addBlock(c, "nvme0n1", "nvme0n1p12", 12, "", 0)
+	s.addBlock(c, "md126", "md126p1", 1, "", 0)
+
+	disk, nr, err := rplib.PartitionOf("nvme0n1p12")
+	c.Assert(err, IsNil)
+	c.Assert(disk, Equals, "nvme0n1")
+	c.Assert(nr, Equals, 12)
+
+	disk, nr, err = rplib.PartitionOf("/dev/md126p1")
+	c.Assert(err, IsNil)
+	c.Assert(disk, Equals, "md126")
+	c.Assert(nr, Equals, 1)
+
+	_, _, err = rplib.PartitionOf("nvme0n1")
+	c.Assert(err, NotNil)
+}
+
+func (s *BlockdevSuite) TestFindPartsByLabel(c *C) {
+	s.addBlock(c, "sda", "sda", 0, "", 0)
+	s.addBlock(c, "sda", "sda1", 1, "INSTALLER", 0x11112222)
+	s.addBlock(c, "sda", "sda2", 2, "SYSBOOT", 0x33334444)
+	s.addBlock(c, "nvme0n1", "nvme0n1", 0, "", 0)
+	s.addBlock(c, "nvme0n1", "nvme0n1p1", 1, "SYSBOOT", 0x55556666)
+	s.addBlock(c, "nvme0n1", "nvme0n1p2", 2, "", 0)
+
+	found, err := rplib.FindPartsByLabel("INSTALLER")
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 1)
+	c.Assert(found[0], DeepEquals, rplib.PartInfo{
+		Node:     "sda1",
+		Path:     filepath.Join(rplib.DevDir, "sda1"),
+		DiskNode: "sda",
+		DiskPath: filepath.Join(rplib.DevDir, "sda"),
+		Nr:       1,
+		FsInfo:   rplib.FsInfo{Type: "vfat", Label: "INSTALLER", UUID: "1111-2222"},
+	})
+
+	found, err = rplib.FindPartsByLabel("SYSBOOT")
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 2)
+	c.Assert(found[0].DiskNode, Equals, "nvme0n1")
+	c.Assert(found[0].UUID, Equals, "5555-6666")
+	c.Assert(found[1].DiskNode, Equals, "sda")
+	c.Assert(found[1].Nr, Equals, 2)
+
+	found, err = rplib.FindPartsByLabel("NOT-EXIST")
+	c.Assert(err, IsNil)
+	c.Assert(found, HasLen, 0)
+}
+
+func (s *BlockdevSuite) TestPartitionPath(c *C) {
+	s.addBlock(c, "sda", "sda", 0, "", 0)
+	s.addBlock(c, "sda", "sda1", 1, "", 0)
+	s.addBlock(c, "md127", "md127", 0, "", 0)
+	s.addBlock(c, "md127", "md127p2", 2, "", 0)
+	s.addBlock(c, "loop0", "loop0", 0, "", 0)
+
+	// partitions in sysfs
+	c.Assert(rplib.PartitionPath("/dev/sda", 1), Equals, filepath.Join(rplib.DevDir, "sda1"))
+	c.Assert(rplib.PartitionPath("/dev/md127", 2), Equals, filepath.Join(rplib.DevDir, "md127p2"))
+
+	// partitions not created yet
+	for disk, part := range map[string]string{
+		"/dev/sda":     "sda3",
+		"/dev/vda":     "vda3",
+		"/dev/md127":   "md127p3",
+		"/dev/loop0":   "loop0p3",
+		"/dev/nbd0":    "nbd0p3",
+		"/dev/mmcblk0": "mmcblk0p3",
+		"/dev/nvme0n1": "nvme0n1p3",
+	} {
+		c.Check(rplib.PartitionPath(disk, 3), Equals, filepath.Join(rplib.DevDir, part))
+	}
+
+	c.Assert(rplib.PartitionPath("/dev/mapper/isw_raid", 1), Equals, "/dev/mapper/isw_raidp1")
+}
+
+func (s *BlockdevSuite) TestDiskNode(c *C) {
+	s.addBlock(c, "nvme0n1", "nvme0n1", 0, "", 0)
+	s.addBlock(c, "nvme0n1", "nvme0n1p3", 3, "", 0)
+
+	byId := filepath.Join(s.root, "nvme-Samsung_SSD_960_S3ESNX0J")
+	c.Assert(os.Symlink(filepath.Join(rplib.DevDir, "nvme0n1"), byId), IsNil)
+	c.Assert(os.Symlink(filepath.Join(rplib.DevDir, "nvme0n1p3"), byId+"-part3"), IsNil)
+
+	c.Assert(rplib.DiskNode("/dev/nvme0n1p3"), Equals, "nvme0n1")
+	c.Assert(rplib.DiskNode(byId), Equals, "nvme0n1")
+	c.Assert(rplib.DiskNode(byId+"-part3"), Equals, "nvme0n1")
+	c.Assert(rplib.DiskNode("/dev/loop0"), Equals, "loop0")
+	c.Assert(rplib.IsLoop("/dev/loop0"), Equals, true)
+	c.Assert(rplib.IsLoop(byId), Equals, false)
+}
+
+func (s *BlockdevSuite) TestWaitPartition(c *C) {
+	s.addBlock(c, "mmcblk0", "mmcblk0", 0, "", 0)
+
+	// the partition shows up later
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.addBlock(c, "mmcblk0", "mmcblk0p1", 1, "", 0)
+	}()
+	path, err := rplib.WaitPartition("/dev/mmcblk0", 1, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, filepath.Join(rplib.DevDir, "mmcblk0p1"))
+
+	// in sysfs, but without the device node
+	syspath := filepath.Join(s.root, "sys/devices/pci0000:00/block/mmcblk0/mmcblk0p2")
+	c.Assert(os.MkdirAll(syspath, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(syspath, "partition"), []byte("2\n"), 0644), IsNil)
+	_, err = rplib.WaitPartition("/dev/mmcblk0", 2, 100*time.Millisecond)
+	c.Assert(err, ErrorMatches, "Partition 2 of /dev/mmcblk0 not ready after 100ms")
+}
+
+func (s *BlockdevSuite) TestListDisks(c *C) {
+	// mmcblk1 is an eMMC with the hardware boot and RPMB partitions
+	for _, disk := range []string{"sda", "sdb", "nvme0n1", "loop0", "sr0", "mmcblk0", "mmcblk1", "mmcblk1boot0", "mmcblk1boot1", "mmcblk1rpmb"} {
+		s.addBlock(c, disk, disk, 0, "", 0)
+		size := "1000215216\n"
+		if disk == "mmcblk0" {
+			// card reader without card
+			size = "0\n"
+		}
+		c.Assert(ioutil.WriteFile(filepath.Join(rplib.SysClassBlockDir, disk, "size"), []byte(size), 0644), IsNil)
+	}
+	s.addBlock(c, "sda", "sda1", 1, "", 0)
+
+	disks, err := rplib.ListDisks()
+	c.Assert(err, IsNil)
+	c.Assert(disks, DeepEquals, []string{"mmcblk1", "nvme0n1", "sda", "sdb"})
+}
+
+func (s *BlockdevSuite) TestGetDiskInfo(c *C) {
+	s.addBlock(c, "nvme0n1", "nvme0n1", 0, "", 0)
+	s.addBlock(c, "sda", "sda", 0, "", 0)
+	for node, attrs := range map[string]map[string]string{
+		"nvme0n1": {"size": "1000215216\n", "device/model": "Samsung SSD 970 EVO 500GB               \n", "device/serial": "S466NX0M123456X     \n"},
+		"sda":     {"size": "62533296\n", "device/model": "SanDisk SSD\n", "device/vpd_pg80": "\x00\x80\x00\x0cAB1234567890"},
+	} {
+		for attr, value := range attrs {
+			file := filepath.Join(rplib.SysClassBlockDir, node, attr)
+			c.Assert(os.MkdirAll(filepath.Dir(file), 0755), IsNil)
+			c.Assert(ioutil.WriteFile(file, []byte(value), 0644), IsNil)
+		}
+	}
+
+	c.Assert(rplib.GetDiskInfo("nvme0n1"), DeepEquals, rplib.DiskInfo{Node: "nvme0n1", Model: "Samsung SSD 970 EVO 500GB", Serial: "S466NX0M123456X", Size: 512110190592})
+	c.Assert(rplib.GetDiskInfo("sda"), DeepEquals, rplib.DiskInfo{Node: "sda", Model: "SanDisk SSD", Serial: "AB1234567890", Size: 32017047552})
+	c.Assert(rplib.HumanSize(512110190592), Equals, "512.1 GB")
+	c.Assert(rplib.HumanSize(100), Equals, "100 B")
+}
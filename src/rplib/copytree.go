@@ -0,0 +1,242 @@
+package rplib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// the chunks of 1 MiB queued for each destination, a slower destination
+// falls behind the others by up to this many chunks before the read waits
+const _COPY_QUEUE_DEPTH = 64
+
+// the operations of treeWriter
+const (
+	_COPY_OP_DIR = iota
+	_COPY_OP_OPEN
+	_COPY_OP_DATA
+	_COPY_OP_CLOSE
+)
+
+type copyOp struct {
+	op   int
+	rel  string
+	info os.FileInfo
+	data []byte
+}
+
+// treeWriter writes the tree read by CopyTreeMulti() to a destination in its
+// own goroutine, so a slow or failing destination doesn't stall the others.
+// A failed destination drops the rest of its queue.
+type treeWriter struct {
+	dst  string
+	ops  chan copyOp
+	done chan struct{}
+	file *os.File
+
+	lock sync.Mutex
+	err  error
+}
+
+func newTreeWriter(dst string) *treeWriter {
+	w := &treeWriter{dst: dst, ops: make(chan copyOp, _COPY_QUEUE_DEPTH), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *treeWriter) run() {
+	defer close(w.done)
+	for op := range w.ops {
+		if w.failed() {
+			continue
+		}
+		if err := w.apply(op); err != nil {
+			w.fail(err)
+		}
+	}
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+func (w *treeWriter) apply(op copyOp) error {
+	path := filepath.Join(w.dst, op.rel)
+	switch op.op {
+	case _COPY_OP_DIR:
+		return os.MkdirAll(path, 0755)
+	case _COPY_OP_OPEN:
+		var err error
+		w.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, op.info.Mode().Perm())
+		return err
+	case _COPY_OP_DATA:
+		_, err := w.file.Write(op.data)
+		return err
+	case _COPY_OP_CLOSE:
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			return err
+		}
+		// not supported on vfat, ignore the error
+		os.Chtimes(path, op.info.ModTime(), op.info.ModTime())
+	}
+	return nil
+}
+
+func (w *treeWriter) fail(err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err == nil {
+		log.Printf("copy to %s failed: %v", w.dst, err)
+		w.err = err
+	}
+}
+
+func (w *treeWriter) failed() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err != nil
+}
+
+// treeWriters sends the operations to all the destinations not failed yet
+type treeWriters []*treeWriter
+
+func (ws treeWriters) send(op copyOp) {
+	for _, w := range ws {
+		if !w.failed() {
+			w.ops <- op
+		}
+	}
+}
+
+func (ws treeWriters) active() bool {
+	for _, w := range ws {
+		if !w.failed() {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile() reads the source file once, and sends it to all the active
+// destinations. It returns the sha256 checksum of the source.
+func (ws treeWriters) copyFile(src, rel string, info os.FileInfo) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	ws.send(copyOp{op: _COPY_OP_OPEN, rel: rel, info: info})
+	h := sha256.New()
+	for {
+		// a new buffer for every chunk, the writers use it after the next read
+		buf := make([]byte, 1024*1024)
+		n, rerr := in.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			ws.send(copyOp{op: _COPY_OP_DATA, rel: rel, data: buf[:n]})
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+	}
+	ws.send(copyOp{op: _COPY_OP_CLOSE, rel: rel, info: info})
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CopyTreeMulti() copies the directory tree src to all the dsts, reading
+// every source file only once. Each destination is written in its own
+// goroutine, a failed destination is dropped and the others go on. The
+// destinations are vfat: a symlink to a file is copied as the file, the
+// other symlinks are skipped. It returns the sha256 checksums of the copied
+// files by the relative path, and the error of each destination. The error
+// of reading the source fails all.
+func CopyTreeMulti(src string, dsts []string) (map[string]string, []error) {
+	ws := treeWriters{}
+	for _, dst := range dsts {
+		ws = append(ws, newTreeWriter(dst))
+	}
+	manifest := map[string]string{}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if !ws.active() {
+			return filepath.SkipDir
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Stat(path)
+			if err != nil || !target.Mode().IsRegular() {
+				log.Printf("skip the symlink %s, not supported on vfat", path)
+				return nil
+			}
+			info = target
+		}
+		switch {
+		case info.IsDir():
+			ws.send(copyOp{op: _COPY_OP_DIR, rel: rel})
+		case info.Mode().IsRegular():
+			sum, err := ws.copyFile(path, rel, info)
+			if err != nil {
+				return err
+			}
+			manifest[rel] = sum
+		default:
+			log.Printf("skip the special file %s", path)
+		}
+		return nil
+	})
+
+	for _, w := range ws {
+		close(w.ops)
+		<-w.done
+	}
+	if err != nil {
+		err = fmt.Errorf("Read %s failed: %v", src, err)
+		for _, w := range ws {
+			w.fail(err)
+		}
+	}
+	errs := []error{}
+	for _, w := range ws {
+		errs = append(errs, w.err)
+	}
+	return manifest, errs
+}
+
+// VerifyTree() checks the files in the directory with the sha256 manifest
+// of CopyTreeMulti()
+func VerifyTree(dir string, manifest map[string]string) error {
+	paths := []string{}
+	for rel := range manifest {
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+
+	for _, rel := range paths {
+		sum, err := FileSha256(filepath.Join(dir, rel))
+		if err != nil {
+			return err
+		}
+		if sum != manifest[rel] {
+			return fmt.Errorf("Checksum mismatch of %s: sha256 %s, expected %s", filepath.Join(dir, rel), sum, manifest[rel])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type CopyTreeSuite struct {
+	src string
+}
+
+var _ = Suite(&CopyTreeSuite{})
+
+func (s *CopyTreeSuite) SetUpTest(c *C) {
+	s.src = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.src, "EFI/ubuntu"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(s.src, "recovery/empty"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.src, "EFI/ubuntu/grubenv"), []byte("# GRUB Environment Block\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.src, "recovery/config.yaml"), []byte("project: pc\n"), 0644), IsNil)
+	big := make([]byte, 3*1024*1024+1)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(s.src, "recovery/base.img"), big, 0644), IsNil)
+}
+
+func (s *CopyTreeSuite) TestCopyTreeMulti(c *C) {
+	dsts := []string{c.MkDir(), c.MkDir(), c.MkDir()}
+	manifest, errs := rplib.CopyTreeMulti(s.src, dsts)
+	c.Assert(errs, DeepEquals, []error{nil, nil, nil})
+	c.Assert(manifest, HasLen, 3)
+	c.Assert(manifest["recovery/config.yaml"], Equals, "958b2549f7abc9570817311e79008ff233f72c0af443f004e97db0b5d5c4d412")
+
+	for _, dst := range dsts {
+		c.Assert(rplib.VerifyTree(dst, manifest), IsNil)
+		_, err := os.Stat(filepath.Join(dst, "recovery/empty"))
+		c.Assert(err, IsNil)
+	}
+	sum, err := rplib.FileSha256(filepath.Join(s.src, "recovery/base.img"))
+	c.Assert(err, IsNil)
+	c.Assert(manifest["recovery/base.img"], Equals, sum)
+}
+
+func (s *CopyTreeSuite) TestCopyTreeMultiOneFailed(c *C) {
+	dsts := []string{c.MkDir(), c.MkDir(), c.MkDir()}
+	// a file in the way of the directory fails the second target only
+	c.Assert(ioutil.WriteFile(filepath.Join(dsts[1], "recovery"), []byte("file"), 0644), IsNil)
+
+	manifest, errs := rplib.CopyTreeMulti(s.src, dsts)
+	c.Assert(errs[0], IsNil)
+	c.Assert(errs[1], NotNil)
+	c.Assert(errs[2], IsNil)
+	c.Assert(rplib.VerifyTree(dsts[0], manifest), IsNil)
+	c.Assert(rplib.VerifyTree(dsts[2], manifest), IsNil)
+	c.Assert(rplib.VerifyTree(dsts[1], manifest), NotNil)
+}
+
+// vfat has no symlinks, a symlink to a file is copied as the file
+func (s *CopyTreeSuite) TestCopyTreeMultiSymlink(c *C) {
+	c.Assert(os.Symlink("config.yaml", filepath.Join(s.src, "recovery/config-link.yaml")), IsNil)
+	c.Assert(os.Symlink("empty", filepath.Join(s.src, "recovery/empty-link")), IsNil)
+	c.Assert(os.Symlink("not-exist", filepath.Join(s.src, "recovery/dangling")), IsNil)
+
+	dsts := []string{c.MkDir(), c.MkDir()}
+	manifest, errs := rplib.CopyTreeMulti(s.src, dsts)
+	c.Assert(errs, DeepEquals, []error{nil, nil})
+	c.Assert(manifest["recovery/config-link.yaml"], Equals, manifest["recovery/config.yaml"])
+	for _, dst := range dsts {
+		c.Assert(rplib.VerifyTree(dst, manifest), IsNil)
+		info, err := os.Lstat(filepath.Join(dst, "recovery/config-link.yaml"))
+		c.Assert(err, IsNil)
+		c.Assert(info.Mode().IsRegular(), Equals, true)
+		_, err = os.Lstat(filepath.Join(dst, "recovery/empty-link"))
+		c.Assert(os.IsNotExist(err), Equals, true)
+		_, err = os.Lstat(filepath.Join(dst, "recovery/dangling"))
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+}
+
+func (s *CopyTreeSuite) TestCopyTreeMultiSourceError(c *C) {
+	dsts := []string{c.MkDir(), c.MkDir()}
+	_, errs := rplib.CopyTreeMulti(filepath.Join(s.src, "not-exist"), dsts)
+	c.Assert(errs[0], ErrorMatches, "Read .* failed: .*")
+	c.Assert(errs[1], ErrorMatches, "Read .* failed: .*")
+}
+
+func (s *CopyTreeSuite) TestVerifyTreeMismatch(c *C) {
+	dst := c.MkDir()
+	manifest, errs := rplib.CopyTreeMulti(s.src, []string{dst})
+	c.Assert(errs, DeepEquals, []error{nil})
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dst, "recovery/config.yaml"), []byte("project: pi3\n"), 0644), IsNil)
+	c.Assert(rplib.VerifyTree(dst, manifest), ErrorMatches, "Checksum mismatch of .*/recovery/config.yaml: .*")
+}
@@ -0,0 +1,158 @@
+package rplib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// WRITABLE_LAYOUT, the layout of the writable partition
+const (
+	WRITABLE_LAYOUT_EXT4     = "ext4"
+	WRITABLE_LAYOUT_LUKS     = "luks"
+	WRITABLE_LAYOUT_LUKS_LVM = "luks-lvm"
+)
+
+// KEY_SOURCE, where the LUKS key of the writable partition comes from
+const (
+	KEY_SOURCE_CONFIG     = "config"     // the key file on the installer media
+	KEY_SOURCE_TPM        = "tpm"        // random key sealed in the TPM
+	KEY_SOURCE_PASSPHRASE = "passphrase" // random recovery passphrase written to the OEM log
+)
+
+// the size of the random LUKS key
+const LUKS_KEY_SIZE = 64
+
+// the keyslot of the key the LUKS device is formatted with
+const LUKS_FORMAT_KEYSLOT = 0
+
+// GenerateKey() returns the random key of the size
+func GenerateKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GeneratePassphrase() returns the random recovery passphrase of 8 groups
+// of 5 digits, easy to type on any keyboard layout.
+func GeneratePassphrase() (string, error) {
+	groups := []string{}
+	for i := 0; i < 8; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000))
+		if err != nil {
+			return "", err
+		}
+		groups = append(groups, fmt.Sprintf("%05d", n.Int64()))
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// cryptsetup() runs cryptsetup with the key in stdin, the key never goes to
+// the command line or a file
+func cryptsetup(key []byte, args ...string) (string, error) {
+	log.Printf("cryptsetup %s", strings.Join(args, " "))
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// LuksFormat() creates the LUKS2 header on the device with the key
+func LuksFormat(device string, key []byte, label string) error {
+	_, err := cryptsetup(key, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", "-",
+		"--key-slot", fmt.Sprintf("%d", LUKS_FORMAT_KEYSLOT), "--label", label, device)
+	return err
+}
+
+// LuksOpen() opens the LUKS device as /dev/mapper/<name>
+func LuksOpen(device string, name string, key []byte) error {
+	_, err := cryptsetup(key, "open", "--type", "luks2", "--key-file", "-", device, name)
+	return err
+}
+
+// LuksClose() closes /dev/mapper/<name>
+func LuksClose(name string) error {
+	_, err := cryptsetup(nil, "close", name)
+	return err
+}
+
+// LuksUUID() returns the LUKS header UUID of the device
+func LuksUUID(device string) (string, error) {
+	return cryptsetup(nil, "luksUUID", device)
+}
+
+// LuksAddKey() adds the new key to the LUKS device unlocked by the key.
+// The new key is passed in a private temporary file, removed after.
+func LuksAddKey(device string, key []byte, newKey []byte) error {
+	f, err := ioutil.TempFile("", "luks-key-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(newKey)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cryptsetup(key, "luksAddKey", "--batch-mode", "--key-file", "-", device, f.Name())
+	return err
+}
+
+func lvm(args ...string) error {
+	log.Printf("%s", strings.Join(args, " "))
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// LvmCreate() creates the volume group on the physical volume, and the
+// logical volume of all the space. It returns the logical volume path.
+func LvmCreate(pv, vg, lv string) (string, error) {
+	for _, args := range [][]string{
+		{"pvcreate", "-ff", "-y", pv},
+		{"vgcreate", vg, pv},
+		{"lvcreate", "-y", "-l", "100%FREE", "-n", lv, vg},
+	} {
+		if err := lvm(args...); err != nil {
+			return "", err
+		}
+	}
+	return LvPath(vg, lv), nil
+}
+
+// LvmDeactivate() deactivates the volume group, before closing the LUKS device under it
+func LvmDeactivate(vg string) error {
+	return lvm("vgchange", "-an", vg)
+}
+
+// LvPath() returns the device mapper path of the logical volume. The dashes
+// in the names are doubled by device mapper.
+func LvPath(vg, lv string) string {
+	return fmt.Sprintf("/dev/mapper/%s-%s", strings.Replace(vg, "-", "--", -1), strings.Replace(lv, "-", "--", -1))
+}
+
+// CrypttabLine() returns the crypttab entry of the LUKS device
+func CrypttabLine(name, uuid, keySource string) string {
+	options := "luks,discard"
+	if keySource == KEY_SOURCE_TPM {
+		options += ",tpm2-device=auto"
+	}
+	return fmt.Sprintf("%s UUID=%s none %s\n", name, uuid, options)
+}
@@ -0,0 +1,41 @@
+package rplib_test
+
+import (
+	"regexp"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type CryptSuite struct{}
+
+var _ = Suite(&CryptSuite{})
+
+func (s *CryptSuite) TestGenerateKey(c *C) {
+	key, err := rplib.GenerateKey(rplib.LUKS_KEY_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(key, HasLen, rplib.LUKS_KEY_SIZE)
+	other, err := rplib.GenerateKey(rplib.LUKS_KEY_SIZE)
+	c.Assert(err, IsNil)
+	c.Assert(other, Not(DeepEquals), key)
+}
+
+func (s *CryptSuite) TestGeneratePassphrase(c *C) {
+	passphrase, err := rplib.GeneratePassphrase()
+	c.Assert(err, IsNil)
+	c.Assert(regexp.MustCompile(`^\d{5}(-\d{5}){7}$`).MatchString(passphrase), Equals, true, Commentf("%s", passphrase))
+}
+
+func (s *CryptSuite) TestLvPath(c *C) {
+	c.Assert(rplib.LvPath("vg0", "writable"), Equals, "/dev/mapper/vg0-writable")
+	c.Assert(rplib.LvPath("ubuntu-vg", "root-lv"), Equals, "/dev/mapper/ubuntu--vg-root--lv")
+}
+
+func (s *CryptSuite) TestCrypttabLine(c *C) {
+	uuid := "9b3ac6b5-5c9d-4a3f-8b0e-2f1d0c6a7e11"
+	c.Assert(rplib.CrypttabLine("sda3_crypt", uuid, rplib.KEY_SOURCE_PASSPHRASE), Equals,
+		"sda3_crypt UUID=9b3ac6b5-5c9d-4a3f-8b0e-2f1d0c6a7e11 none luks,discard\n")
+	c.Assert(rplib.CrypttabLine("sda3_crypt", uuid, rplib.KEY_SOURCE_TPM), Equals,
+		"sda3_crypt UUID=9b3ac6b5-5c9d-4a3f-8b0e-2f1d0c6a7e11 none luks,discard,tpm2-device=auto\n")
+}
@@ -0,0 +1,173 @@
+package rplib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// DIAG_FORMAT, the format of the factory diagnostics result
+const (
+	DIAG_FORMAT_JSON = "json"
+	DIAG_FORMAT_INI  = "ini"
+)
+
+// DIAG_RESULT
+const (
+	DIAG_RESULT_PASS = "PASS"
+	DIAG_RESULT_FAIL = "FAIL"
+)
+
+// the diagnostics result in an EFI variable: efivar:<name>-<vendor guid>
+const DIAG_EFIVAR_PREFIX = "efivar:"
+
+// the key of the result in the diagnostics result
+const DIAG_RESULT_KEY = "result"
+
+// DiagResult is the factory diagnostics result of the unit
+type DiagResult struct {
+	Result string            // PASS or FAIL
+	Fields map[string]string // all the fields in the result, for the report
+}
+
+// diagResultValue() normalizes the result value to PASS or FAIL
+func diagResultValue(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "pass", "passed", "ok", "true":
+		return DIAG_RESULT_PASS, nil
+	case "fail", "failed", "error", "false":
+		return DIAG_RESULT_FAIL, nil
+	}
+	return "", fmt.Errorf("Unknown diagnostics result: %q", value)
+}
+
+// parseDiagJson() reads the fields of the top level object
+func parseDiagJson(dat []byte) (map[string]string, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(dat, &obj); err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	for key, value := range obj {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			continue
+		}
+		fields[strings.ToLower(key)] = fmt.Sprintf("%v", value)
+	}
+	return fields, nil
+}
+
+// parseDiagIni() reads key=value lines, the keys in a section are
+// <section>.<key>. The comment lines start with ; or #.
+func parseDiagIni(dat []byte) (map[string]string, error) {
+	fields := map[string]string{}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, ";"), strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid line: %q", line)
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		if section != "" {
+			key = section + "." + key
+		}
+		fields[key] = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	return fields, scanner.Err()
+}
+
+// ParseDiagResult() parses the diagnostics result in JSON or INI format.
+// The result is the "result" key at the top level, or in any section of INI.
+func ParseDiagResult(dat []byte, format string) (*DiagResult, error) {
+	dat = bytes.TrimRight(dat, "\x00")
+	var fields map[string]string
+	var err error
+	switch format {
+	case DIAG_FORMAT_JSON:
+		fields, err = parseDiagJson(dat)
+	case DIAG_FORMAT_INI:
+		fields, err = parseDiagIni(dat)
+	default:
+		return nil, fmt.Errorf("Unsupported diagnostics result format: %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Parse diagnostics result failed: %v", err)
+	}
+
+	value, found := fields[DIAG_RESULT_KEY]
+	if !found {
+		for key, v := range fields {
+			if strings.HasSuffix(key, "."+DIAG_RESULT_KEY) {
+				value, found = v, true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No %q in diagnostics result", DIAG_RESULT_KEY)
+	}
+	result, err := diagResultValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return &DiagResult{Result: result, Fields: fields}, nil
+}
+
+// ReadDiagResult() reads the diagnostics result from the file relative to
+// root, or from the EFI variable if the path is efivar:<name>-<guid>.
+func ReadDiagResult(path string, root string, efi *Efivars, format string) (*DiagResult, error) {
+	var dat []byte
+	var err error
+	if strings.HasPrefix(path, DIAG_EFIVAR_PREFIX) {
+		v := strings.TrimPrefix(path, DIAG_EFIVAR_PREFIX)
+		// the GUID is 36 characters after the last "-" of the name
+		if len(v) < 38 || v[len(v)-37] != '-' {
+			return nil, fmt.Errorf("Invalid EFI variable: %q", v)
+		}
+		_, dat, err = efi.ReadVendorVar(v[:len(v)-37], v[len(v)-36:])
+	} else {
+		dat, err = ioutil.ReadFile(filepath.Join(root, path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseDiagResult(dat, format)
+}
+
+// DiagGate is the install gating decision of the diagnostics result
+type DiagGate struct {
+	Source  string `json:"source"`
+	Result  string `json:"result,omitempty"` // PASS, FAIL, or empty if not read
+	Skipped bool   `json:"skipped"`
+	Install bool   `json:"install"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GateDiagResult() decides if the unit is installed by the diagnostics
+// result: only a PASS unit is installed unless skip is set. A missing or
+// invalid result is not a PASS.
+func GateDiagResult(path string, root string, efi *Efivars, format string, skip bool) *DiagGate {
+	gate := &DiagGate{Source: path, Skipped: skip}
+	result, err := ReadDiagResult(path, root, efi, format)
+	if err != nil {
+		gate.Error = err.Error()
+	} else {
+		gate.Result = result.Result
+	}
+	gate.Install = skip || gate.Result == DIAG_RESULT_PASS
+	return gate
+}
@@ -0,0 +1,96 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type DiagSuite struct {
+	root string
+	efi  *rplib.Efivars
+}
+
+var _ = Suite(&DiagSuite{})
+
+const diagGuid = "3e8a7a5c-6b4f-4a3e-9d2b-1f0e7c6d5b4a"
+
+func (s *DiagSuite) SetUpTest(c *C) {
+	s.root = c.MkDir()
+	s.efi = &rplib.Efivars{Dir: c.MkDir()}
+}
+
+func (s *DiagSuite) TestParseDiagResultJson(c *C) {
+	result, err := rplib.ParseDiagResult([]byte(`{"Result": "passed", "serial": "PF0ABCDE", "tests": {"memory": "pass"}}`), rplib.DIAG_FORMAT_JSON)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, &rplib.DiagResult{Result: rplib.DIAG_RESULT_PASS, Fields: map[string]string{"result": "passed", "serial": "PF0ABCDE"}})
+
+	result, err = rplib.ParseDiagResult([]byte(`{"result": false}`), rplib.DIAG_FORMAT_JSON)
+	c.Assert(err, IsNil)
+	c.Assert(result.Result, Equals, rplib.DIAG_RESULT_FAIL)
+
+	_, err = rplib.ParseDiagResult([]byte(`{"serial": "PF0ABCDE"}`), rplib.DIAG_FORMAT_JSON)
+	c.Assert(err, ErrorMatches, `No "result" in diagnostics result`)
+	_, err = rplib.ParseDiagResult([]byte(`{"result": "skipped"}`), rplib.DIAG_FORMAT_JSON)
+	c.Assert(err, ErrorMatches, `Unknown diagnostics result: "skipped"`)
+	_, err = rplib.ParseDiagResult([]byte(`{`), rplib.DIAG_FORMAT_JSON)
+	c.Assert(err, ErrorMatches, "Parse diagnostics result failed: .*")
+}
+
+func (s *DiagSuite) TestParseDiagResultIni(c *C) {
+	ini := "; factory diag\n[unit]\nserial = PF0ABCDE\n\n[summary]\nResult = \"FAIL\"\n# end\n"
+	result, err := rplib.ParseDiagResult([]byte(ini), rplib.DIAG_FORMAT_INI)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, &rplib.DiagResult{Result: rplib.DIAG_RESULT_FAIL, Fields: map[string]string{"unit.serial": "PF0ABCDE", "summary.result": "FAIL"}})
+
+	result, err = rplib.ParseDiagResult([]byte("result=OK\n"), rplib.DIAG_FORMAT_INI)
+	c.Assert(err, IsNil)
+	c.Assert(result.Result, Equals, rplib.DIAG_RESULT_PASS)
+
+	_, err = rplib.ParseDiagResult([]byte("result\n"), rplib.DIAG_FORMAT_INI)
+	c.Assert(err, ErrorMatches, `Parse diagnostics result failed: Invalid line: "result"`)
+	_, err = rplib.ParseDiagResult([]byte("result=OK\n"), "xml")
+	c.Assert(err, ErrorMatches, `Unsupported diagnostics result format: "xml"`)
+}
+
+func (s *DiagSuite) TestReadDiagResultEfivar(c *C) {
+	// the attributes, then the data with the trailing NUL
+	dat := append([]byte{7, 0, 0, 0}, []byte("result=PASS\n\x00")...)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.efi.Dir, "FactoryDiag-"+diagGuid), dat, 0644), IsNil)
+
+	result, err := rplib.ReadDiagResult("efivar:FactoryDiag-"+diagGuid, s.root, s.efi, rplib.DIAG_FORMAT_INI)
+	c.Assert(err, IsNil)
+	c.Assert(result.Result, Equals, rplib.DIAG_RESULT_PASS)
+
+	_, err = rplib.ReadDiagResult("efivar:FactoryDiag", s.root, s.efi, rplib.DIAG_FORMAT_INI)
+	c.Assert(err, ErrorMatches, `Invalid EFI variable: "FactoryDiag"`)
+}
+
+func (s *DiagSuite) TestGateDiagResult(c *C) {
+	c.Assert(os.MkdirAll(filepath.Join(s.root, "factory"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.root, "factory/pass.json"), []byte(`{"result": "PASS"}`), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.root, "factory/fail.json"), []byte(`{"result": "FAIL"}`), 0644), IsNil)
+
+	for _, t := range []struct {
+		path string
+		skip bool
+		gate rplib.DiagGate
+	}{
+		{"factory/pass.json", false, rplib.DiagGate{Source: "factory/pass.json", Result: "PASS", Install: true}},
+		{"factory/fail.json", false, rplib.DiagGate{Source: "factory/fail.json", Result: "FAIL", Install: false}},
+		{"factory/fail.json", true, rplib.DiagGate{Source: "factory/fail.json", Result: "FAIL", Skipped: true, Install: true}},
+	} {
+		gate := rplib.GateDiagResult(t.path, s.root, s.efi, rplib.DIAG_FORMAT_JSON, t.skip)
+		c.Check(*gate, DeepEquals, t.gate)
+	}
+
+	// no result is not a pass
+	gate := rplib.GateDiagResult("factory/missing.json", s.root, s.efi, rplib.DIAG_FORMAT_JSON, false)
+	c.Assert(gate.Install, Equals, false)
+	c.Assert(gate.Result, Equals, "")
+	c.Assert(gate.Error, Matches, ".*no such file or directory")
+}
@@ -0,0 +1,217 @@
+package rplib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the retries of the download after the connection is broken
+const DOWNLOAD_RETRIES = 5
+
+// the kernel command line, changed in tests
+var ProcCmdline = "/proc/cmdline"
+
+// CmdlineValue() returns the value of key=value in the kernel command line
+func CmdlineValue(key string) string {
+	dat, err := ioutil.ReadFile(ProcCmdline)
+	if err != nil {
+		return ""
+	}
+	for _, field := range strings.Fields(string(dat)) {
+		if strings.HasPrefix(field, key+"=") {
+			return field[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+// DownloadProgress is called with the downloaded and the total bytes,
+// total is -1 if unknown.
+type DownloadProgress func(done, total int64)
+
+// LogProgress() logs the download progress every 5 percent
+func LogProgress(name string) DownloadProgress {
+	start := time.Now()
+	last := int64(-1)
+	return func(done, total int64) {
+		if total <= 0 {
+			return
+		}
+		percent := done * 100 / total
+		if percent/5 == last/5 && done != total {
+			return
+		}
+		last = percent
+		speed := float64(done) / time.Since(start).Seconds() / (1024 * 1024)
+		log.Printf("download %s: %d%% (%d/%d MiB, %.1f MiB/s)", name, percent, done>>20, total>>20, speed)
+	}
+}
+
+// fetchChecksum() fetches the sha256 checksum in <url>.sha256
+func fetchChecksum(url string) (string, error) {
+	resp, err := http.Get(url + PAYLOAD_CHECKSUM_SUFFIX)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetch checksum %s%s failed: %s", url, PAYLOAD_CHECKSUM_SUFFIX, resp.Status)
+	}
+	dat, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(dat))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Empty checksum %s%s", url, PAYLOAD_CHECKSUM_SUFFIX)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+type progressWriter struct {
+	done, total int64
+	progress    DownloadProgress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.done += int64(len(p))
+	if w.progress != nil {
+		w.progress(w.done, w.total)
+	}
+	return len(p), nil
+}
+
+// fetchRange() appends the url content from the offset to the file, with the
+// range request. It returns the new offset, or 0 if the server sends the whole
+// content, and if the download can be resumed after the error.
+func fetchRange(url string, f *os.File, h hash.Hash, offset int64, pw *progressWriter) (int64, bool, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return offset, false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return offset, true, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != offset {
+			return offset, false, fmt.Errorf("Unexpected Content-Range of %s: %q", url, resp.Header.Get("Content-Range"))
+		}
+		pw.total = total
+	case http.StatusOK:
+		// the server doesn't support ranges, start over
+		if offset > 0 {
+			log.Printf("%s doesn't support range requests, download from the start", url)
+			if err = f.Truncate(0); err != nil {
+				return offset, false, err
+			}
+			h.Reset()
+			offset = 0
+		}
+		pw.total = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file is complete already
+		if total, err := strconv.ParseInt(strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes */"), 10, 64); err == nil && total == offset {
+			return offset, false, nil
+		}
+		return offset, false, fmt.Errorf("Download %s failed: %s", url, resp.Status)
+	default:
+		return offset, false, fmt.Errorf("Download %s failed: %s", url, resp.Status)
+	}
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return offset, false, err
+	}
+	pw.done = offset
+	n, err := io.Copy(io.MultiWriter(f, h, pw), resp.Body)
+	offset += n
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	return offset, true, err
+}
+
+// DownloadFile() downloads the url to the file, and verifies the sha256
+// checksum. The checksum is fetched from <url>.sha256 if not given. An
+// existing file is the cache: it's used if the checksum matches, or the
+// download resumes from its end with range requests. The broken download
+// is also resumed, up to DOWNLOAD_RETRIES times.
+func DownloadFile(url, file, sum string, progress DownloadProgress) error {
+	var err error
+	if sum == "" {
+		if sum, err = fetchChecksum(url); err != nil {
+			return err
+		}
+	}
+	sum = strings.ToLower(sum)
+
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// hash the cached part
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		if hex.EncodeToString(h.Sum(nil)) == sum {
+			log.Printf("%s is cached in %s", url, file)
+			return nil
+		}
+		log.Printf("resume %s from %d", url, offset)
+	}
+
+	pw := &progressWriter{progress: progress}
+	resumed := offset > 0
+	for retry := 0; ; retry++ {
+		var resumable bool
+		offset, resumable, err = fetchRange(url, f, h, offset, pw)
+		if err == nil {
+			if hex.EncodeToString(h.Sum(nil)) == sum || !resumed {
+				break
+			}
+			// the cached part is broken, download all again
+			log.Printf("the cache of %s is broken, download from the start", url)
+			if err = f.Truncate(0); err != nil {
+				return err
+			}
+			h.Reset()
+			offset, resumed = 0, false
+			continue
+		}
+		if !resumable || retry == DOWNLOAD_RETRIES {
+			return err
+		}
+		log.Printf("%v, resume from %d", err, offset)
+		time.Sleep(time.Duration(retry+1) * time.Second)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		f.Close()
+		os.Remove(file)
+		return fmt.Errorf("Checksum mismatch of %s: sha256 %s, expected %s", url, got, sum)
+	}
+	log.Printf("%s downloaded to %s", url, file)
+	return f.Sync()
+}
@@ -0,0 +1,172 @@
+package rplib_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type DownloadSuite struct {
+	payload []byte
+	sum     string
+	server  *httptest.Server
+
+	lock   sync.Mutex
+	ranges []string // the Range headers of the payload requests
+	// noRange ignores the Range header, breakAt closes the connection at the
+	// offset once
+	noRange bool
+	breakAt int
+}
+
+var _ = Suite(&DownloadSuite{})
+
+func (s *DownloadSuite) SetUpTest(c *C) {
+	s.payload = bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	h := sha256.Sum256(s.payload)
+	s.sum = hex.EncodeToString(h[:])
+	s.ranges, s.noRange, s.breakAt = nil, false, 0
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+}
+
+func (s *DownloadSuite) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+func (s *DownloadSuite) serve(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/recovery.squashfs.sha256":
+		w.Write([]byte(s.sum + "  recovery.squashfs\n"))
+	case "/recovery.squashfs":
+		s.lock.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		breakAt := s.breakAt
+		s.breakAt = 0
+		s.lock.Unlock()
+
+		if breakAt > 0 {
+			hj, _ := w.(http.Hijacker)
+			conn, buf, _ := hj.Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 1048576\r\n\r\n")
+			buf.Write(s.payload[:breakAt])
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		if s.noRange {
+			w.Write(s.payload)
+			return
+		}
+		http.ServeContent(w, r, "recovery.squashfs", time.Time{}, bytes.NewReader(s.payload))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *DownloadSuite) url() string {
+	return s.server.URL + "/recovery.squashfs"
+}
+
+func (s *DownloadSuite) TestDownload(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	var last, total int64
+	err := rplib.DownloadFile(s.url(), file, "", func(done, t int64) { last, total = done, t })
+	c.Assert(err, IsNil)
+
+	got, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, s.payload), Equals, true)
+	c.Assert(last, Equals, int64(len(s.payload)))
+	c.Assert(total, Equals, int64(len(s.payload)))
+	c.Assert(s.ranges, DeepEquals, []string{""})
+}
+
+func (s *DownloadSuite) TestDownloadCached(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	c.Assert(ioutil.WriteFile(file, s.payload, 0644), IsNil)
+
+	c.Assert(rplib.DownloadFile(s.url(), file, s.sum, nil), IsNil)
+	c.Assert(s.ranges, HasLen, 0)
+}
+
+func (s *DownloadSuite) TestDownloadResume(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	c.Assert(ioutil.WriteFile(file, s.payload[:1000], 0644), IsNil)
+
+	c.Assert(rplib.DownloadFile(s.url(), file, s.sum, nil), IsNil)
+	c.Assert(s.ranges, DeepEquals, []string{"bytes=1000-"})
+	got, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, s.payload), Equals, true)
+}
+
+func (s *DownloadSuite) TestDownloadResumeNoRange(c *C) {
+	s.noRange = true
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	c.Assert(ioutil.WriteFile(file, s.payload[:1000], 0644), IsNil)
+
+	c.Assert(rplib.DownloadFile(s.url(), file, s.sum, nil), IsNil)
+	got, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, s.payload), Equals, true)
+}
+
+func (s *DownloadSuite) TestDownloadBrokenCache(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	c.Assert(ioutil.WriteFile(file, []byte("broken"), 0644), IsNil)
+
+	c.Assert(rplib.DownloadFile(s.url(), file, s.sum, nil), IsNil)
+	c.Assert(s.ranges, DeepEquals, []string{"bytes=6-", ""})
+	got, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, s.payload), Equals, true)
+}
+
+func (s *DownloadSuite) TestDownloadBrokenConnection(c *C) {
+	s.breakAt = 4096
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+
+	c.Assert(rplib.DownloadFile(s.url(), file, s.sum, nil), IsNil)
+	c.Assert(s.ranges, DeepEquals, []string{"", "bytes=4096-"})
+	got, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(got, s.payload), Equals, true)
+}
+
+func (s *DownloadSuite) TestDownloadChecksumMismatch(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.squashfs")
+	err := rplib.DownloadFile(s.url(), file, strings.Repeat("0", 64), nil)
+	c.Assert(err, ErrorMatches, "Checksum mismatch of .*")
+	_, err = os.Stat(file)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *DownloadSuite) TestDownloadNotFound(c *C) {
+	file := filepath.Join(c.MkDir(), "recovery.iso")
+	err := rplib.DownloadFile(s.server.URL+"/recovery.iso", file, s.sum, nil)
+	c.Assert(err, ErrorMatches, "Download .* failed: 404 Not Found")
+}
+
+func (s *DownloadSuite) TestCmdlineValue(c *C) {
+	cmdline := filepath.Join(c.MkDir(), "cmdline")
+	c.Assert(ioutil.WriteFile(cmdline, []byte("BOOT_IMAGE=/vmlinuz quiet oem-installer.payload-url=http://10.0.0.1/recovery.squashfs\n"), 0644), IsNil)
+	old := rplib.ProcCmdline
+	rplib.ProcCmdline = cmdline
+	defer func() { rplib.ProcCmdline = old }()
+
+	c.Assert(rplib.CmdlineValue("oem-installer.payload-url"), Equals, "http://10.0.0.1/recovery.squashfs")
+	c.Assert(rplib.CmdlineValue("quiet"), Equals, "")
+	c.Assert(rplib.CmdlineValue("BOOT_IMAGE"), Equals, "/vmlinuz")
+}
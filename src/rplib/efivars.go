@@ -0,0 +1,532 @@
+package rplib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+const (
+	EFIVARS_DIR         = "/sys/firmware/efi/efivars"
+	EFI_GLOBAL_VARIABLE = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+
+	EFI_VARIABLE_NON_VOLATILE       = 0x1
+	EFI_VARIABLE_BOOTSERVICE_ACCESS = 0x2
+	EFI_VARIABLE_RUNTIME_ACCESS     = 0x4
+	EFI_VARIABLE_DEFAULT_ATTRS      = EFI_VARIABLE_NON_VOLATILE | EFI_VARIABLE_BOOTSERVICE_ACCESS | EFI_VARIABLE_RUNTIME_ACCESS
+
+	LOAD_OPTION_ACTIVE = 0x1
+)
+
+const (
+	_EFIVARFS_MAGIC    = 0xde5e81e4
+	_FS_IOC_GETFLAGS   = 0x80086601
+	_FS_IOC_SETFLAGS   = 0x40086602
+	_FS_IMMUTABLE_FL   = 0x10
+	_DP_TYPE_MEDIA     = 0x04
+	_DP_TYPE_END       = 0x7f
+	_DP_MEDIA_HD       = 0x01
+	_DP_MEDIA_FILEPATH = 0x04
+	_DP_END_ENTIRE     = 0xff
+	_DP_HD_LENGTH      = 42
+	_DP_END_LENGTH     = 4
+	_MBR_TYPE_GPT      = 0x02
+	_SIGNATURE_GUID    = 0x02
+)
+
+var bootEntryRegex = regexp.MustCompile("^Boot([0-9A-F]{4})-" + EFI_GLOBAL_VARIABLE + "$")
+
+// EfiHardDrive is the HD() media device path node
+type EfiHardDrive struct {
+	PartitionNumber uint32
+	PartitionStart  uint64 // in logical blocks
+	PartitionSize   uint64 // in logical blocks
+	Signature       [16]byte
+}
+
+// EfiLoadOption is the EFI_LOAD_OPTION stored in Boot#### variables.
+// Only HD() and file path nodes are decoded, the raw device path is kept
+// so entries pointing to other devices are written back unchanged.
+type EfiLoadOption struct {
+	Attributes   uint32
+	Description  string
+	HardDrive    *EfiHardDrive
+	FilePath     string
+	DevicePath   []byte
+	OptionalData []byte
+}
+
+type EfiBootEntry struct {
+	Num    uint16
+	Option *EfiLoadOption
+}
+
+// Efivars accesses the EFI variables through efivarfs mounted on Dir
+type Efivars struct {
+	Dir string
+}
+
+func NewEfivars() *Efivars {
+	return &Efivars{Dir: EFIVARS_DIR}
+}
+
+// IsEfiBoot() returns true if the system is booted in UEFI mode
+func IsEfiBoot() bool {
+	_, err := os.Stat("/sys/firmware/efi")
+	return err == nil
+}
+
+func utf16Encode(s string) []byte {
+	var b bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(&b, binary.LittleEndian, c)
+	}
+	binary.Write(&b, binary.LittleEndian, uint16(0))
+	return b.Bytes()
+}
+
+// utf16Decode() decodes a null terminated UTF-16LE string, returns the
+// string and the length in bytes including the terminator.
+func utf16Decode(b []byte) (string, int, error) {
+	var chars []uint16
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			return string(utf16.Decode(chars)), i + 2, nil
+		}
+		chars = append(chars, c)
+	}
+	return "", 0, errors.New("Unterminated UTF-16 string")
+}
+
+// GuidString() formats the on-disk (mixed endian) GUID
+func GuidString(guid [16]byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(guid[0:4]),
+		binary.LittleEndian.Uint16(guid[4:6]),
+		binary.LittleEndian.Uint16(guid[6:8]),
+		guid[8:10], guid[10:16])
+}
+
+// EfiDevicePath() builds the device path of HD() and file path nodes
+func EfiDevicePath(hd *EfiHardDrive, filePath string) []byte {
+	var b bytes.Buffer
+	if hd != nil {
+		b.Write([]byte{_DP_TYPE_MEDIA, _DP_MEDIA_HD})
+		binary.Write(&b, binary.LittleEndian, uint16(_DP_HD_LENGTH))
+		binary.Write(&b, binary.LittleEndian, hd.PartitionNumber)
+		binary.Write(&b, binary.LittleEndian, hd.PartitionStart)
+		binary.Write(&b, binary.LittleEndian, hd.PartitionSize)
+		b.Write(hd.Signature[:])
+		b.Write([]byte{_MBR_TYPE_GPT, _SIGNATURE_GUID})
+	}
+	if filePath != "" {
+		path := utf16Encode(strings.Replace(filePath, "/", "\\", -1))
+		b.Write([]byte{_DP_TYPE_MEDIA, _DP_MEDIA_FILEPATH})
+		binary.Write(&b, binary.LittleEndian, uint16(4+len(path)))
+		b.Write(path)
+	}
+	b.Write([]byte{_DP_TYPE_END, _DP_END_ENTIRE})
+	binary.Write(&b, binary.LittleEndian, uint16(_DP_END_LENGTH))
+	return b.Bytes()
+}
+
+// parseDevicePath() decodes the HD() and file path nodes of the first instance
+func (opt *EfiLoadOption) parseDevicePath() error {
+	dp := opt.DevicePath
+	for len(dp) >= 4 {
+		typ, subtype := dp[0], dp[1]
+		length := int(binary.LittleEndian.Uint16(dp[2:4]))
+		if length < 4 || length > len(dp) {
+			return fmt.Errorf("Invalid device path node length: %d", length)
+		}
+		node := dp[4:length]
+		dp = dp[length:]
+
+		switch {
+		case typ == _DP_TYPE_END:
+			return nil
+		case typ == _DP_TYPE_MEDIA && subtype == _DP_MEDIA_HD:
+			if length != _DP_HD_LENGTH {
+				return fmt.Errorf("Invalid HD() node length: %d", length)
+			}
+			hd := &EfiHardDrive{
+				PartitionNumber: binary.LittleEndian.Uint32(node[0:4]),
+				PartitionStart:  binary.LittleEndian.Uint64(node[4:12]),
+				PartitionSize:   binary.LittleEndian.Uint64(node[12:20]),
+			}
+			copy(hd.Signature[:], node[20:36])
+			opt.HardDrive = hd
+		case typ == _DP_TYPE_MEDIA && subtype == _DP_MEDIA_FILEPATH:
+			path, _, err := utf16Decode(node)
+			if err != nil {
+				return err
+			}
+			opt.FilePath = path
+		}
+	}
+	return errors.New("Device path without end node")
+}
+
+func ParseEfiLoadOption(data []byte) (*EfiLoadOption, error) {
+	if len(data) < 6 {
+		return nil, errors.New("EFI load option too short")
+	}
+	opt := &EfiLoadOption{Attributes: binary.LittleEndian.Uint32(data[0:4])}
+	dpLen := int(binary.LittleEndian.Uint16(data[4:6]))
+
+	desc, n, err := utf16Decode(data[6:])
+	if err != nil {
+		return nil, err
+	}
+	opt.Description = desc
+
+	rest := data[6+n:]
+	if dpLen > len(rest) {
+		return nil, fmt.Errorf("Invalid device path length: %d", dpLen)
+	}
+	opt.DevicePath = rest[:dpLen]
+	opt.OptionalData = rest[dpLen:]
+	if err = opt.parseDevicePath(); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// NewEfiLoadOption() creates an active load option for the loader on the partition
+func NewEfiLoadOption(description string, hd *EfiHardDrive, loader string) *EfiLoadOption {
+	return &EfiLoadOption{
+		Attributes:  LOAD_OPTION_ACTIVE,
+		Description: description,
+		HardDrive:   hd,
+		FilePath:    strings.Replace(loader, "/", "\\", -1),
+		DevicePath:  EfiDevicePath(hd, loader),
+	}
+}
+
+func (opt *EfiLoadOption) Bytes() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, opt.Attributes)
+	binary.Write(&b, binary.LittleEndian, uint16(len(opt.DevicePath)))
+	b.Write(utf16Encode(opt.Description))
+	b.Write(opt.DevicePath)
+	b.Write(opt.OptionalData)
+	return b.Bytes()
+}
+
+func (opt *EfiLoadOption) String() string {
+	s := opt.Description
+	if opt.HardDrive != nil {
+		hd := opt.HardDrive
+		s += fmt.Sprintf("\tHD(%d,GPT,%s,0x%x,0x%x)", hd.PartitionNumber, GuidString(hd.Signature), hd.PartitionStart, hd.PartitionSize)
+	}
+	if opt.FilePath != "" {
+		s += "/File(" + opt.FilePath + ")"
+	}
+	return s
+}
+
+func (efi *Efivars) varPath(name string) string {
+	return filepath.Join(efi.Dir, name+"-"+EFI_GLOBAL_VARIABLE)
+}
+
+func (efi *Efivars) isEfivarfs() bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(efi.Dir, &st); err != nil {
+		return false
+	}
+	return uint32(st.Type) == _EFIVARFS_MAGIC
+}
+
+// clearImmutable() removes the immutable flag efivarfs sets on variables
+func clearImmutable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var flags int
+	if _, err = ioctl(f.Fd(), _FS_IOC_GETFLAGS, uintptr(unsafe.Pointer(&flags))); err != nil {
+		return err
+	}
+	if flags&_FS_IMMUTABLE_FL == 0 {
+		return nil
+	}
+	flags &^= _FS_IMMUTABLE_FL
+	_, err = ioctl(f.Fd(), _FS_IOC_SETFLAGS, uintptr(unsafe.Pointer(&flags)))
+	return err
+}
+
+func (efi *Efivars) ReadVar(name string) (attrs uint32, data []byte, err error) {
+	return efi.ReadVendorVar(name, EFI_GLOBAL_VARIABLE)
+}
+
+// ReadVendorVar() reads the variable of the vendor GUID
+func (efi *Efivars) ReadVendorVar(name string, guid string) (attrs uint32, data []byte, err error) {
+	dat, err := ioutil.ReadFile(filepath.Join(efi.Dir, name+"-"+guid))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(dat) < 4 {
+		return 0, nil, fmt.Errorf("Invalid EFI variable %s", name)
+	}
+	return binary.LittleEndian.Uint32(dat[0:4]), dat[4:], nil
+}
+
+// WriteVar() writes the variable, efivarfs requires attributes and data in one write
+func (efi *Efivars) WriteVar(name string, attrs uint32, data []byte) error {
+	path := efi.varPath(name)
+	flags := os.O_WRONLY | os.O_CREATE
+	if _, err := os.Stat(path); err == nil {
+		if efi.isEfivarfs() {
+			if err = clearImmutable(path); err != nil {
+				return err
+			}
+		} else {
+			flags |= os.O_TRUNC
+		}
+	}
+
+	buf := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(buf, attrs)
+	buf = append(buf, data...)
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("Write EFI variable %s failed: %v", name, err)
+	}
+	return f.Close()
+}
+
+func (efi *Efivars) DeleteVar(name string) error {
+	path := efi.varPath(name)
+	if efi.isEfivarfs() {
+		if err := clearImmutable(path); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+func bootVarName(num uint16) string {
+	return fmt.Sprintf("Boot%04X", num)
+}
+
+func (efi *Efivars) BootOrder() ([]uint16, error) {
+	_, data, err := efi.ReadVar("BootOrder")
+	if os.IsNotExist(err) {
+		return []uint16{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	order := make([]uint16, len(data)/2)
+	for i := range order {
+		order[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return order, nil
+}
+
+func (efi *Efivars) SetBootOrder(order []uint16) error {
+	data := make([]byte, len(order)*2)
+	for i, num := range order {
+		binary.LittleEndian.PutUint16(data[i*2:], num)
+	}
+	log.Printf("set BootOrder: %04X", order)
+	return efi.WriteVar("BootOrder", EFI_VARIABLE_DEFAULT_ATTRS, data)
+}
+
+func (efi *Efivars) SetBootNext(num uint16) error {
+	data := make([]byte, 2)
+	binary.LittleEndian.PutUint16(data, num)
+	log.Printf("set BootNext: %04X", num)
+	return efi.WriteVar("BootNext", EFI_VARIABLE_DEFAULT_ATTRS, data)
+}
+
+// BootEntries() lists all Boot#### entries sorted by number
+func (efi *Efivars) BootEntries() ([]EfiBootEntry, error) {
+	files, err := ioutil.ReadDir(efi.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []EfiBootEntry{}
+	for _, f := range files {
+		m := bootEntryRegex.FindStringSubmatch(f.Name())
+		if m == nil {
+			continue
+		}
+		num, _ := strconv.ParseUint(m[1], 16, 16)
+		_, data, err := efi.ReadVar(bootVarName(uint16(num)))
+		if err != nil {
+			return nil, err
+		}
+		opt, err := ParseEfiLoadOption(data)
+		if err != nil {
+			log.Printf("ignore %s: %v", bootVarName(uint16(num)), err)
+			continue
+		}
+		entries = append(entries, EfiBootEntry{uint16(num), opt})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Num < entries[j].Num })
+	return entries, nil
+}
+
+// FindBootEntries() returns numbers of entries which description contains the keyword
+func (efi *Efivars) FindBootEntries(keyword string) ([]uint16, error) {
+	entries, err := efi.BootEntries()
+	if err != nil {
+		return nil, err
+	}
+	nums := []uint16{}
+	for _, e := range entries {
+		if strings.Contains(e.Option.Description, keyword) {
+			nums = append(nums, e.Num)
+		}
+	}
+	return nums, nil
+}
+
+// CreateBootEntry() writes the option to the first free Boot#### and
+// puts it first in BootOrder, the same as efibootmgr -c.
+func (efi *Efivars) CreateBootEntry(opt *EfiLoadOption) (uint16, error) {
+	entries, err := efi.BootEntries()
+	if err != nil {
+		return 0, err
+	}
+	used := map[uint16]bool{}
+	for _, e := range entries {
+		used[e.Num] = true
+	}
+	var num uint16
+	for used[num] {
+		num++
+		if num == 0xffff {
+			return 0, errors.New("No free boot entry number")
+		}
+	}
+
+	log.Printf("create %s: %s", bootVarName(num), opt)
+	if err = efi.WriteVar(bootVarName(num), EFI_VARIABLE_DEFAULT_ATTRS, opt.Bytes()); err != nil {
+		return 0, err
+	}
+
+	order, err := efi.BootOrder()
+	if err != nil {
+		return 0, err
+	}
+	return num, efi.SetBootOrder(append([]uint16{num}, order...))
+}
+
+// DeleteBootEntry() deletes the Boot#### and removes it from BootOrder
+func (efi *Efivars) DeleteBootEntry(num uint16) error {
+	log.Printf("delete %s", bootVarName(num))
+	if err := efi.DeleteVar(bootVarName(num)); err != nil {
+		return err
+	}
+
+	order, err := efi.BootOrder()
+	if err != nil {
+		return err
+	}
+	newOrder := []uint16{}
+	for _, n := range order {
+		if n != num {
+			newOrder = append(newOrder, n)
+		}
+	}
+	if len(newOrder) == len(order) {
+		return nil
+	}
+	return efi.SetBootOrder(newOrder)
+}
+
+// GptPartitions() reads all used GPT partition entries from the disk
+// (device or image file), for the HD() device path node.
+func GptPartitions(disk string, blockSize int) ([]*EfiHardDrive, error) {
+	f, err := os.Open(disk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 92)
+	if _, err = f.ReadAt(header, int64(blockSize)); err != nil {
+		return nil, err
+	}
+	if string(header[0:8]) != "EFI PART" {
+		return nil, fmt.Errorf("No GPT found on %s", disk)
+	}
+	entriesLba := binary.LittleEndian.Uint64(header[72:80])
+	numEntries := binary.LittleEndian.Uint32(header[80:84])
+	entrySize := binary.LittleEndian.Uint32(header[84:88])
+	if entrySize < 128 || numEntries > 1024 {
+		return nil, fmt.Errorf("Invalid GPT partition entries on %s", disk)
+	}
+
+	table := make([]byte, numEntries*entrySize)
+	if _, err = f.ReadAt(table, int64(entriesLba)*int64(blockSize)); err != nil {
+		return nil, err
+	}
+
+	hds := []*EfiHardDrive{}
+	for i := uint32(0); i < numEntries; i++ {
+		entry := table[i*entrySize : (i+1)*entrySize]
+		first := binary.LittleEndian.Uint64(entry[32:40])
+		last := binary.LittleEndian.Uint64(entry[40:48])
+		if first == 0 && last == 0 {
+			continue
+		}
+		hd := &EfiHardDrive{
+			PartitionNumber: i + 1,
+			PartitionStart:  first,
+			PartitionSize:   last - first + 1,
+		}
+		copy(hd.Signature[:], entry[16:32])
+		hds = append(hds, hd)
+	}
+	return hds, nil
+}
+
+// GptPartition() returns the GPT partition entry of the partition number nr
+func GptPartition(disk string, nr int, blockSize int) (*EfiHardDrive, error) {
+	hds, err := GptPartitions(disk, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, hd := range hds {
+		if int(hd.PartitionNumber) == nr {
+			return hd, nil
+		}
+	}
+	return nil, fmt.Errorf("Partition %d not found on %s", nr, disk)
+}
+
+// LogicalBlockSize() returns the logical block size of the disk, 512 for image files
+func LogicalBlockSize(disk string) int {
+	dat, err := ioutil.ReadFile(filepath.Join(SysClassBlockDir, filepath.Base(disk), "queue/logical_block_size"))
+	if err != nil {
+		return 512
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(string(dat)))
+	if err != nil || size <= 0 {
+		return 512
+	}
+	return size
+}
@@ -0,0 +1,143 @@
+package rplib_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type EfivarsSuite struct {
+	efi *rplib.Efivars
+}
+
+var _ = Suite(&EfivarsSuite{})
+
+// partition GUID 6f7dbc1a-9b1c-4a5e-8e0e-1d2c3b4a5968 in on-disk byte order
+var testPartGuid = [16]byte{
+	0x1a, 0xbc, 0x7d, 0x6f, 0x1c, 0x9b, 0x5e, 0x4a,
+	0x8e, 0x0e, 0x1d, 0x2c, 0x3b, 0x4a, 0x59, 0x68,
+}
+
+func (s *EfivarsSuite) SetUpTest(c *C) {
+	s.efi = &rplib.Efivars{Dir: c.MkDir()}
+}
+
+// makeGptImage() creates an image with a GPT header and the second
+// partition entry from LBA 2048 to 4095.
+func makeGptImage(c *C) string {
+	img := filepath.Join(c.MkDir(), "disk.img")
+	dat := make([]byte, 34*512)
+	copy(dat[512:], "EFI PART")
+	binary.LittleEndian.PutUint64(dat[512+72:], 2)
+	binary.LittleEndian.PutUint32(dat[512+80:], 128)
+	binary.LittleEndian.PutUint32(dat[512+84:], 128)
+
+	entry := dat[2*512+128:]
+	copy(entry[16:32], testPartGuid[:])
+	binary.LittleEndian.PutUint64(entry[32:], 2048)
+	binary.LittleEndian.PutUint64(entry[40:], 4095)
+	c.Assert(ioutil.WriteFile(img, dat, 0644), IsNil)
+	return img
+}
+
+func (s *EfivarsSuite) TestGptPartition(c *C) {
+	img := makeGptImage(c)
+	hd, err := rplib.GptPartition(img, 2, 512)
+	c.Assert(err, IsNil)
+	c.Assert(hd.PartitionNumber, Equals, uint32(2))
+	c.Assert(hd.PartitionStart, Equals, uint64(2048))
+	c.Assert(hd.PartitionSize, Equals, uint64(2048))
+	c.Assert(rplib.GuidString(hd.Signature), Equals, "6f7dbc1a-9b1c-4a5e-8e0e-1d2c3b4a5968")
+
+	_, err = rplib.GptPartition(img, 1, 512)
+	c.Assert(err, NotNil)
+	_, err = rplib.GptPartition(img, 0, 512)
+	c.Assert(err, NotNil)
+}
+
+func (s *EfivarsSuite) TestLoadOption(c *C) {
+	hd := &rplib.EfiHardDrive{PartitionNumber: 1, PartitionStart: 2048, PartitionSize: 1572864, Signature: testPartGuid}
+	opt := rplib.NewEfiLoadOption(rplib.BOOT_ENTRY_RECOVERY, hd, "/EFI/BOOT/BOOTX64.EFI")
+	data := opt.Bytes()
+
+	// attributes, device path length, description "factory_restore\0"
+	c.Assert(binary.LittleEndian.Uint32(data[0:4]), Equals, uint32(rplib.LOAD_OPTION_ACTIVE))
+	dpLen := int(binary.LittleEndian.Uint16(data[4:6]))
+	dp := data[6+2*(len(rplib.BOOT_ENTRY_RECOVERY)+1):]
+	c.Assert(len(dp), Equals, dpLen)
+	// HD() node, file path node, end node
+	c.Assert(dp[0:4], DeepEquals, []byte{0x04, 0x01, 42, 0})
+	c.Assert(dp[42:44], DeepEquals, []byte{0x04, 0x04})
+	c.Assert(dp[len(dp)-4:], DeepEquals, []byte{0x7f, 0xff, 4, 0})
+
+	parsed, err := rplib.ParseEfiLoadOption(data)
+	c.Assert(err, IsNil)
+	c.Assert(parsed.Description, Equals, rplib.BOOT_ENTRY_RECOVERY)
+	c.Assert(parsed.FilePath, Equals, "\\EFI\\BOOT\\BOOTX64.EFI")
+	c.Assert(*parsed.HardDrive, DeepEquals, *hd)
+	c.Assert(parsed.Bytes(), DeepEquals, data)
+	c.Assert(parsed.String(), Equals, "factory_restore\tHD(1,GPT,6f7dbc1a-9b1c-4a5e-8e0e-1d2c3b4a5968,0x800,0x180000)/File(\\EFI\\BOOT\\BOOTX64.EFI)")
+
+	_, err = rplib.ParseEfiLoadOption(data[:20])
+	c.Assert(err, NotNil)
+}
+
+func (s *EfivarsSuite) TestCreateDeleteBootEntry(c *C) {
+	// an existing entry from firmware
+	err := s.efi.WriteVar("Boot0000", rplib.EFI_VARIABLE_DEFAULT_ATTRS, rplib.NewEfiLoadOption("UEFI Shell", nil, "").Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(s.efi.SetBootOrder([]uint16{0}), IsNil)
+
+	hd, err := rplib.GptPartition(makeGptImage(c), 2, 512)
+	c.Assert(err, IsNil)
+	num, err := s.efi.CreateBootEntry(rplib.NewEfiLoadOption(rplib.BOOT_ENTRY_RECOVERY, hd, "\\EFI\\BOOT\\BOOTX64.EFI"))
+	c.Assert(err, IsNil)
+	c.Assert(num, Equals, uint16(1))
+	num, err = s.efi.CreateBootEntry(rplib.NewEfiLoadOption(rplib.BOOT_ENTRY_UBUNTU_CLASSIC, hd, "\\EFI\\ubuntu\\shimx64.efi"))
+	c.Assert(err, IsNil)
+	c.Assert(num, Equals, uint16(2))
+
+	order, err := s.efi.BootOrder()
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []uint16{2, 1, 0})
+
+	entries, err := s.efi.BootEntries()
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 3)
+	c.Assert(entries[1].Option.Description, Equals, rplib.BOOT_ENTRY_RECOVERY)
+	c.Assert(entries[1].Option.HardDrive.PartitionStart, Equals, uint64(2048))
+
+	nums, err := s.efi.FindBootEntries(rplib.BOOT_ENTRY_RECOVERY)
+	c.Assert(err, IsNil)
+	c.Assert(nums, DeepEquals, []uint16{1})
+
+	c.Assert(s.efi.DeleteBootEntry(1), IsNil)
+	order, err = s.efi.BootOrder()
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []uint16{2, 0})
+	_, err = os.Stat(filepath.Join(s.efi.Dir, "Boot0001-"+rplib.EFI_GLOBAL_VARIABLE))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *EfivarsSuite) TestBootOrderAndNext(c *C) {
+	order, err := s.efi.BootOrder()
+	c.Assert(err, IsNil)
+	c.Assert(order, HasLen, 0)
+
+	c.Assert(s.efi.SetBootOrder([]uint16{3, 0x1a, 1}), IsNil)
+	c.Assert(s.efi.SetBootOrder([]uint16{1, 3}), IsNil)
+	order, err = s.efi.BootOrder()
+	c.Assert(err, IsNil)
+	c.Assert(order, DeepEquals, []uint16{1, 3})
+
+	c.Assert(s.efi.SetBootNext(0x1a), IsNil)
+	attrs, data, err := s.efi.ReadVar("BootNext")
+	c.Assert(err, IsNil)
+	c.Assert(attrs, Equals, uint32(rplib.EFI_VARIABLE_DEFAULT_ATTRS))
+	c.Assert(data, DeepEquals, []byte{0x1a, 0})
+}
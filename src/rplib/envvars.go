@@ -0,0 +1,51 @@
+package rplib
+
+import (
+	"fmt"
+	"sort"
+)
+
+// envVars keeps the bootloader environment variables in the order they are stored
+type envVars struct {
+	names  []string
+	values map[string]string
+}
+
+func (env *envVars) reset() {
+	env.names = nil
+	env.values = map[string]string{}
+}
+
+func (env *envVars) set(name, value string) {
+	if _, ok := env.values[name]; !ok {
+		env.names = append(env.names, name)
+	}
+	env.values[name] = value
+}
+
+func (env *envVars) Get(name string) string {
+	return env.values[name]
+}
+
+func (env *envVars) Unset(name string) {
+	if _, ok := env.values[name]; !ok {
+		return
+	}
+	delete(env.values, name)
+	for i, n := range env.names {
+		if n == name {
+			env.names = append(env.names[:i], env.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// List() returns "name=value" of all variables, sorted by name
+func (env *envVars) List() []string {
+	list := []string{}
+	for _, name := range env.names {
+		list = append(list, fmt.Sprintf("%s=%s", name, env.values[name]))
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,432 @@
+package rplib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ERASE_METHOD
+const (
+	ERASE_METHOD_AUTO      = "auto"
+	ERASE_METHOD_NVME      = "nvme"
+	ERASE_METHOD_ATA       = "ata"
+	ERASE_METHOD_EMMC      = "emmc"
+	ERASE_METHOD_OVERWRITE = "overwrite"
+)
+
+const (
+	ERASE_RESULT_PASS = "pass"
+	ERASE_RESULT_FAIL = "fail"
+)
+
+const (
+	_BLKGETSIZE64        = 0x80081272
+	_BLKSECDISCARD       = 0x127d
+	_NVME_IOCTL_ID       = 0x4e40
+	_NVME_IOCTL_ADMIN    = 0xc0484e41
+	_SG_IO               = 0x2285
+	_NVME_ADMIN_IDENTIFY = 0x06
+	_NVME_ADMIN_FORMAT   = 0x80
+	_NVME_SES_USER_DATA  = 1
+	_ATA_16              = 0x85
+	_ATA_SEC_SET_PASS    = 0xf1
+	_ATA_SEC_ERASE_PREP  = 0xf3
+	_ATA_SEC_ERASE_UNIT  = 0xf4
+	_ATA_SEC_DISABLE     = 0xf6
+	_SG_DXFER_NONE       = -1
+	_SG_DXFER_TO_DEV     = -2
+	_ERASE_TIMEOUT_MS    = 12 * 60 * 60 * 1000
+	_ERASE_ATA_PASSWORD  = "oem-erase"
+	_OVERWRITE_BLOCKSIZE = 1024 * 1024
+)
+
+// struct nvme_admin_cmd from linux/nvme_ioctl.h
+type nvmeAdminCmd struct {
+	opcode      uint8
+	flags       uint8
+	rsvd1       uint16
+	nsid        uint32
+	cdw2        uint32
+	cdw3        uint32
+	metadata    uint64
+	addr        uint64
+	metadataLen uint32
+	dataLen     uint32
+	cdw10       uint32
+	cdw11       uint32
+	cdw12       uint32
+	cdw13       uint32
+	cdw14       uint32
+	cdw15       uint32
+	timeoutMs   uint32
+	result      uint32
+}
+
+// struct sg_io_hdr from scsi/sg.h
+type sgIoHdr struct {
+	interfaceId    int32
+	dxferDirection int32
+	cmdLen         uint8
+	mxSbLen        uint8
+	iovecCount     uint16
+	dxferLen       uint32
+	dxferp         uintptr
+	cmdp           uintptr
+	sbp            uintptr
+	timeout        uint32
+	flags          uint32
+	packId         int32
+	usrPtr         uintptr
+	status         uint8
+	maskedStatus   uint8
+	msgStatus      uint8
+	sbLenWr        uint8
+	hostStatus     uint16
+	driverStatus   uint16
+	resid          int32
+	duration       uint32
+	info           uint32
+}
+
+// ioctl is the ioctl syscall, faked in tests
+var ioctl = func(fd uintptr, req uintptr, arg uintptr) (uintptr, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return r, errno
+	}
+	return r, nil
+}
+
+// EraseMethodFor() returns the hardware erase method matching the device name.
+func EraseMethodFor(device string) string {
+	node := filepath.Base(device)
+	switch {
+	case strings.HasPrefix(node, "nvme"):
+		return ERASE_METHOD_NVME
+	case strings.HasPrefix(node, "mmcblk"):
+		return ERASE_METHOD_EMMC
+	case strings.HasPrefix(node, "sd"):
+		return ERASE_METHOD_ATA
+	}
+	return ERASE_METHOD_OVERWRITE
+}
+
+// DeviceSerial() reads the serial number of a block device from sysfs.
+func DeviceSerial(device string) string {
+	sysdev := filepath.Join("/sys/class/block", filepath.Base(device), "device")
+	for _, attr := range []string{"serial", "wwid", "vpd_pg80"} {
+		dat, err := ioutil.ReadFile(filepath.Join(sysdev, attr))
+		if err != nil {
+			continue
+		}
+		serial := strings.TrimSpace(strings.Map(func(r rune) rune {
+			if r < 0x20 || r > 0x7e {
+				return -1
+			}
+			return r
+		}, string(dat)))
+		if serial != "" {
+			return serial
+		}
+	}
+	return "unknown"
+}
+
+// NvmeFormat() issues an NVMe Format NVM admin command with the user data
+// erase secure erase setting, keeping the current LBA format.
+func NvmeFormat(device string) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	nsid, err := ioctl(f.Fd(), _NVME_IOCTL_ID, 0)
+	if err != nil {
+		return fmt.Errorf("%s is not a nvme namespace: %v", device, err)
+	}
+
+	// Identify Namespace, FLBAS is at byte 26
+	identify := make([]byte, 4096)
+	cmd := nvmeAdminCmd{
+		opcode:  _NVME_ADMIN_IDENTIFY,
+		nsid:    uint32(nsid),
+		addr:    uint64(uintptr(unsafe.Pointer(&identify[0]))),
+		dataLen: uint32(len(identify)),
+	}
+	// the nvme command status is the positive return value, not errno
+	status, err := ioctl(f.Fd(), _NVME_IOCTL_ADMIN, uintptr(unsafe.Pointer(&cmd)))
+	if err != nil {
+		return fmt.Errorf("nvme identify namespace failed: %v", err)
+	}
+	if status != 0 {
+		return fmt.Errorf("nvme identify namespace failed with status 0x%x", status)
+	}
+	lbaf := uint32(identify[26] & 0xf)
+
+	cmd = nvmeAdminCmd{
+		opcode:    _NVME_ADMIN_FORMAT,
+		nsid:      uint32(nsid),
+		cdw10:     lbaf | _NVME_SES_USER_DATA<<9,
+		timeoutMs: _ERASE_TIMEOUT_MS,
+	}
+	status, err = ioctl(f.Fd(), _NVME_IOCTL_ADMIN, uintptr(unsafe.Pointer(&cmd)))
+	if err != nil {
+		return fmt.Errorf("nvme format failed: %v", err)
+	}
+	if status != 0 {
+		return fmt.Errorf("nvme format failed with status 0x%x", status)
+	}
+	return nil
+}
+
+// an SG_IO request with its buffers, the kernel reads the buffers through the
+// uintptrs in hdr. They are in one heap object, referenced until the ioctl
+// returns, as a stack copy could move while the kernel uses it.
+type ataCmd struct {
+	hdr   sgIoHdr
+	cdb   [16]byte
+	sense [32]byte
+	data  [512]byte
+}
+
+// sgIo sends the SG_IO request, faked in tests. The request escapes to the
+// heap through the func value.
+var sgIo = func(fd uintptr, cmd *ataCmd) error {
+	_, err := ioctl(fd, _SG_IO, uintptr(unsafe.Pointer(&cmd.hdr)))
+	runtime.KeepAlive(cmd)
+	return err
+}
+
+// ataPassthrough() sends an ATA command through SG_IO with ATA PASS-THROUGH(16).
+// A non-nil data is sent to the device as one 512 bytes PIO data-out sector.
+func ataPassthrough(f *os.File, command byte, data []byte) error {
+	cmd := &ataCmd{}
+	cmd.cdb[0] = _ATA_16
+	cmd.cdb[14] = command
+	cmd.hdr = sgIoHdr{
+		interfaceId:    'S',
+		dxferDirection: _SG_DXFER_NONE,
+		cmdLen:         uint8(len(cmd.cdb)),
+		mxSbLen:        uint8(len(cmd.sense)),
+		cmdp:           uintptr(unsafe.Pointer(&cmd.cdb[0])),
+		sbp:            uintptr(unsafe.Pointer(&cmd.sense[0])),
+		timeout:        _ERASE_TIMEOUT_MS,
+	}
+	if data != nil {
+		cmd.cdb[1] = 5 << 1 // PIO data-out
+		cmd.cdb[2] = 0x06   // T_DIR=0, BYT_BLOK=1, T_LENGTH=sector count
+		cmd.cdb[6] = 1
+		copy(cmd.data[:], data)
+		cmd.hdr.dxferDirection = _SG_DXFER_TO_DEV
+		cmd.hdr.dxferLen = uint32(len(cmd.data))
+		cmd.hdr.dxferp = uintptr(unsafe.Pointer(&cmd.data[0]))
+	} else {
+		cmd.cdb[1] = 3 << 1 // non-data
+	}
+
+	if err := sgIo(f.Fd(), cmd); err != nil {
+		return err
+	}
+	hdr := &cmd.hdr
+	if hdr.status != 0 || hdr.hostStatus != 0 || hdr.driverStatus&0xf != 0 {
+		return fmt.Errorf("ata command 0x%x failed, status: 0x%x, host: 0x%x, driver: 0x%x", command, hdr.status, hdr.hostStatus, hdr.driverStatus)
+	}
+	return nil
+}
+
+// AtaSecurityErase() sets a temporary user password and issues
+// ATA SECURITY ERASE UNIT, the same sequence hdparm uses. The password is
+// disabled again if the erase fails, not to leave the disk locked.
+func AtaSecurityErase(device string) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// word 0: bit 0 identifier (0 = user), words 1-16: password
+	sector := make([]byte, 512)
+	copy(sector[2:34], _ERASE_ATA_PASSWORD)
+
+	if err = ataPassthrough(f, _ATA_SEC_SET_PASS, sector); err != nil {
+		return fmt.Errorf("ata security set password failed: %v", err)
+	}
+	if err = ataPassthrough(f, _ATA_SEC_ERASE_PREP, nil); err != nil {
+		err = fmt.Errorf("ata security erase prepare failed: %v", err)
+	} else if err = ataPassthrough(f, _ATA_SEC_ERASE_UNIT, sector); err != nil {
+		err = fmt.Errorf("ata security erase unit failed: %v", err)
+	}
+	if err != nil {
+		if derr := ataPassthrough(f, _ATA_SEC_DISABLE, sector); derr != nil {
+			return fmt.Errorf("%v, and ata security disable password failed: %v", err, derr)
+		}
+		return err
+	}
+	return nil
+}
+
+// EmmcSecureTrim() discards the whole device with BLKSECDISCARD, which the
+// mmc driver issues as eMMC secure trim/erase.
+func EmmcSecureTrim(device string) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size uint64
+	if _, err = ioctl(f.Fd(), _BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); err != nil {
+		return fmt.Errorf("get size of %s failed: %v", device, err)
+	}
+	r := [2]uint64{0, size}
+	if _, err = ioctl(f.Fd(), _BLKSECDISCARD, uintptr(unsafe.Pointer(&r))); err != nil {
+		return fmt.Errorf("emmc secure trim failed: %v", err)
+	}
+	return nil
+}
+
+// Overwrite() overwrites the whole device (or file) in several passes.
+// The passes alternate 0x00 and 0xff patterns and the last pass is random data.
+func Overwrite(device string, passes int) error {
+	if passes <= 0 {
+		return fmt.Errorf("Invalid overwrite passes: %d", passes)
+	}
+
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, _OVERWRITE_BLOCKSIZE)
+	for pass := 1; pass <= passes; pass++ {
+		log.Printf("overwrite %s pass %d/%d", device, pass, passes)
+		random := pass == passes
+		if !random {
+			pattern := byte(0x00)
+			if pass%2 == 0 {
+				pattern = 0xff
+			}
+			for i := range buf {
+				buf[i] = pattern
+			}
+		}
+
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		for written := int64(0); written < size; {
+			n := int64(len(buf))
+			if size-written < n {
+				n = size - written
+			}
+			if random {
+				if _, err = rand.Read(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if _, err = f.Write(buf[:n]); err != nil {
+				return err
+			}
+			written += n
+		}
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type EraseCertificate struct {
+	Device    string    `json:"device"`
+	Serial    string    `json:"serial"`
+	Method    string    `json:"method"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// payload() is the certificate content covered by the signature
+func (cert *EraseCertificate) payload() ([]byte, error) {
+	unsigned := *cert
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+func (cert *EraseCertificate) Sign(key ed25519.PrivateKey) error {
+	payload, err := cert.payload()
+	if err != nil {
+		return err
+	}
+	cert.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+func (cert *EraseCertificate) Verify(key ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(cert.Signature)
+	if err != nil {
+		return err
+	}
+	payload, err := cert.payload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, payload, sig) {
+		return errors.New("Erase certificate signature mismatch")
+	}
+	return nil
+}
+
+// Save() writes the certificate as json to the file
+func (cert *EraseCertificate) Save(file string) error {
+	dat, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(dat, '\n'), 0644)
+}
+
+// LoadSigningKey() reads an ed25519 private key in PKCS#8 PEM format
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(dat)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", file)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edkey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", file)
+	}
+	return edkey, nil
+}
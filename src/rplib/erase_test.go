@@ -0,0 +1,160 @@
+package rplib_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type EraseSuite struct{}
+
+var _ = Suite(&EraseSuite{})
+
+func (s *EraseSuite) TestOverwrite(c *C) {
+	img := filepath.Join(c.MkDir(), "disk.img")
+	data := bytes.Repeat([]byte("customer data"), 200000)
+	err := ioutil.WriteFile(img, data, 0644)
+	c.Assert(err, IsNil)
+
+	err = rplib.Overwrite(img, 2)
+	c.Assert(err, IsNil)
+
+	dat, err := ioutil.ReadFile(img)
+	c.Assert(err, IsNil)
+	c.Assert(len(dat), Equals, len(data))
+	c.Assert(bytes.Contains(dat, []byte("customer data")), Equals, false)
+}
+
+func (s *EraseSuite) TestOverwriteInvalidPasses(c *C) {
+	img := filepath.Join(c.MkDir(), "disk.img")
+	err := ioutil.WriteFile(img, []byte("customer data"), 0644)
+	c.Assert(err, IsNil)
+
+	err = rplib.Overwrite(img, 0)
+	c.Assert(err, NotNil)
+}
+
+// fakeNvme() fakes the nvme ioctls, the admin commands return the statuses
+// in order: identify namespace, format
+func fakeNvme(statuses []uintptr, calls *int) func(fd uintptr, req uintptr, arg uintptr) (uintptr, error) {
+	return func(fd uintptr, req uintptr, arg uintptr) (uintptr, error) {
+		if req == 0x4e40 { // NVME_IOCTL_ID
+			return 1, nil
+		}
+		*calls++
+		return statuses[*calls-1], nil
+	}
+}
+
+func (s *EraseSuite) TestNvmeFormat(c *C) {
+	img := filepath.Join(c.MkDir(), "nvme0n1")
+	c.Assert(ioutil.WriteFile(img, nil, 0644), IsNil)
+
+	calls := 0
+	defer rplib.MockIoctl(fakeNvme([]uintptr{0, 0}, &calls))()
+	c.Assert(rplib.NvmeFormat(img), IsNil)
+	c.Assert(calls, Equals, 2)
+}
+
+func (s *EraseSuite) TestNvmeFormatStatus(c *C) {
+	img := filepath.Join(c.MkDir(), "nvme0n1")
+	c.Assert(ioutil.WriteFile(img, nil, 0644), IsNil)
+
+	// Invalid Format
+	calls := 0
+	defer rplib.MockIoctl(fakeNvme([]uintptr{0, 0x10a}, &calls))()
+	c.Assert(rplib.NvmeFormat(img), ErrorMatches, "nvme format failed with status 0x10a")
+
+	calls = 0
+	rplib.MockIoctl(fakeNvme([]uintptr{0x2, 0}, &calls))
+	c.Assert(rplib.NvmeFormat(img), ErrorMatches, "nvme identify namespace failed with status 0x2")
+	c.Assert(calls, Equals, 1)
+}
+
+// fakeAta() fakes the ATA commands, records them, and fails the command fail
+func fakeAta(fail byte, cmds *[]byte, passwords *[]string) func(command byte, data []byte) error {
+	return func(command byte, data []byte) error {
+		*cmds = append(*cmds, command)
+		if len(data) > 0 {
+			*passwords = append(*passwords, strings.TrimRight(string(data[2:34]), "\x00"))
+		}
+		if command == fail {
+			return errors.New("I/O error")
+		}
+		return nil
+	}
+}
+
+func (s *EraseSuite) TestAtaSecurityErase(c *C) {
+	img := filepath.Join(c.MkDir(), "sda")
+	c.Assert(ioutil.WriteFile(img, nil, 0644), IsNil)
+
+	var cmds []byte
+	var passwords []string
+	defer rplib.MockSgIo(fakeAta(0, &cmds, &passwords))()
+	c.Assert(rplib.AtaSecurityErase(img), IsNil)
+	// set password, erase prepare, erase unit
+	c.Assert(cmds, DeepEquals, []byte{0xf1, 0xf3, 0xf4})
+	c.Assert(passwords, DeepEquals, []string{"oem-erase", "oem-erase"})
+}
+
+// The password is disabled if the erase fails after it's set
+func (s *EraseSuite) TestAtaSecurityEraseDisablePassword(c *C) {
+	img := filepath.Join(c.MkDir(), "sda")
+	c.Assert(ioutil.WriteFile(img, nil, 0644), IsNil)
+
+	var cmds []byte
+	var passwords []string
+	defer rplib.MockSgIo(fakeAta(0xf4, &cmds, &passwords))()
+	c.Assert(rplib.AtaSecurityErase(img), ErrorMatches, "ata security erase unit failed: I/O error")
+	c.Assert(cmds, DeepEquals, []byte{0xf1, 0xf3, 0xf4, 0xf6})
+	c.Assert(passwords, DeepEquals, []string{"oem-erase", "oem-erase", "oem-erase"})
+
+	cmds, passwords = nil, nil
+	rplib.MockSgIo(fakeAta(0xf3, &cmds, &passwords))
+	c.Assert(rplib.AtaSecurityErase(img), ErrorMatches, "ata security erase prepare failed: I/O error")
+	c.Assert(cmds, DeepEquals, []byte{0xf1, 0xf3, 0xf6})
+
+	// the password isn't set, nothing to disable
+	cmds, passwords = nil, nil
+	rplib.MockSgIo(fakeAta(0xf1, &cmds, &passwords))
+	c.Assert(rplib.AtaSecurityErase(img), ErrorMatches, "ata security set password failed: I/O error")
+	c.Assert(cmds, DeepEquals, []byte{0xf1})
+}
+
+func (s *EraseSuite) TestEraseMethodFor(c *C) {
+	c.Assert(rplib.EraseMethodFor("/dev/nvme0n1"), Equals, rplib.ERASE_METHOD_NVME)
+	c.Assert(rplib.EraseMethodFor("/dev/mmcblk0"), Equals, rplib.ERASE_METHOD_EMMC)
+	c.Assert(rplib.EraseMethodFor("/dev/sda"), Equals, rplib.ERASE_METHOD_ATA)
+	c.Assert(rplib.EraseMethodFor("/dev/vda"), Equals, rplib.ERASE_METHOD_OVERWRITE)
+}
+
+func (s *EraseSuite) TestEraseCertificate(c *C) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+
+	cert := rplib.EraseCertificate{
+		Device: "/dev/sda",
+		Serial: "S3Z1NB0K123456",
+		Method: rplib.ERASE_METHOD_ATA,
+		Start:  time.Unix(1500000000, 0).UTC(),
+		End:    time.Unix(1500000600, 0).UTC(),
+		Result: rplib.ERASE_RESULT_PASS,
+	}
+	err = cert.Sign(key)
+	c.Assert(err, IsNil)
+	c.Assert(cert.Signature, Not(Equals), "")
+	c.Assert(cert.Verify(pub), IsNil)
+
+	cert.Result = rplib.ERASE_RESULT_FAIL
+	c.Assert(cert.Verify(pub), NotNil)
+}
@@ -0,0 +1,18 @@
+package rplib
+
+// MockIoctl() replaces the ioctl syscall, and returns the restore function
+func MockIoctl(f func(fd uintptr, req uintptr, arg uintptr) (uintptr, error)) (restore func()) {
+	old := ioctl
+	ioctl = f
+	return func() { ioctl = old }
+}
+
+// MockSgIo() replaces the SG_IO request with a fake of the ATA command and
+// its data sector, and returns the restore function
+func MockSgIo(f func(command byte, data []byte) error) (restore func()) {
+	old := sgIo
+	sgIo = func(fd uintptr, cmd *ataCmd) error {
+		return f(cmd.cdb[14], cmd.data[:cmd.hdr.dxferLen])
+	}
+	return func() { sgIo = old }
+}
@@ -0,0 +1,306 @@
+package rplib
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// FS_TYPE, the filesystem names in gadget.yaml
+const (
+	FS_TYPE_VFAT     = "vfat"
+	FS_TYPE_VFAT_16  = "vfat-16"
+	FS_TYPE_VFAT_32  = "vfat-32"
+	FS_TYPE_EXT4     = "ext4"
+	FS_TYPE_SWAP     = "swap"
+	FS_TYPE_ISO9660  = "iso9660"
+	FS_TYPE_SQUASHFS = "squashfs"
+	FS_TYPE_NONE     = "none"
+)
+
+const (
+	FAT_LABEL_MAX  = 11
+	EXT4_LABEL_MAX = 16
+	SWAP_LABEL_MAX = 16
+)
+
+var (
+	uuidRegex      = regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$")
+	fatVolIdRegex  = regexp.MustCompile("^[0-9A-F]{4}-?[0-9A-F]{4}$")
+	fatLabelRegexp = regexp.MustCompile("^[A-Z0-9 !#$%&'()@^_`{}~-]*$")
+)
+
+type FormatOptions struct {
+	// UUID is the filesystem UUID, or the volume id (XXXX-XXXX) for vfat
+	UUID string
+	// UUIDSeed derives the UUID deterministically if UUID is not set
+	UUIDSeed string
+	// Extra arguments passed to mkfs
+	Extra []string
+}
+
+// FsInfo is the filesystem information probed from the superblock
+type FsInfo struct {
+	Type  string // vfat, ext4, swap, iso9660 or squashfs
+	Label string // the volume id for iso9660
+	UUID  string
+}
+
+// FsType() returns the probed type of a gadget filesystem name
+func FsType(fstype string) string {
+	if strings.HasPrefix(fstype, FS_TYPE_VFAT) {
+		return FS_TYPE_VFAT
+	}
+	return fstype
+}
+
+// ValidateLabel() checks the label length and charset of the filesystem
+func ValidateLabel(fstype string, label string) error {
+	switch FsType(fstype) {
+	case FS_TYPE_VFAT:
+		if len(label) > FAT_LABEL_MAX {
+			return fmt.Errorf("FAT label %q longer than %d", label, FAT_LABEL_MAX)
+		}
+		if !fatLabelRegexp.MatchString(label) {
+			return fmt.Errorf("FAT label %q must be upper-case letters, digits, space or !#$%%&'()-@^_`{}~", label)
+		}
+	case FS_TYPE_EXT4:
+		if len(label) > EXT4_LABEL_MAX {
+			return fmt.Errorf("ext4 label %q longer than %d", label, EXT4_LABEL_MAX)
+		}
+	case FS_TYPE_SWAP:
+		if len(label) > SWAP_LABEL_MAX {
+			return fmt.Errorf("swap label %q longer than %d", label, SWAP_LABEL_MAX)
+		}
+	case FS_TYPE_NONE:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported filesystem: %q", fstype)
+	}
+	return nil
+}
+
+// DeterministicUUID() returns the name based (version 5 style) UUID of the seed
+func DeterministicUUID(seed string) string {
+	sum := sha1.Sum([]byte(seed))
+	u := sum[:16]
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// fatVolId() returns the vfat volume id (XXXX-XXXX) of the UUID option
+func fatVolId(opts FormatOptions) string {
+	if opts.UUID != "" {
+		return strings.ToUpper(opts.UUID)
+	}
+	if opts.UUIDSeed != "" {
+		id := strings.ToUpper(DeterministicUUID(opts.UUIDSeed)[:8])
+		return id[:4] + "-" + id[4:]
+	}
+	return ""
+}
+
+func fsUUID(opts FormatOptions) string {
+	if opts.UUID != "" {
+		return strings.ToLower(opts.UUID)
+	}
+	if opts.UUIDSeed != "" {
+		return DeterministicUUID(opts.UUIDSeed)
+	}
+	return ""
+}
+
+// mkfsCommand() returns the mkfs command line of the filesystem
+func mkfsCommand(device, fstype, label string, opts FormatOptions) ([]string, string, error) {
+	var args []string
+	var uuid string
+
+	switch fstype {
+	case FS_TYPE_VFAT, FS_TYPE_VFAT_32, FS_TYPE_VFAT_16:
+		fat := "32"
+		if fstype == FS_TYPE_VFAT_16 {
+			fat = "16"
+		}
+		args = []string{"mkfs.vfat", "-F", fat}
+		if label != "" {
+			args = append(args, "-n", label)
+		}
+		if uuid = fatVolId(opts); uuid != "" {
+			if !fatVolIdRegex.MatchString(uuid) {
+				return nil, "", fmt.Errorf("Invalid vfat volume id: %q", uuid)
+			}
+			args = append(args, "-i", strings.Replace(uuid, "-", "", -1))
+			uuid = uuid[:4] + "-" + uuid[len(uuid)-4:]
+		}
+	case FS_TYPE_EXT4, FS_TYPE_SWAP:
+		args = []string{"mkfs.ext4", "-F"}
+		if fstype == FS_TYPE_SWAP {
+			args = []string{"mkswap", "-f"}
+		}
+		if label != "" {
+			args = append(args, "-L", label)
+		}
+		if uuid = fsUUID(opts); uuid != "" {
+			if !uuidRegex.MatchString(uuid) {
+				return nil, "", fmt.Errorf("Invalid filesystem UUID: %q", uuid)
+			}
+			args = append(args, "-U", uuid)
+		}
+	default:
+		return nil, "", fmt.Errorf("Unsupported filesystem: %q", fstype)
+	}
+
+	args = append(args, opts.Extra...)
+	return append(args, device), uuid, nil
+}
+
+// Format() creates the filesystem on the device, then probes the device to
+// confirm the filesystem type, label and UUID.
+func Format(device, fstype, label string, opts FormatOptions) (*FsInfo, error) {
+	if fstype == FS_TYPE_NONE {
+		return nil, nil
+	}
+	if err := ValidateLabel(fstype, label); err != nil {
+		return nil, err
+	}
+	args, uuid, err := mkfsCommand(device, fstype, label, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println(strings.Join(args, " "))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", args[0], err)
+	}
+
+	info, err := ProbeFilesystem(device)
+	if err != nil {
+		return nil, fmt.Errorf("Probe %s after %s failed: %v", device, args[0], err)
+	}
+	if info.Type != FsType(fstype) || info.Label != label || (uuid != "" && info.UUID != uuid) {
+		return nil, fmt.Errorf("Filesystem on %s is %s, label %q, UUID %s, not the formatted %s, label %q, UUID %s",
+			device, info.Type, info.Label, info.UUID, FsType(fstype), label, uuid)
+	}
+	log.Printf("%s formatted: %s, label: %q, UUID: %s", device, info.Type, info.Label, info.UUID)
+	return info, nil
+}
+
+func trimLabel(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+func formatUUID(u []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func probeExt4(sb []byte) *FsInfo {
+	// superblock at 1024, magic 0xef53 at 0x38
+	s := sb[1024:2048]
+	if binary.LittleEndian.Uint16(s[0x38:]) != 0xef53 {
+		return nil
+	}
+	return &FsInfo{Type: FS_TYPE_EXT4, Label: trimLabel(s[0x78:0x88]), UUID: formatUUID(s[0x68:0x78])}
+}
+
+func probeSwap(sb []byte) *FsInfo {
+	// swap header in the first 4K page, signature at the end of the page
+	if string(sb[4086:4096]) != "SWAPSPACE2" {
+		return nil
+	}
+	return &FsInfo{Type: FS_TYPE_SWAP, Label: trimLabel(sb[0x41c:0x42c]), UUID: formatUUID(sb[0x40c:0x41c])}
+}
+
+func probeSquashfs(sb []byte) *FsInfo {
+	// no label and UUID in squashfs
+	if string(sb[0:4]) != "hsqs" {
+		return nil
+	}
+	return &FsInfo{Type: FS_TYPE_SQUASHFS}
+}
+
+func probeVfat(sb []byte) *FsInfo {
+	if sb[510] != 0x55 || sb[511] != 0xaa {
+		return nil
+	}
+	// FAT32 extended boot record at 0x40, FAT12/16 at 0x24
+	var ebr []byte
+	if string(sb[0x52:0x57]) == "FAT32" {
+		ebr = sb[0x40:]
+	} else if string(sb[0x36:0x39]) == "FAT" {
+		ebr = sb[0x24:]
+	} else {
+		return nil
+	}
+	// boot signature 0x29: volume id and label are valid
+	if ebr[2] != 0x29 {
+		return &FsInfo{Type: FS_TYPE_VFAT}
+	}
+	volid := binary.LittleEndian.Uint32(ebr[3:7])
+	label := trimLabel(ebr[7:18])
+	if label == "NO NAME" {
+		label = ""
+	}
+	return &FsInfo{Type: FS_TYPE_VFAT, Label: label, UUID: fmt.Sprintf("%04X-%04X", volid>>16, volid&0xffff)}
+}
+
+// ISO9660 primary volume descriptor at sector 16 of 2048 bytes
+const (
+	ISO9660_PVD_OFFSET = 16 * 2048
+	ISO9660_PVD_SIZE   = 2048
+)
+
+func probeIso9660(pvd []byte) *FsInfo {
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		return nil
+	}
+	// blkid uses the volume creation date as UUID: YYYY-MM-DD-HH-MM-SS-CC
+	date := string(pvd[813:829])
+	uuid := ""
+	if strings.Trim(date, "0 \x00") != "" {
+		uuid = strings.Join([]string{date[0:4], date[4:6], date[6:8], date[8:10], date[10:12], date[12:14], date[14:16]}, "-")
+	}
+	return &FsInfo{Type: FS_TYPE_ISO9660, Label: trimLabel(pvd[40:72]), UUID: uuid}
+}
+
+// ProbeFilesystem() reads the superblock of the device to find the filesystem
+// type, label and UUID, the same as blkid for vfat, ext4, swap, squashfs and iso9660.
+func ProbeFilesystem(device string) (*FsInfo, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sb := make([]byte, 4096)
+	if _, err = io.ReadFull(f, sb); err != nil {
+		return nil, fmt.Errorf("Read superblock of %s failed: %v", device, err)
+	}
+
+	for _, probe := range []func([]byte) *FsInfo{probeExt4, probeSwap, probeSquashfs, probeVfat} {
+		if info := probe(sb); info != nil {
+			return info, nil
+		}
+	}
+
+	pvd := make([]byte, ISO9660_PVD_SIZE)
+	if _, err = f.ReadAt(pvd, ISO9660_PVD_OFFSET); err == nil {
+		if info := probeIso9660(pvd); info != nil {
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("No known filesystem found on %s", device)
+}
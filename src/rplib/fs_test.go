@@ -0,0 +1,121 @@
+package rplib_test
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type FsSuite struct {
+	img string
+}
+
+var _ = Suite(&FsSuite{})
+
+func (s *FsSuite) SetUpTest(c *C) {
+	s.img = filepath.Join(c.MkDir(), "part.img")
+	f, err := os.Create(s.img)
+	c.Assert(err, IsNil)
+	c.Assert(f.Truncate(64*1024*1024), IsNil)
+	f.Close()
+}
+
+func (s *FsSuite) writeAt(c *C, data []byte, offset int64) {
+	f, err := os.OpenFile(s.img, os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	_, err = f.WriteAt(data, offset)
+	c.Assert(err, IsNil)
+}
+
+func (s *FsSuite) TestValidateLabel(c *C) {
+	c.Assert(rplib.ValidateLabel("vfat", "ESP"), IsNil)
+	c.Assert(rplib.ValidateLabel("vfat-16", "RECOVERY_01"), IsNil)
+	c.Assert(rplib.ValidateLabel("vfat", "RECOVERYDATA"), NotNil)
+	c.Assert(rplib.ValidateLabel("vfat", "system-boot"), NotNil)
+	c.Assert(rplib.ValidateLabel("vfat", "A.B"), NotNil)
+	c.Assert(rplib.ValidateLabel("ext4", "writable"), IsNil)
+	c.Assert(rplib.ValidateLabel("ext4", "a-very-long-ext4-label"), NotNil)
+	c.Assert(rplib.ValidateLabel("swap", "swap"), IsNil)
+	c.Assert(rplib.ValidateLabel("btrfs", "writable"), NotNil)
+}
+
+func (s *FsSuite) TestDeterministicUUID(c *C) {
+	u1 := rplib.DeterministicUUID("writable")
+	c.Assert(u1, Equals, rplib.DeterministicUUID("writable"))
+	c.Assert(u1, Not(Equals), rplib.DeterministicUUID("system-boot"))
+	c.Assert(u1, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+}
+
+func (s *FsSuite) TestProbeVfat(c *C) {
+	// FAT32 boot sector with extended boot record
+	bs := make([]byte, 512)
+	copy(bs[0x52:], "FAT32   ")
+	bs[0x42] = 0x29
+	binary.LittleEndian.PutUint32(bs[0x43:], 0x1234abcd)
+	copy(bs[0x47:], "ESP        ")
+	bs[510], bs[511] = 0x55, 0xaa
+	s.writeAt(c, bs, 0)
+
+	info, err := rplib.ProbeFilesystem(s.img)
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, rplib.FsInfo{Type: "vfat", Label: "ESP", UUID: "1234-ABCD"})
+}
+
+func (s *FsSuite) TestProbeNothing(c *C) {
+	_, err := rplib.ProbeFilesystem(s.img)
+	c.Assert(err, NotNil)
+}
+
+func (s *FsSuite) TestFormatExt4(c *C) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		c.Skip("mkfs.ext4 not found")
+	}
+	uuid := rplib.DeterministicUUID("writable")
+	info, err := rplib.Format(s.img, "ext4", "writable", rplib.FormatOptions{UUIDSeed: "writable"})
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, rplib.FsInfo{Type: "ext4", Label: "writable", UUID: uuid})
+
+	info, err = rplib.ProbeFilesystem(s.img)
+	c.Assert(err, IsNil)
+	c.Assert(info.UUID, Equals, uuid)
+}
+
+func (s *FsSuite) TestFormatSwap(c *C) {
+	if _, err := exec.LookPath("mkswap"); err != nil {
+		c.Skip("mkswap not found")
+	}
+	uuid := "6f7dbc1a-9b1c-4a5e-8e0e-1d2c3b4a5968"
+	info, err := rplib.Format(s.img, "swap", "swap", rplib.FormatOptions{UUID: uuid})
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, rplib.FsInfo{Type: "swap", Label: "swap", UUID: uuid})
+}
+
+func (s *FsSuite) TestFormatVfat(c *C) {
+	if _, err := exec.LookPath("mkfs.vfat"); err != nil {
+		c.Skip("mkfs.vfat not found")
+	}
+	info, err := rplib.Format(s.img, "vfat", "ESP", rplib.FormatOptions{UUID: "1234-ABCD"})
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, rplib.FsInfo{Type: "vfat", Label: "ESP", UUID: "1234-ABCD"})
+}
+
+func (s *FsSuite) TestFormatInvalid(c *C) {
+	_, err := rplib.Format(s.img, "vfat", "system-boot", rplib.FormatOptions{})
+	c.Assert(err, NotNil)
+	_, err = rplib.Format(s.img, "ext4", "writable", rplib.FormatOptions{UUID: "not-a-uuid"})
+	c.Assert(err, NotNil)
+	_, err = rplib.Format(s.img, "xfs", "writable", rplib.FormatOptions{})
+	c.Assert(err, NotNil)
+
+	// nothing written
+	dat, err := ioutil.ReadFile(s.img)
+	c.Assert(err, IsNil)
+	c.Assert(dat[:4096], DeepEquals, make([]byte, 4096))
+}
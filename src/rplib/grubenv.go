@@ -0,0 +1,194 @@
+package rplib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The GRUB environment block, the same format grub-editenv reads and writes:
+// a fixed 1024 bytes file starts with the signature line, followed by
+// "name=value" lines and padded with '#'.
+const (
+	GRUBENV_SIZE      = 1024
+	GRUBENV_SIGNATURE = "# GRUB Environment Block\n"
+)
+
+// grubenv variables
+const (
+	GRUBENV_RECOVERY_TYPE = "recovery_type"
+	GRUBENV_SAVED_ENTRY   = "saved_entry"
+	GRUBENV_NEXT_ENTRY    = "next_entry"
+)
+
+type GrubEnv struct {
+	envVars
+}
+
+func NewGrubEnv() *GrubEnv {
+	return &GrubEnv{envVars{values: map[string]string{}}}
+}
+
+// grub escapes '\' and new line in values with a backslash
+func grubenvEscape(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	return strings.Replace(value, "\n", "\\\n", -1)
+}
+
+func grubenvUnescape(value string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+// Parse() parses a GRUB environment block
+func (env *GrubEnv) Parse(block []byte) error {
+	if len(block) != GRUBENV_SIZE {
+		return fmt.Errorf("Invalid grubenv size: %d, must be %d", len(block), GRUBENV_SIZE)
+	}
+	if !bytes.HasPrefix(block, []byte(GRUBENV_SIGNATURE)) {
+		return errors.New("Invalid grubenv signature")
+	}
+
+	env.reset()
+	body := block[len(GRUBENV_SIGNATURE):]
+	for len(body) > 0 && body[0] != '#' {
+		// find the end of line, skip the escaped new lines
+		end := -1
+		for i := 0; i < len(body); i++ {
+			if body[i] == '\\' {
+				i++
+			} else if body[i] == '\n' {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return errors.New("Invalid grubenv, unterminated variable")
+		}
+
+		line := string(body[:end])
+		body = body[end+1:]
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return fmt.Errorf("Invalid grubenv line: %q", line)
+		}
+		if err := env.Set(line[:eq], grubenvUnescape(line[eq+1:])); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range body {
+		if c != '#' {
+			return errors.New("Invalid grubenv padding")
+		}
+	}
+	return nil
+}
+
+// Bytes() returns the GRUB environment block
+func (env *GrubEnv) Bytes() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(GRUBENV_SIGNATURE)
+	for _, name := range env.names {
+		fmt.Fprintf(&b, "%s=%s\n", name, grubenvEscape(env.values[name]))
+	}
+	if b.Len() > GRUBENV_SIZE {
+		return nil, fmt.Errorf("grubenv too large: %d bytes, must be less than %d", b.Len(), GRUBENV_SIZE)
+	}
+	b.Write(bytes.Repeat([]byte("#"), GRUBENV_SIZE-b.Len()))
+	return b.Bytes(), nil
+}
+
+func (env *GrubEnv) Load(grubenv string) error {
+	block, err := ioutil.ReadFile(grubenv)
+	if err != nil {
+		return err
+	}
+	if err = env.Parse(block); err != nil {
+		return fmt.Errorf("%s: %v", grubenv, err)
+	}
+	return nil
+}
+
+func (env *GrubEnv) Save(grubenv string) error {
+	block, err := env.Bytes()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(grubenv, block, 0644)
+}
+
+func (env *GrubEnv) Set(name, value string) error {
+	if name == "" || strings.ContainsAny(name, "=\n#") {
+		return fmt.Errorf("Invalid grubenv variable name: %q", name)
+	}
+	env.set(name, value)
+	return nil
+}
+
+// GrubenvCreate() creates an empty GRUB environment block file
+func GrubenvCreate(grubenv string) error {
+	return NewGrubEnv().Save(grubenv)
+}
+
+// GrubenvValidate() checks the file is a valid GRUB environment block
+func GrubenvValidate(grubenv string) error {
+	return NewGrubEnv().Load(grubenv)
+}
+
+// GrubenvSet() sets the variables in an existing grubenv file. The new
+// variables are appended in the order of the names, the same file every time.
+func GrubenvSet(grubenv string, vars map[string]string) error {
+	env := NewGrubEnv()
+	if err := env.Load(grubenv); err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := vars[name]
+		log.Printf("grubenv %s: set %s=%s", grubenv, name, value)
+		if err := env.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return env.Save(grubenv)
+}
+
+// GrubenvSetRecoveryType() sets recovery_type to one of the RECOVERY_TYPE
+func GrubenvSetRecoveryType(grubenv, recoveryType string) error {
+	switch recoveryType {
+	case HEADLESS_INSTALLER, FACTORY_INSTALL, FACTORY_RESTORE:
+	default:
+		return fmt.Errorf("Invalid recovery type: %q", recoveryType)
+	}
+	return GrubenvSet(grubenv, map[string]string{GRUBENV_RECOVERY_TYPE: recoveryType})
+}
+
+// GrubenvSetBootEntry() sets the default boot entry to one of the BOOT_ENTRY.
+// If oneshot is true, only the next boot goes to the entry (like grub-reboot).
+func GrubenvSetBootEntry(grubenv, entry string, oneshot bool) error {
+	switch entry {
+	case BOOT_ENTRY_RECOVERY, BOOT_ENTRY_SNAPPY, BOOT_ENTRY_UBUNTU_CLASSIC:
+	default:
+		return fmt.Errorf("Invalid boot entry: %q", entry)
+	}
+	name := GRUBENV_SAVED_ENTRY
+	if oneshot {
+		name = GRUBENV_NEXT_ENTRY
+	}
+	return GrubenvSet(grubenv, map[string]string{name: entry})
+}
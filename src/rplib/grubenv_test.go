@@ -0,0 +1,157 @@
+package rplib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type GrubenvSuite struct {
+	tmpdir string
+}
+
+var _ = Suite(&GrubenvSuite{})
+
+func (s *GrubenvSuite) SetUpTest(c *C) {
+	s.tmpdir = c.MkDir()
+}
+
+func (s *GrubenvSuite) copyGolden(c *C, name string) string {
+	dat, err := ioutil.ReadFile(filepath.Join("test_data", name))
+	c.Assert(err, IsNil)
+	grubenv := filepath.Join(s.tmpdir, "grubenv")
+	err = ioutil.WriteFile(grubenv, dat, 0644)
+	c.Assert(err, IsNil)
+	return grubenv
+}
+
+func (s *GrubenvSuite) assertGolden(c *C, grubenv string, name string) {
+	golden, err := ioutil.ReadFile(filepath.Join("test_data", name))
+	c.Assert(err, IsNil)
+	dat, err := ioutil.ReadFile(grubenv)
+	c.Assert(err, IsNil)
+	c.Assert(string(dat), Equals, string(golden))
+}
+
+func (s *GrubenvSuite) TestCreate(c *C) {
+	grubenv := filepath.Join(s.tmpdir, "grubenv")
+	err := rplib.GrubenvCreate(grubenv)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, grubenv, "grubenv")
+}
+
+func (s *GrubenvSuite) TestLoad(c *C) {
+	env := rplib.NewGrubEnv()
+	err := env.Load("test_data/grubenv.factory_restore")
+	c.Assert(err, IsNil)
+	c.Assert(env.Get("recovery_type"), Equals, rplib.FACTORY_RESTORE)
+	c.Assert(env.Get("saved_entry"), Equals, rplib.BOOT_ENTRY_RECOVERY)
+	c.Assert(env.Get("next_entry"), Equals, rplib.BOOT_ENTRY_UBUNTU_CLASSIC)
+	c.Assert(env.Get("not_exist"), Equals, "")
+	c.Assert(env.List(), DeepEquals, []string{
+		"next_entry=ubuntu",
+		"recovery_type=factory_restore",
+		"saved_entry=factory_restore",
+	})
+}
+
+func (s *GrubenvSuite) TestSetRecoveryType(c *C) {
+	grubenv := s.copyGolden(c, "grubenv")
+	err := rplib.GrubenvSetRecoveryType(grubenv, rplib.FACTORY_INSTALL)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, grubenv, "grubenv.factory_install")
+
+	err = rplib.GrubenvSetRecoveryType(grubenv, "unknown")
+	c.Assert(err, NotNil)
+	s.assertGolden(c, grubenv, "grubenv.factory_install")
+}
+
+func (s *GrubenvSuite) TestSetBootEntry(c *C) {
+	grubenv := s.copyGolden(c, "grubenv")
+	err := rplib.GrubenvSetRecoveryType(grubenv, rplib.FACTORY_RESTORE)
+	c.Assert(err, IsNil)
+	err = rplib.GrubenvSetBootEntry(grubenv, rplib.BOOT_ENTRY_RECOVERY, false)
+	c.Assert(err, IsNil)
+	err = rplib.GrubenvSetBootEntry(grubenv, rplib.BOOT_ENTRY_UBUNTU_CLASSIC, true)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, grubenv, "grubenv.factory_restore")
+
+	err = rplib.GrubenvSetBootEntry(grubenv, "unknown", false)
+	c.Assert(err, NotNil)
+}
+
+func (s *GrubenvSuite) TestUnset(c *C) {
+	grubenv := s.copyGolden(c, "grubenv.factory_install")
+	env := rplib.NewGrubEnv()
+	err := env.Load(grubenv)
+	c.Assert(err, IsNil)
+	env.Unset("recovery_type")
+	env.Unset("not_exist")
+	err = env.Save(grubenv)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, grubenv, "grubenv")
+}
+
+func (s *GrubenvSuite) TestEscape(c *C) {
+	grubenv := s.copyGolden(c, "grubenv")
+	err := rplib.GrubenvSet(grubenv, map[string]string{"cmdline": "a\\b\nc"})
+	c.Assert(err, IsNil)
+
+	env := rplib.NewGrubEnv()
+	err = env.Load(grubenv)
+	c.Assert(err, IsNil)
+	c.Assert(env.Get("cmdline"), Equals, "a\\b\nc")
+}
+
+// The new variables are written in the order of the names
+func (s *GrubenvSuite) TestSetSorted(c *C) {
+	vars := map[string]string{}
+	for _, name := range []string{"e", "b", "d", "a", "c", "f", "h", "g"} {
+		vars[name] = name
+	}
+	for i := 0; i < 10; i++ {
+		grubenv := s.copyGolden(c, "grubenv")
+		c.Assert(rplib.GrubenvSet(grubenv, vars), IsNil)
+		dat, err := ioutil.ReadFile(grubenv)
+		c.Assert(err, IsNil)
+		c.Assert(strings.HasPrefix(string(dat), rplib.GRUBENV_SIGNATURE+"a=a\nb=b\nc=c\nd=d\ne=e\nf=f\ng=g\nh=h\n#"), Equals, true)
+	}
+}
+
+func (s *GrubenvSuite) TestTooLarge(c *C) {
+	grubenv := s.copyGolden(c, "grubenv")
+	err := rplib.GrubenvSet(grubenv, map[string]string{"big": strings.Repeat("x", rplib.GRUBENV_SIZE)})
+	c.Assert(err, NotNil)
+	s.assertGolden(c, grubenv, "grubenv")
+}
+
+func (s *GrubenvSuite) TestValidate(c *C) {
+	c.Assert(rplib.GrubenvValidate("test_data/grubenv"), IsNil)
+	c.Assert(rplib.GrubenvValidate("test_data/grubenv.factory_install"), IsNil)
+
+	golden, err := ioutil.ReadFile("test_data/grubenv.factory_install")
+	c.Assert(err, IsNil)
+
+	// truncated
+	grubenv := filepath.Join(s.tmpdir, "grubenv")
+	err = ioutil.WriteFile(grubenv, golden[:512], 0644)
+	c.Assert(err, IsNil)
+	c.Assert(rplib.GrubenvValidate(grubenv), NotNil)
+
+	// bad signature
+	err = ioutil.WriteFile(grubenv, bytes.Replace(golden, []byte("GRUB"), []byte("BURG"), 1), 0644)
+	c.Assert(err, IsNil)
+	c.Assert(rplib.GrubenvValidate(grubenv), NotNil)
+
+	// garbage in padding
+	bad := append([]byte{}, golden...)
+	bad[len(bad)-1] = 'x'
+	err = ioutil.WriteFile(grubenv, bad, 0644)
+	c.Assert(err, IsNil)
+	c.Assert(rplib.GrubenvValidate(grubenv), NotNil)
+}
@@ -0,0 +1,84 @@
+package rplib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+const (
+	COMPRESS_NONE = ""
+	COMPRESS_GZIP = "gzip"
+	COMPRESS_XZ   = "xz"
+)
+
+// CreateSparseImage() creates the disk image file of the size without
+// allocating the blocks. An existing file is truncated.
+func CreateSparseImage(file string, size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("Invalid image size: %d", size)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		return err
+	}
+	log.Printf("created sparse image %s, size: %d", file, size)
+	return nil
+}
+
+// CompressImage() compresses the image file with gzip or xz, the image file
+// is replaced by the compressed file the same as the command line tools.
+// It returns the compressed file name.
+func CompressImage(file string, method string) (string, error) {
+	switch method {
+	case COMPRESS_NONE:
+		return file, nil
+	case COMPRESS_XZ:
+		log.Printf("xz -T0 %s", file)
+		cmd := exec.Command("xz", "-f", "-T0", file)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("xz %s failed: %v", file, err)
+		}
+		return file + ".xz", nil
+	case COMPRESS_GZIP:
+		return file + ".gz", gzipFile(file, file+".gz")
+	}
+	return "", fmt.Errorf("Unsupported compression: %q", method)
+}
+
+func gzipFile(src, dst string) error {
+	log.Printf("gzip %s", src)
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("gzip %s failed: %v", src, err)
+	}
+	return os.Remove(src)
+}
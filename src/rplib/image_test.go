@@ -0,0 +1,64 @@
+package rplib_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type ImageSuite struct{}
+
+var _ = Suite(&ImageSuite{})
+
+func (s *ImageSuite) TestCreateSparseImage(c *C) {
+	file := filepath.Join(c.MkDir(), "out.img")
+	c.Assert(rplib.CreateSparseImage(file, 16*1024*1024*1024), IsNil)
+
+	info, err := os.Stat(file)
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(16*1024*1024*1024))
+	// no blocks allocated
+	c.Assert(info.Sys().(*syscall.Stat_t).Blocks, Equals, int64(0))
+
+	c.Assert(rplib.CreateSparseImage(file, 0), NotNil)
+}
+
+func (s *ImageSuite) TestCompressImageGzip(c *C) {
+	file := filepath.Join(c.MkDir(), "out.img")
+	data := make([]byte, 4096)
+	copy(data[512:], "EFI PART")
+	c.Assert(ioutil.WriteFile(file, data, 0644), IsNil)
+
+	compressed, err := rplib.CompressImage(file, rplib.COMPRESS_GZIP)
+	c.Assert(err, IsNil)
+	c.Assert(compressed, Equals, file+".gz")
+	_, err = os.Stat(file)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	f, err := os.Open(compressed)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	c.Assert(err, IsNil)
+	got, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, data)
+}
+
+func (s *ImageSuite) TestCompressImageNone(c *C) {
+	file := filepath.Join(c.MkDir(), "out.img")
+	c.Assert(ioutil.WriteFile(file, []byte("image"), 0644), IsNil)
+
+	compressed, err := rplib.CompressImage(file, rplib.COMPRESS_NONE)
+	c.Assert(err, IsNil)
+	c.Assert(compressed, Equals, file)
+
+	_, err = rplib.CompressImage(file, "bzip2")
+	c.Assert(err, NotNil)
+}
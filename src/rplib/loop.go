@@ -0,0 +1,206 @@
+package rplib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	LOOP_CONTROL = "/dev/loop-control"
+
+	_LOOP_SET_FD        = 0x4C00
+	_LOOP_CLR_FD        = 0x4C01
+	_LOOP_SET_STATUS64  = 0x4C04
+	_LOOP_GET_STATUS64  = 0x4C05
+	_LOOP_CONFIGURE     = 0x4C0A
+	_LOOP_CTL_GET_FREE  = 0x4C82
+	_LO_FLAGS_READ_ONLY = 1
+	_LO_FLAGS_AUTOCLEAR = 4
+	_LO_FLAGS_PARTSCAN  = 8
+)
+
+// struct loop_info64 in linux/loop.h
+type loopInfo64 struct {
+	device         uint64
+	inode          uint64
+	rdevice        uint64
+	offset         uint64
+	sizelimit      uint64
+	number         uint32
+	encryptType    uint32
+	encryptKeySize uint32
+	flags          uint32
+	fileName       [64]byte
+	cryptName      [64]byte
+	encryptKey     [32]byte
+	init           [2]uint64
+}
+
+// struct loop_config in linux/loop.h
+type loopConfig struct {
+	fd        uint32
+	blockSize uint32
+	info      loopInfo64
+	reserved  [8]uint64
+}
+
+// IsLoop() returns true if the device is a loop device
+func IsLoop(device string) bool {
+	return strings.HasPrefix(DiskNode(device), "loop")
+}
+
+// LoopBackingFile() returns the backing file of the loop device
+func LoopBackingFile(device string) (string, error) {
+	node := DiskNode(device)
+	dat, err := readSysfsString(filepath.Join(SysClassBlockDir, node, "loop", "backing_file"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not an attached loop device: %v", device, err)
+	}
+	return dat, nil
+}
+
+// LoopEnablePartScan() turns on the partition scan of the loop device, so
+// the kernel creates the partition nodes (loop0p1) of the image file.
+func LoopEnablePartScan(device string) error {
+	f, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var info loopInfo64
+	if _, err = ioctl(f.Fd(), _LOOP_GET_STATUS64, uintptr(unsafe.Pointer(&info))); err != nil {
+		return fmt.Errorf("LOOP_GET_STATUS64 on %s failed: %v", device, err)
+	}
+	if info.flags&_LO_FLAGS_PARTSCAN != 0 {
+		return nil
+	}
+
+	log.Printf("enable partition scan of %s", device)
+	info.flags |= _LO_FLAGS_PARTSCAN
+	if _, err = ioctl(f.Fd(), _LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&info))); err != nil {
+		return fmt.Errorf("LOOP_SET_STATUS64 on %s failed: %v", device, err)
+	}
+	return nil
+}
+
+// loopConfigure() sets the backing file of the loop device with the flags.
+// LOOP_CONFIGURE does it atomically, the kernels before 5.8 don't have it and
+// fall back to LOOP_SET_FD and LOOP_SET_STATUS64.
+func loopConfigure(loop *os.File, file *os.File, flags uint32) error {
+	var config loopConfig
+	config.fd = uint32(file.Fd())
+	config.info.flags = flags
+	copy(config.info.fileName[:len(config.info.fileName)-1], file.Name())
+
+	_, err := ioctl(loop.Fd(), _LOOP_CONFIGURE, uintptr(unsafe.Pointer(&config)))
+	if err != syscall.EINVAL && err != syscall.ENOTTY {
+		return err
+	}
+
+	if _, err = ioctl(loop.Fd(), _LOOP_SET_FD, file.Fd()); err != nil {
+		return err
+	}
+	if _, err = ioctl(loop.Fd(), _LOOP_SET_STATUS64, uintptr(unsafe.Pointer(&config.info))); err != nil {
+		ioctl(loop.Fd(), _LOOP_CLR_FD, 0)
+		return err
+	}
+	return nil
+}
+
+// loopAttach() attaches the file to a free loop device with the flags, and
+// returns the opened loop device. The caller closes it.
+func loopAttach(file string, flags uint32) (*os.File, error) {
+	mode := os.O_RDWR
+	if flags&_LO_FLAGS_READ_ONLY != 0 {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(file, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ctl, err := os.OpenFile(LOOP_CONTROL, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.Close()
+
+	// another process may take the free device before us, try again
+	for retry := 0; retry < 5; retry++ {
+		nr, err := ioctl(ctl.Fd(), _LOOP_CTL_GET_FREE, 0)
+		if err != nil {
+			return nil, fmt.Errorf("LOOP_CTL_GET_FREE failed: %v", err)
+		}
+		device := fmt.Sprintf("/dev/loop%d", nr)
+		loop, err := os.OpenFile(device, mode, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = loopConfigure(loop, f, flags)
+		if err == syscall.EBUSY {
+			loop.Close()
+			continue
+		} else if err != nil {
+			loop.Close()
+			return nil, fmt.Errorf("Attach %s to %s failed: %v", file, device, err)
+		}
+		log.Printf("%s attached to %s", file, device)
+		return loop, nil
+	}
+	return nil, fmt.Errorf("Attach %s failed: no free loop device", file)
+}
+
+// LoopAttach() attaches the file to a free loop device with partition scan,
+// and returns the loop device path.
+func LoopAttach(file string) (string, error) {
+	loop, err := loopAttach(file, _LO_FLAGS_PARTSCAN)
+	if err != nil {
+		return "", err
+	}
+	loop.Close()
+	return loop.Name(), nil
+}
+
+// LoopMountReadOnly() attaches the filesystem image file to a read-only loop
+// device and mounts it on the target. The loop device is detached by the
+// kernel (autoclear) after it's unmounted.
+func LoopMountReadOnly(file, fstype, target string, mounts *MountManager) error {
+	loop, err := loopAttach(file, _LO_FLAGS_READ_ONLY|_LO_FLAGS_AUTOCLEAR)
+	if err != nil {
+		return err
+	}
+	// the loop device is cleared once closed if not mounted
+	defer loop.Close()
+	return mounts.Mount(loop.Name(), target, fstype, syscall.MS_RDONLY, "")
+}
+
+// LoopDetach() detaches the backing file from the loop device. The device may
+// be busy for a while after unmount by udev probing the partitions.
+func LoopDetach(device string) error {
+	loop, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer loop.Close()
+
+	for retry := 0; ; retry++ {
+		_, err = ioctl(loop.Fd(), _LOOP_CLR_FD, 0)
+		if err != syscall.EBUSY || retry == 10 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("Detach %s failed: %v", device, err)
+	}
+	log.Printf("%s detached", device)
+	return nil
+}
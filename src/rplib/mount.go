@@ -0,0 +1,211 @@
+package rplib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MOUNT_NS_ENV is set in the installer re-executed in the private mount namespace
+const MOUNT_NS_ENV = "OEM_INSTALLER_MOUNT_NS"
+
+type mountPoint struct {
+	source, target string
+	tempDir        bool // target created by the manager, removed after unmount
+}
+
+// MountManager tracks all the mounts of the installer in a stack, so they are
+// unmounted in the reverse order even on error or panic:
+//
+//	mounts := NewMountManager()
+//	defer mounts.UnmountAll()
+type MountManager struct {
+	// TempRoot is the directory of the temporary mount points, os.TempDir() if empty
+	TempRoot string
+
+	lock   sync.Mutex
+	mounts []mountPoint
+}
+
+func NewMountManager() *MountManager {
+	return &MountManager{}
+}
+
+func (m *MountManager) push(mp mountPoint) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.mounts = append(m.mounts, mp)
+}
+
+// Mount() mounts the source on the target directory, which is created if not exist
+func (m *MountManager) Mount(source, target, fstype string, flags uintptr, data string) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	log.Printf("mount %s on %s (%s)", source, target, fstype)
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("Mount %s on %s failed: %v", source, target, err)
+	}
+	m.push(mountPoint{source, target, false})
+	return nil
+}
+
+// MountTemp() mounts the source on a new unique temporary directory,
+// and returns the mount point.
+func (m *MountManager) MountTemp(source, fstype string, flags uintptr, data string) (string, error) {
+	target, err := ioutil.TempDir(m.TempRoot, "oem-installer-mnt-")
+	if err != nil {
+		return "", err
+	}
+	log.Printf("mount %s on %s (%s)", source, target, fstype)
+	if err = syscall.Mount(source, target, fstype, flags, data); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("Mount %s on %s failed: %v", source, target, err)
+	}
+	m.push(mountPoint{source, target, true})
+	return target, nil
+}
+
+// Bind() bind mounts the source directory on the target
+func (m *MountManager) Bind(source, target string) error {
+	return m.Mount(source, target, "", syscall.MS_BIND, "")
+}
+
+// BindReadOnly() bind mounts the source directory on the target read-only,
+// the source mount stays writable.
+func (m *MountManager) BindReadOnly(source, target string) error {
+	if err := m.Bind(source, target); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		m.Unmount(target)
+		return fmt.Errorf("Remount %s read-only failed: %v", target, err)
+	}
+	return nil
+}
+
+// Mounted() returns the mount points, the latest last
+func (m *MountManager) Mounted() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	targets := []string{}
+	for _, mp := range m.mounts {
+		targets = append(targets, mp.target)
+	}
+	return targets
+}
+
+// unmount() unmounts the mount point, retries if busy,
+// and detaches it lazily as the last resort.
+func unmount(mp mountPoint) error {
+	var err error
+	for retry := 0; retry < 5; retry++ {
+		if err = syscall.Unmount(mp.target, 0); err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err == syscall.EBUSY {
+		log.Printf("%s is busy, detach it lazily", mp.target)
+		err = syscall.Unmount(mp.target, syscall.MNT_DETACH)
+	}
+	if err != nil {
+		return fmt.Errorf("Unmount %s failed: %v", mp.target, err)
+	}
+	log.Printf("unmounted %s", mp.target)
+	if mp.tempDir {
+		os.Remove(mp.target)
+	}
+	return nil
+}
+
+// unmountFrom() unmounts the stack down to the index in the reverse order.
+// All are tried, the first error is returned.
+func (m *MountManager) unmountFrom(index int) error {
+	var firstErr error
+	for i := len(m.mounts) - 1; i >= index; i-- {
+		if err := unmount(m.mounts[i]); err != nil {
+			log.Println(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	m.mounts = m.mounts[:index]
+	return firstErr
+}
+
+// Unmount() unmounts the target, and the mounts after it which may be on top of it
+func (m *MountManager) Unmount(target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := len(m.mounts) - 1; i >= 0; i-- {
+		if m.mounts[i].target == target {
+			return m.unmountFrom(i)
+		}
+	}
+	return fmt.Errorf("%s is not mounted by the installer", target)
+}
+
+// UnmountOnly() unmounts only the target and removes it from the stack, the
+// mounts after it are kept. It is for the mounts of the concurrent workers,
+// which are not nested but pushed in any order.
+func (m *MountManager) UnmountOnly(target string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := len(m.mounts) - 1; i >= 0; i-- {
+		if m.mounts[i].target == target {
+			err := unmount(m.mounts[i])
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return err
+		}
+	}
+	return fmt.Errorf("%s is not mounted by the installer", target)
+}
+
+// UnmountAll() unmounts all the mounts in the reverse order
+func (m *MountManager) UnmountAll() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.unmountFrom(0)
+}
+
+// InPrivateMountNamespace() returns true in the installer re-executed by
+// ExecInPrivateMountNamespace()
+func InPrivateMountNamespace() bool {
+	return os.Getenv(MOUNT_NS_ENV) == "1"
+}
+
+// ExecInPrivateMountNamespace() runs the same installer command in a new
+// private mount namespace, and returns its exit code. The mounts inside are
+// not visible to the host, and released by the kernel when it exits.
+func ExecInPrivateMountNamespace() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return -1, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), MOUNT_NS_ENV+"=1")
+	// the mounts are made private by go after unshare(CLONE_NEWNS)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+
+	log.Printf("run %s in private mount namespace", exe)
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,150 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type MountSuite struct {
+	tmp    string
+	mounts *rplib.MountManager
+}
+
+var _ = Suite(&MountSuite{})
+
+func (s *MountSuite) SetUpTest(c *C) {
+	s.tmp = c.MkDir()
+	if err := syscall.Mount("none", s.tmp, "tmpfs", 0, ""); err != nil {
+		c.Skip("tmpfs mount not permitted: " + err.Error())
+	}
+	syscall.Unmount(s.tmp, 0)
+	s.mounts = rplib.NewMountManager()
+	s.mounts.TempRoot = s.tmp
+}
+
+func (s *MountSuite) TearDownTest(c *C) {
+	if s.mounts != nil {
+		s.mounts.UnmountAll()
+	}
+}
+
+func isMountPoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+func (s *MountSuite) TestMountTempUnique(c *C) {
+	mnt1, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+	mnt2, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(mnt1, Not(Equals), mnt2)
+	c.Assert(isMountPoint(mnt1), Equals, true)
+	c.Assert(s.mounts.Mounted(), DeepEquals, []string{mnt1, mnt2})
+
+	c.Assert(s.mounts.Unmount(mnt2), IsNil)
+	c.Assert(s.mounts.Mounted(), DeepEquals, []string{mnt1})
+	// the temporary mount point is removed
+	_, err = os.Stat(mnt2)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(s.mounts.Unmount(mnt2), NotNil)
+}
+
+func (s *MountSuite) TestUnmountNested(c *C) {
+	mnt, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+	src := filepath.Join(s.tmp, "src")
+	c.Assert(os.Mkdir(src, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644), IsNil)
+	nested := filepath.Join(mnt, "a", "b")
+	c.Assert(s.mounts.Bind(src, nested), IsNil)
+	c.Assert(isMountPoint(nested), Equals, true)
+
+	// unmount the lower one unmounts the one on top of it first
+	c.Assert(s.mounts.Unmount(mnt), IsNil)
+	c.Assert(s.mounts.Mounted(), HasLen, 0)
+	c.Assert(isMountPoint(mnt), Equals, false)
+}
+
+func (s *MountSuite) TestUnmountOnly(c *C) {
+	mnt1, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+	mnt2, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+
+	// the mount after it is kept
+	c.Assert(s.mounts.UnmountOnly(mnt1), IsNil)
+	c.Assert(isMountPoint(mnt1), Equals, false)
+	c.Assert(isMountPoint(mnt2), Equals, true)
+	c.Assert(s.mounts.Mounted(), DeepEquals, []string{mnt2})
+
+	c.Assert(s.mounts.UnmountOnly(mnt1), NotNil)
+}
+
+// The mounts of the concurrent installs overlap in time: an install done
+// first must not unmount the mounts of the others made after its own.
+func (s *MountSuite) TestUnmountOnlyOverlap(c *C) {
+	firstMounted, secondMounted, firstDone := make(chan bool), make(chan bool), make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		mnt, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+		close(firstMounted)
+		<-secondMounted
+		if c.Check(err, IsNil) {
+			c.Check(s.mounts.UnmountOnly(mnt), IsNil)
+		}
+		close(firstDone)
+	}()
+	go func() {
+		defer wg.Done()
+		<-firstMounted
+		mnt, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+		close(secondMounted)
+		<-firstDone
+		if c.Check(err, IsNil) {
+			c.Check(isMountPoint(mnt), Equals, true)
+			c.Check(ioutil.WriteFile(filepath.Join(mnt, "seed.yaml"), []byte("snaps: []\n"), 0644), IsNil)
+			c.Check(s.mounts.Mounted(), DeepEquals, []string{mnt})
+		}
+	}()
+	wg.Wait()
+}
+
+func (s *MountSuite) TestUnmountAllOnPanic(c *C) {
+	var mnt string
+	func() {
+		defer func() { recover() }()
+		defer s.mounts.UnmountAll()
+		var err error
+		mnt, err = s.mounts.MountTemp("none", "tmpfs", 0, "")
+		c.Assert(err, IsNil)
+		panic("install failed")
+	}()
+	c.Assert(s.mounts.Mounted(), HasLen, 0)
+	c.Assert(isMountPoint(mnt), Equals, false)
+}
+
+func (s *MountSuite) TestUnmountBusy(c *C) {
+	mnt, err := s.mounts.MountTemp("none", "tmpfs", 0, "")
+	c.Assert(err, IsNil)
+	f, err := os.Create(filepath.Join(mnt, "busy"))
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	// detached lazily
+	c.Assert(s.mounts.Unmount(mnt), IsNil)
+	c.Assert(isMountPoint(mnt), Equals, false)
+}
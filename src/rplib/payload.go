@@ -0,0 +1,93 @@
+package rplib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var sha256Regex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// PAYLOAD_FILES, the payload images of the recovery tree on the installer
+// media, with the sha256 checksum in <payload>.sha256
+var PAYLOAD_FILES = []string{"recovery.squashfs", "recovery.iso"}
+
+const PAYLOAD_CHECKSUM_SUFFIX = ".sha256"
+
+// FindPayload() returns the payload file in the directory, or "" if not exist
+func FindPayload(dir string) string {
+	for _, name := range PAYLOAD_FILES {
+		payload := filepath.Join(dir, name)
+		if info, err := os.Stat(payload); err == nil && info.Mode().IsRegular() {
+			return payload
+		}
+	}
+	return ""
+}
+
+// FileSha256() returns the hex sha256 checksum of the file
+func FileSha256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum() checks the file with the sha256 checksum in the
+// <file>.sha256 file, in the sha256sum output format or only the checksum.
+func VerifyChecksum(file string) error {
+	dat, err := ioutil.ReadFile(file + PAYLOAD_CHECKSUM_SUFFIX)
+	if err != nil {
+		return fmt.Errorf("Read checksum of %s failed: %v", file, err)
+	}
+	fields := strings.Fields(string(dat))
+	if len(fields) == 0 {
+		return fmt.Errorf("Empty checksum file of %s", file)
+	}
+	expected := strings.ToLower(fields[0])
+
+	log.Printf("verify sha256 of %s", file)
+	sum, err := FileSha256(file)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("Checksum mismatch of %s: sha256 %s, expected %s", file, sum, expected)
+	}
+	return nil
+}
+
+// MountPayload() verifies the payload checksum, and mounts the squashfs or
+// ISO9660 payload read-only on the target.
+func MountPayload(payload, target string, mounts *MountManager) error {
+	if err := VerifyChecksum(payload); err != nil {
+		return err
+	}
+	return MountImageReadOnly(payload, target, mounts)
+}
+
+// MountImageReadOnly() mounts the squashfs or ISO9660 image read-only on the target
+func MountImageReadOnly(image, target string, mounts *MountManager) error {
+	info, err := ProbeFilesystem(image)
+	if err != nil {
+		return err
+	}
+	if info.Type != FS_TYPE_SQUASHFS && info.Type != FS_TYPE_ISO9660 {
+		return fmt.Errorf("Payload %s is %s, not squashfs or iso9660", image, info.Type)
+	}
+	return LoopMountReadOnly(image, info.Type, target, mounts)
+}
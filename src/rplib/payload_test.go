@@ -0,0 +1,85 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type PayloadSuite struct{}
+
+var _ = Suite(&PayloadSuite{})
+
+// sha256 of "payload"
+const payloadSha256 = "239f59ed55e737c77147cf55ad0c1b030b6d7ee748a7426952f9b852d5a935e5"
+
+func (s *PayloadSuite) TestFindPayload(c *C) {
+	dir := c.MkDir()
+	c.Assert(rplib.FindPayload(dir), Equals, "")
+
+	c.Assert(os.Mkdir(filepath.Join(dir, "recovery.iso"), 0755), IsNil)
+	c.Assert(rplib.FindPayload(dir), Equals, "")
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "recovery.squashfs"), []byte("hsqs"), 0644), IsNil)
+	c.Assert(rplib.FindPayload(dir), Equals, filepath.Join(dir, "recovery.squashfs"))
+}
+
+func (s *PayloadSuite) TestVerifyChecksum(c *C) {
+	payload := filepath.Join(c.MkDir(), "recovery.squashfs")
+	c.Assert(ioutil.WriteFile(payload, []byte("payload"), 0644), IsNil)
+
+	c.Assert(rplib.VerifyChecksum(payload), ErrorMatches, "Read checksum of .* failed: .*")
+
+	// sha256sum output
+	c.Assert(ioutil.WriteFile(payload+".sha256", []byte(payloadSha256+"  recovery.squashfs\n"), 0644), IsNil)
+	c.Assert(rplib.VerifyChecksum(payload), IsNil)
+
+	// only the checksum
+	c.Assert(ioutil.WriteFile(payload+".sha256", []byte(payloadSha256), 0644), IsNil)
+	c.Assert(rplib.VerifyChecksum(payload), IsNil)
+
+	c.Assert(ioutil.WriteFile(payload, []byte("payloaD"), 0644), IsNil)
+	c.Assert(rplib.VerifyChecksum(payload), ErrorMatches, "Checksum mismatch of .*")
+
+	c.Assert(ioutil.WriteFile(payload+".sha256", []byte("\n"), 0644), IsNil)
+	c.Assert(rplib.VerifyChecksum(payload), ErrorMatches, "Empty checksum file of .*")
+}
+
+func (s *PayloadSuite) TestMountPayloadNotImage(c *C) {
+	payload := filepath.Join(c.MkDir(), "recovery.iso")
+	c.Assert(ioutil.WriteFile(payload, []byte("payload"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(payload+".sha256", []byte(payloadSha256), 0644), IsNil)
+
+	c.Assert(rplib.MountPayload(payload, c.MkDir(), rplib.NewMountManager()), NotNil)
+}
+
+func (s *PayloadSuite) TestLoopMountReadOnly(c *C) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		c.Skip("mkfs.ext4 not found")
+	}
+	if _, err := os.Stat(rplib.LOOP_CONTROL); err != nil || os.Getuid() != 0 {
+		c.Skip("loop devices not available")
+	}
+
+	dir := c.MkDir()
+	image := filepath.Join(dir, "recovery.img")
+	c.Assert(rplib.CreateSparseImage(image, 8*1024*1024), IsNil)
+	c.Assert(exec.Command("mkfs.ext4", "-q", "-F", "-d", "test_data", image).Run(), IsNil)
+
+	mounts := rplib.NewMountManager()
+	defer mounts.UnmountAll()
+	target := filepath.Join(dir, "mnt")
+	c.Assert(rplib.LoopMountReadOnly(image, "ext4", target, mounts), IsNil)
+
+	_, err := os.Stat(filepath.Join(target, "config.yaml"))
+	c.Assert(err, IsNil)
+	err = ioutil.WriteFile(filepath.Join(target, "new"), []byte("x"), 0644)
+	c.Assert(err, NotNil)
+	c.Assert(os.IsPermission(err) || err.(*os.PathError).Err == syscall.EROFS, Equals, true)
+}
@@ -0,0 +1,207 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RAID_ASSEMBLE, the policy to assemble the arrays not running yet
+const (
+	RAID_ASSEMBLE_NEVER    = "never"    // only the arrays assembled already
+	RAID_ASSEMBLE_SCAN     = "scan"     // all arrays found by mdadm
+	RAID_ASSEMBLE_FIRMWARE = "firmware" // only the firmware RAID (Intel IMSM, DDF) containers and their volumes
+)
+
+// MdArray is an md array in sysfs
+type MdArray struct {
+	Node       string   // md126
+	Level      string   // raid0, raid1, ..., container
+	Metadata   string   // 1.2, external:imsm, external:/md127/0
+	ArrayState string   // clean, active, inactive, ...
+	Members    []string // the member disk nodes
+}
+
+// IsContainer() returns true for the IMSM/DDF container, which holds the
+// metadata of the member disks but is not a usable disk.
+func (md *MdArray) IsContainer() bool {
+	return md.Level == "container" || (strings.HasPrefix(md.Metadata, "external:") && !strings.HasPrefix(md.Metadata, "external:/"))
+}
+
+// IsRunning() returns true if the array is assembled and started
+func (md *MdArray) IsRunning() bool {
+	switch md.ArrayState {
+	case "clean", "active", "active-idle", "write-pending", "read-auto", "readonly":
+		return true
+	}
+	return false
+}
+
+// ListMdArrays() returns the md arrays in sysfs by the md/ attributes
+func ListMdArrays() ([]*MdArray, error) {
+	entries, err := filepath.Glob(filepath.Join(SysClassBlockDir, "md*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(entries)
+
+	arrays := []*MdArray{}
+	for _, entry := range entries {
+		mdDir := filepath.Join(entry, "md")
+		if _, err := readSysfsString(filepath.Join(mdDir, "metadata_version")); err != nil {
+			// a partition of the array, or not an md device
+			continue
+		}
+		md := &MdArray{Node: filepath.Base(entry), Members: []string{}}
+		md.Level, _ = readSysfsString(filepath.Join(mdDir, "level"))
+		md.Metadata, _ = readSysfsString(filepath.Join(mdDir, "metadata_version"))
+		md.ArrayState, _ = readSysfsString(filepath.Join(mdDir, "array_state"))
+
+		slaves, _ := ioutil.ReadDir(filepath.Join(entry, "slaves"))
+		seen := map[string]bool{}
+		for _, slave := range slaves {
+			disk := DiskNode(slave.Name())
+			if !seen[disk] {
+				seen[disk] = true
+				md.Members = append(md.Members, disk)
+			}
+		}
+		arrays = append(arrays, md)
+	}
+	return arrays, nil
+}
+
+// MdMemberDisks() returns the disk nodes which are members of any md array
+// or container, they are not targets themselves.
+func MdMemberDisks() map[string]bool {
+	members := map[string]bool{}
+	arrays, err := ListMdArrays()
+	if err != nil {
+		return members
+	}
+	for _, md := range arrays {
+		for _, disk := range md.Members {
+			members[disk] = true
+		}
+	}
+	return members
+}
+
+// RaidTargets() returns the running arrays usable as the target disk,
+// without the containers and the arrays on the excluded disk.
+func RaidTargets(exclude string) ([]*MdArray, error) {
+	arrays, err := ListMdArrays()
+	if err != nil {
+		return nil, err
+	}
+	targets := []*MdArray{}
+	for _, md := range arrays {
+		if md.IsContainer() || !md.IsRunning() || md.Node == exclude {
+			continue
+		}
+		onExclude := false
+		for _, disk := range md.Members {
+			onExclude = onExclude || disk == exclude
+		}
+		if !onExclude {
+			targets = append(targets, md)
+		}
+	}
+	return targets, nil
+}
+
+// MdExamined is an array found by mdadm --examine --scan
+type MdExamined struct {
+	Metadata  string
+	UUID      string
+	Container string // the container UUID of the volume in a container
+}
+
+// ParseMdadmExamine() parses the ARRAY lines of mdadm --examine --scan
+func ParseMdadmExamine(out string) []MdExamined {
+	arrays := []MdExamined{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "ARRAY" {
+			continue
+		}
+		var md MdExamined
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "metadata":
+				md.Metadata = kv[1]
+			case "UUID":
+				md.UUID = kv[1]
+			case "container":
+				md.Container = kv[1]
+			}
+		}
+		arrays = append(arrays, md)
+	}
+	return arrays
+}
+
+func mdadm(args ...string) (string, error) {
+	log.Printf("mdadm %s", strings.Join(args, " "))
+	out, err := exec.Command("mdadm", args...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("mdadm %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// AssembleRaid() assembles the arrays not running yet with the policy.
+// The firmware RAID containers are assembled and their volumes started
+// incrementally.
+func AssembleRaid(policy string) error {
+	switch policy {
+	case "", RAID_ASSEMBLE_NEVER:
+		return nil
+	case RAID_ASSEMBLE_SCAN:
+		// mdadm fails if there is nothing new to assemble
+		if out, err := mdadm("--assemble", "--scan"); err != nil {
+			log.Println(strings.TrimSpace(out))
+		}
+		return nil
+	case RAID_ASSEMBLE_FIRMWARE:
+	default:
+		return fmt.Errorf("Unknown raid assemble policy: %q", policy)
+	}
+
+	out, err := mdadm("--examine", "--scan")
+	if err != nil {
+		return err
+	}
+	for _, md := range ParseMdadmExamine(out) {
+		if (md.Metadata != "imsm" && md.Metadata != "ddf") || md.UUID == "" {
+			continue
+		}
+		if out, err := mdadm("--assemble", "--scan", "--uuid="+md.UUID); err != nil {
+			// assembled already
+			log.Println(strings.TrimSpace(out))
+		}
+	}
+
+	arrays, err := ListMdArrays()
+	if err != nil {
+		return err
+	}
+	for _, md := range arrays {
+		if md.IsContainer() {
+			if out, err := mdadm("--incremental", filepath.Join(DevDir, md.Node)); err != nil {
+				log.Println(strings.TrimSpace(out))
+			}
+		}
+	}
+	return nil
+}
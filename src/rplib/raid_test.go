@@ -0,0 +1,96 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+// addMd() adds the md array with the md/ attributes and the member disks
+func (s *BlockdevSuite) addMd(c *C, node, level, metadata, state string, size string, members ...string) {
+	s.addBlock(c, node, node, 0, "", 0)
+	dir := filepath.Join(rplib.SysClassBlockDir, node)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "md"), 0755), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(dir, "slaves"), 0755), IsNil)
+	for file, value := range map[string]string{"md/level": level, "md/metadata_version": metadata, "md/array_state": state, "size": size} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, file), []byte(value+"\n"), 0644), IsNil)
+	}
+	for _, member := range members {
+		c.Assert(os.Symlink(filepath.Join(rplib.SysClassBlockDir, member), filepath.Join(dir, "slaves", member)), IsNil)
+	}
+}
+
+func (s *BlockdevSuite) addDisk(c *C, node string) {
+	s.addBlock(c, node, node, 0, "", 0)
+	c.Assert(ioutil.WriteFile(filepath.Join(rplib.SysClassBlockDir, node, "size"), []byte("1000215216\n"), 0644), IsNil)
+}
+
+// Intel RST: container md127 and volume md125 on sda and sdb, usb stick sdc
+func (s *BlockdevSuite) addImsm(c *C) {
+	s.addDisk(c, "sda")
+	s.addDisk(c, "sdb")
+	s.addDisk(c, "sdc")
+	s.addBlock(c, "sdc", "sdc1", 1, "INSTALLER", 0x11112222)
+	s.addMd(c, "md127", "container", "external:imsm", "inactive", "0", "sda", "sdb")
+	s.addMd(c, "md125", "raid1", "external:/md127/0", "active", "1000212480", "sda", "sdb")
+	s.addBlock(c, "md125", "md125p1", 1, "", 0)
+}
+
+func (s *BlockdevSuite) TestListMdArrays(c *C) {
+	s.addImsm(c)
+
+	arrays, err := rplib.ListMdArrays()
+	c.Assert(err, IsNil)
+	c.Assert(arrays, HasLen, 2)
+	c.Assert(*arrays[0], DeepEquals, rplib.MdArray{Node: "md125", Level: "raid1", Metadata: "external:/md127/0", ArrayState: "active", Members: []string{"sda", "sdb"}})
+	c.Assert(arrays[0].IsContainer(), Equals, false)
+	c.Assert(arrays[0].IsRunning(), Equals, true)
+	c.Assert(arrays[1].Node, Equals, "md127")
+	c.Assert(arrays[1].IsContainer(), Equals, true)
+
+	c.Assert(rplib.MdMemberDisks(), DeepEquals, map[string]bool{"sda": true, "sdb": true})
+}
+
+func (s *BlockdevSuite) TestRaidTargets(c *C) {
+	s.addImsm(c)
+	s.addDisk(c, "sdd")
+	s.addDisk(c, "sde")
+	s.addMd(c, "md0", "raid0", "1.2", "inactive", "0", "sdd", "sde")
+
+	targets, err := rplib.RaidTargets("sdc")
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 1)
+	c.Assert(targets[0].Node, Equals, "md125")
+
+	// the array on the installer media
+	targets, err = rplib.RaidTargets("sda")
+	c.Assert(err, IsNil)
+	c.Assert(targets, HasLen, 0)
+
+	// the members and the container are not disks
+	disks, err := rplib.ListDisks()
+	c.Assert(err, IsNil)
+	c.Assert(disks, DeepEquals, []string{"md125", "sdc"})
+
+	c.Assert(rplib.PartitionPath("/dev/md125", 1), Equals, filepath.Join(rplib.DevDir, "md125p1"))
+	c.Assert(rplib.PartitionPath("/dev/md125", 2), Equals, filepath.Join(rplib.DevDir, "md125p2"))
+}
+
+func (s *BlockdevSuite) TestParseMdadmExamine(c *C) {
+	out := `ARRAY metadata=imsm UUID=1c41b8a6:1b8e7ab2:63bd1fa9:b41e8f72
+ARRAY /dev/md/Volume0 container=1c41b8a6:1b8e7ab2:63bd1fa9:b41e8f72 member=0 UUID=8b9c6b6a:27d34f2e:2bd0bd8e:8fa87b2c
+ARRAY /dev/md/0  metadata=1.2 UUID=3aaa0122:29827cfa:5331ad66:ca767371 name=host:0
+`
+	c.Assert(rplib.ParseMdadmExamine(out), DeepEquals, []rplib.MdExamined{
+		{Metadata: "imsm", UUID: "1c41b8a6:1b8e7ab2:63bd1fa9:b41e8f72"},
+		{UUID: "8b9c6b6a:27d34f2e:2bd0bd8e:8fa87b2c", Container: "1c41b8a6:1b8e7ab2:63bd1fa9:b41e8f72"},
+		{Metadata: "1.2", UUID: "3aaa0122:29827cfa:5331ad66:ca767371"},
+	})
+
+	c.Assert(rplib.AssembleRaid(rplib.RAID_ASSEMBLE_NEVER), IsNil)
+	c.Assert(rplib.AssembleRaid("always"), NotNil)
+}
@@ -0,0 +1,321 @@
+package rplib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// structures without offset start at 1MiB, except mbr
+	NON_MBR_START_OFFSET = 1024 * 1024
+	MBR_BOOTCODE_SIZE    = 440
+	MBR_SIZE             = 512
+	GPT_SIZE             = 34 * 512 // protective MBR, GPT header and 128 entries
+	GPT_BACKUP_SIZE      = 33 * 512 // entries and header at the end of disk
+	SECTOR_SIZE          = 512
+)
+
+// LaidOutStructure is a gadget structure with its absolute offset and size on the disk
+type LaidOutStructure struct {
+	*VolumeStructure
+	StartOffset int64
+	TotalSize   int64
+}
+
+func (ls *LaidOutStructure) IsBare() bool {
+	return ls.Filesystem == "" || ls.Filesystem == "none"
+}
+
+// ParseGadgetSize() parses sizes and offsets in gadget.yaml: bytes, or with K, M, G suffix
+func ParseGadgetSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(size, "K"):
+		unit = 1024
+	case strings.HasSuffix(size, "M"):
+		unit = 1024 * 1024
+	case strings.HasSuffix(size, "G"):
+		unit = 1024 * 1024 * 1024
+	}
+	if unit != 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size: %q", size)
+	}
+	return n * unit, nil
+}
+
+// LayoutVolume() calculates the offset and size of every structure in the volume
+func LayoutVolume(vol *GadgetVolume) ([]LaidOutStructure, error) {
+	laidOut := []LaidOutStructure{}
+	previousEnd := int64(0)
+	for i := range vol.Structure {
+		st := &vol.Structure[i]
+		size, err := ParseGadgetSize(st.Size)
+		if err != nil {
+			return nil, fmt.Errorf("structure %q: %v", st.Name, err)
+		}
+
+		var start int64
+		if st.Offset != "" {
+			if start, err = ParseGadgetSize(st.Offset); err != nil {
+				return nil, fmt.Errorf("structure %q: %v", st.Name, err)
+			}
+		} else {
+			start = previousEnd
+			if st.Type != "mbr" && start < NON_MBR_START_OFFSET {
+				start = NON_MBR_START_OFFSET
+			}
+		}
+
+		if st.Type == "mbr" && (start != 0 || size > MBR_BOOTCODE_SIZE) {
+			return nil, fmt.Errorf("structure %q: mbr must be at offset 0 and not larger than %d", st.Name, MBR_BOOTCODE_SIZE)
+		}
+		for _, ls := range laidOut {
+			if start < ls.StartOffset+ls.TotalSize && ls.StartOffset < start+size {
+				return nil, fmt.Errorf("structure %q overlaps %q", st.Name, ls.Name)
+			}
+		}
+
+		laidOut = append(laidOut, LaidOutStructure{st, start, size})
+		previousEnd = start + size
+	}
+	return laidOut, nil
+}
+
+// resolveOffsetWrite() resolves "[structure-name+]offset" to the absolute offset
+func resolveOffsetWrite(offsetWrite string, laidOut []LaidOutStructure) (int64, error) {
+	base := int64(0)
+	rel := offsetWrite
+	if i := strings.Index(offsetWrite, "+"); i != -1 {
+		name := offsetWrite[:i]
+		rel = offsetWrite[i+1:]
+		found := false
+		for _, ls := range laidOut {
+			if ls.Name == name {
+				base = ls.StartOffset
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("offset-write %q: structure %q not found", offsetWrite, name)
+		}
+	}
+	offset, err := ParseGadgetSize(rel)
+	if err != nil {
+		return 0, fmt.Errorf("offset-write %q: %v", offsetWrite, err)
+	}
+	return base + offset, nil
+}
+
+type region struct {
+	name       string
+	start, end int64
+}
+
+// PartitionExtent is a partition created by the installer on the disk, in
+// bytes, which the raw content must not overwrite
+type PartitionExtent struct {
+	Name       string
+	Start, End int64
+}
+
+// protectedRegions() returns the partition table regions of the disk, and
+// the partitions created by the installer
+func protectedRegions(schema string, diskSize int64, partitions []PartitionExtent) []region {
+	regions := []region{{"MBR partition table", MBR_BOOTCODE_SIZE, MBR_SIZE}}
+	if schema != "mbr" {
+		regions = append(regions, region{"GPT", MBR_SIZE, GPT_SIZE})
+		if diskSize > 0 {
+			regions = append(regions, region{"backup GPT", diskSize - GPT_BACKUP_SIZE, diskSize})
+		}
+	}
+	for _, p := range partitions {
+		regions = append(regions, region{"partition " + p.Name, p.Start, p.End})
+	}
+	return regions
+}
+
+func checkWrite(name string, start, end int64, owner *LaidOutStructure, laidOut []LaidOutStructure, protected []region) error {
+	for _, r := range protected {
+		if start < r.end && r.start < end {
+			return fmt.Errorf("%s [%d, %d) overwrites the %s", name, start, end, r.name)
+		}
+	}
+	for i := range laidOut {
+		ls := &laidOut[i]
+		if owner != nil && ls.VolumeStructure == owner.VolumeStructure {
+			continue
+		}
+		// offset-write pointers may go into the mbr boot code of another structure
+		if owner == nil && ls.Type == "mbr" {
+			continue
+		}
+		if start < ls.StartOffset+ls.TotalSize && ls.StartOffset < end {
+			return fmt.Errorf("%s [%d, %d) overwrites structure %q", name, start, end, ls.Name)
+		}
+	}
+	if owner != nil && (start < owner.StartOffset || end > owner.StartOffset+owner.TotalSize) {
+		return fmt.Errorf("%s [%d, %d) is out of structure %q", name, start, end, owner.Name)
+	}
+	return nil
+}
+
+type imageWrite struct {
+	image  string
+	offset int64
+}
+
+type lbaWrite struct {
+	offsetWrite string
+	at          int64
+	lba         uint32
+}
+
+// planLba() resolves and checks the offset-write location of the offset
+func planLba(offsetWrite string, offset int64, laidOut []LaidOutStructure, protected []region) (*lbaWrite, error) {
+	at, err := resolveOffsetWrite(offsetWrite, laidOut)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkWrite("offset-write "+offsetWrite, at, at+4, nil, laidOut, protected); err != nil {
+		return nil, err
+	}
+	return &lbaWrite{offsetWrite, at, uint32(offset / SECTOR_SIZE)}, nil
+}
+
+// copyAt() copies from the reader to the file at the offset
+func copyAt(f *os.File, r io.Reader, offset int64) error {
+	buf := make([]byte, 1024*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteRawContent() writes the image content of the bare structures (no
+// filesystem) and the offset-write pointers of the volume to the disk, which
+// can be a device or an image file. It never writes into the partition table,
+// the partitions created by the installer, or into other structures.
+func WriteRawContent(disk string, vol *GadgetVolume, gadgetDir string, partitions []PartitionExtent) error {
+	laidOut, err := LayoutVolume(vol)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(disk, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	diskSize, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	protected := protectedRegions(vol.Schema, diskSize, partitions)
+
+	// plan and check all the writes before writing anything
+	images := []imageWrite{}
+	lbas := []*lbaWrite{}
+	for i := range laidOut {
+		ls := &laidOut[i]
+		if ls.OffsetWrite != "" {
+			lba, err := planLba(ls.OffsetWrite, ls.StartOffset, laidOut, protected)
+			if err != nil {
+				return err
+			}
+			lbas = append(lbas, lba)
+		}
+
+		next := ls.StartOffset
+		for _, content := range ls.Content {
+			if content.Image == "" {
+				continue
+			}
+			if !ls.IsBare() {
+				return fmt.Errorf("structure %q: image content requires no filesystem", ls.Name)
+			}
+			image := filepath.Join(gadgetDir, content.Image)
+			info, err := os.Stat(image)
+			if err != nil {
+				return fmt.Errorf("structure %q: %v", ls.Name, err)
+			}
+
+			start := next
+			if content.Offset != "" {
+				rel, err := ParseGadgetSize(content.Offset)
+				if err != nil {
+					return fmt.Errorf("structure %q: %v", ls.Name, err)
+				}
+				start = ls.StartOffset + rel
+			}
+			size := info.Size()
+			if content.Size != "" {
+				limit, err := ParseGadgetSize(content.Size)
+				if err != nil {
+					return fmt.Errorf("structure %q: %v", ls.Name, err)
+				}
+				if size > limit {
+					return fmt.Errorf("structure %q: image %s size %d is larger than %d", ls.Name, content.Image, size, limit)
+				}
+				size = limit
+			}
+			if err = checkWrite("image "+content.Image, start, start+info.Size(), ls, laidOut, protected); err != nil {
+				return err
+			}
+			images = append(images, imageWrite{image, start})
+
+			if content.OffsetWrite != "" {
+				lba, err := planLba(content.OffsetWrite, start, laidOut, protected)
+				if err != nil {
+					return err
+				}
+				lbas = append(lbas, lba)
+			}
+			next = start + size
+		}
+	}
+
+	// the LBA pointers go after the images, they may point into the mbr boot code
+	for _, w := range images {
+		log.Printf("write %s to offset %d of %s", w.image, w.offset, disk)
+		image, err := os.Open(w.image)
+		if err != nil {
+			return err
+		}
+		err = copyAt(f, image, w.offset)
+		image.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, w := range lbas {
+		log.Printf("write LBA %d to offset %d (%s)", w.lba, w.at, w.offsetWrite)
+		lba := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lba, w.lba)
+		if _, err = f.WriteAt(lba, w.at); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,158 @@
+package rplib_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+const rawTestDiskSize = 4 * 1024 * 1024
+
+type RawContentSuite struct {
+	gadgetDir string
+	disk      string
+}
+
+var _ = Suite(&RawContentSuite{})
+
+func (s *RawContentSuite) SetUpTest(c *C) {
+	s.gadgetDir = c.MkDir()
+	s.disk = filepath.Join(c.MkDir(), "disk.img")
+
+	// the disk already has a partition table, filled with 0xee
+	c.Assert(ioutil.WriteFile(s.disk, bytes.Repeat([]byte{0xee}, rawTestDiskSize), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.gadgetDir, "pc-boot.img"), bytes.Repeat([]byte{0xb0}, 440), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.gadgetDir, "pc-core.img"), bytes.Repeat([]byte{0xc0}, 30000), 0644), IsNil)
+}
+
+func (s *RawContentSuite) loadPcVolume(c *C) *rplib.GadgetVolume {
+	var gi rplib.GadgetInfo
+	c.Assert(gi.Load("test_data/gadget.yaml"), IsNil)
+	vol := gi.Volumes["pc"]
+	return &vol
+}
+
+func (s *RawContentSuite) TestParseGadgetSize(c *C) {
+	for str, size := range map[string]int64{"440": 440, "8K": 8192, "1M": 1048576, "2G": 2147483648} {
+		n, err := rplib.ParseGadgetSize(str)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, size)
+	}
+	_, err := rplib.ParseGadgetSize("1T")
+	c.Assert(err, NotNil)
+	_, err = rplib.ParseGadgetSize("-1")
+	c.Assert(err, NotNil)
+}
+
+func (s *RawContentSuite) TestLayoutVolume(c *C) {
+	laidOut, err := rplib.LayoutVolume(s.loadPcVolume(c))
+	c.Assert(err, IsNil)
+	c.Assert(laidOut, HasLen, 4)
+	c.Assert(laidOut[0].StartOffset, Equals, int64(0))
+	c.Assert(laidOut[1].StartOffset, Equals, int64(1024*1024))
+	c.Assert(laidOut[2].StartOffset, Equals, int64(2*1024*1024))
+	c.Assert(laidOut[3].StartOffset, Equals, int64(770*1024*1024))
+	c.Assert(laidOut[1].IsBare(), Equals, true)
+	c.Assert(laidOut[2].IsBare(), Equals, false)
+}
+
+func (s *RawContentSuite) TestWriteRawContent(c *C) {
+	err := rplib.WriteRawContent(s.disk, s.loadPcVolume(c), s.gadgetDir, nil)
+	c.Assert(err, IsNil)
+
+	dat, err := ioutil.ReadFile(s.disk)
+	c.Assert(err, IsNil)
+	c.Assert(len(dat), Equals, rawTestDiskSize)
+
+	// mbr boot code with the LBA of BIOS Boot at mbr+92
+	c.Assert(dat[0:92], DeepEquals, bytes.Repeat([]byte{0xb0}, 92))
+	c.Assert(binary.LittleEndian.Uint32(dat[92:96]), Equals, uint32(2048))
+	c.Assert(dat[96:440], DeepEquals, bytes.Repeat([]byte{0xb0}, 440-96))
+	// partition table untouched
+	c.Assert(dat[440:1024*1024], DeepEquals, bytes.Repeat([]byte{0xee}, 1024*1024-440))
+	// BIOS Boot
+	c.Assert(dat[1024*1024:1024*1024+30000], DeepEquals, bytes.Repeat([]byte{0xc0}, 30000))
+	c.Assert(dat[1024*1024+30000:], DeepEquals, bytes.Repeat([]byte{0xee}, rawTestDiskSize-1024*1024-30000))
+}
+
+func (s *RawContentSuite) TestWriteRawContentMissingImage(c *C) {
+	vol := s.loadPcVolume(c)
+	vol.Structure[1].Content[0].Image = "not-exist.img"
+	err := rplib.WriteRawContent(s.disk, vol, s.gadgetDir, nil)
+	c.Assert(err, ErrorMatches, ".*not-exist.img.*")
+
+	// nothing written
+	dat, err := ioutil.ReadFile(s.disk)
+	c.Assert(err, IsNil)
+	c.Assert(dat, DeepEquals, bytes.Repeat([]byte{0xee}, rawTestDiskSize))
+}
+
+func (s *RawContentSuite) TestWriteRawContentProtectPartitionTable(c *C) {
+	// u-boot SPL at 8K overlaps the GPT entries
+	vol := &rplib.GadgetVolume{
+		Schema: "gpt",
+		Structure: []rplib.VolumeStructure{{
+			Name:    "spl",
+			Type:    "bare",
+			Offset:  "8K",
+			Size:    "32K",
+			Content: []rplib.VolumeContent{{Image: "pc-core.img"}},
+		}},
+	}
+	err := rplib.WriteRawContent(s.disk, vol, s.gadgetDir, nil)
+	c.Assert(err, ErrorMatches, ".*overwrites the GPT")
+
+	// fine with mbr schema
+	vol.Schema = "mbr"
+	err = rplib.WriteRawContent(s.disk, vol, s.gadgetDir, nil)
+	c.Assert(err, IsNil)
+	dat, err := ioutil.ReadFile(s.disk)
+	c.Assert(err, IsNil)
+	c.Assert(dat[8192:8192+30000], DeepEquals, bytes.Repeat([]byte{0xc0}, 30000))
+}
+
+func (s *RawContentSuite) TestWriteRawContentTooLarge(c *C) {
+	vol := &rplib.GadgetVolume{
+		Structure: []rplib.VolumeStructure{{
+			Name:    "mbr",
+			Type:    "mbr",
+			Size:    "440",
+			Content: []rplib.VolumeContent{{Image: "pc-core.img"}},
+		}},
+	}
+	err := rplib.WriteRawContent(s.disk, vol, s.gadgetDir, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *RawContentSuite) TestWriteRawContentProtectPartitions(c *C) {
+	// the recovery partition created by the installer right after 1M
+	recovery := []rplib.PartitionExtent{{Name: "recovery", Start: 1024*1024 + 16*1024, End: rawTestDiskSize}}
+	vol := &rplib.GadgetVolume{
+		Schema: "gpt",
+		Structure: []rplib.VolumeStructure{{
+			Name:    "u-boot",
+			Type:    "bare",
+			Offset:  "1M",
+			Size:    "1M",
+			Content: []rplib.VolumeContent{{Image: "pc-core.img"}},
+		}},
+	}
+	err := rplib.WriteRawContent(s.disk, vol, s.gadgetDir, recovery)
+	c.Assert(err, ErrorMatches, `image pc-core.img \[1048576, 1078576\) overwrites the partition recovery`)
+
+	// nothing written
+	dat, err := ioutil.ReadFile(s.disk)
+	c.Assert(err, IsNil)
+	c.Assert(dat, DeepEquals, bytes.Repeat([]byte{0xee}, rawTestDiskSize))
+
+	// the offset-write pointer into the partition
+	vol.Structure[0].Content = nil
+	vol.Structure[0].OffsetWrite = "1040K"
+	err = rplib.WriteRawContent(s.disk, vol, s.gadgetDir, recovery)
+	c.Assert(err, ErrorMatches, `offset-write 1040K .* overwrites the partition recovery`)
+}
@@ -14,3 +14,16 @@ const (
 	RECOVERY_OS_UBUNTU_CLASSIC        = "ubuntu_classic"
 	RECOVERY_OS_UBUNTU_CLASSIC_CURTIN = "ubuntu_classic_curtin"
 )
+
+// BOOT_MODE
+const (
+	BOOT_MODE_UEFI   = "uefi"
+	BOOT_MODE_LEGACY = "legacy"
+	BOOT_MODE_HYBRID = "hybrid"
+)
+
+// TARGET_POLICY, how to select the target disks for multi-target install
+const (
+	TARGET_POLICY_ALL  = "all"  // all disks except the installer media, up to the count if set
+	TARGET_POLICY_LIST = "list" // the listed devices
+)
@@ -0,0 +1,25 @@
+package rplib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// InstallReport is the result report of the install in the OEM log dir
+type InstallReport struct {
+	Project string    `json:"project"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Result  string    `json:"result"` // PASS or FAIL
+	Errors  []string  `json:"errors,omitempty"`
+	Diag    *DiagGate `json:"diag,omitempty"`
+}
+
+func (report *InstallReport) Save(file string) error {
+	dat, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(dat, '\n'), 0644)
+}
@@ -0,0 +1,112 @@
+package rplib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	_BLKRRPART = 0x125F
+	_BLKPG     = 0x1269
+
+	_BLKPG_ADD_PARTITION = 1
+)
+
+// struct blkpg_partition in linux/blkpg.h
+type blkpgPartition struct {
+	start   int64 // in bytes
+	length  int64
+	pno     int32
+	devname [64]byte
+	volname [64]byte
+}
+
+// struct blkpg_ioctl_arg in linux/blkpg.h
+type blkpgIoctlArg struct {
+	op      int32
+	flags   int32
+	datalen int32
+	data    uintptr
+}
+
+// the first and the longest interval of polling sysfs in WaitPartition()
+var (
+	waitPollMin = 10 * time.Millisecond
+	waitPollMax = 500 * time.Millisecond
+)
+
+// RereadPartitions() asks the kernel to re-read the partition table of the
+// disk with BLKRRPART. If the disk is busy (a partition is in use), the GPT
+// partitions not known by the kernel yet are added one by one with BLKPG.
+func RereadPartitions(disk string) error {
+	f, err := os.OpenFile(disk, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = ioctl(f.Fd(), _BLKRRPART, 0)
+	if err == nil {
+		return nil
+	}
+	if err != syscall.EBUSY {
+		return fmt.Errorf("BLKRRPART on %s failed: %v", disk, err)
+	}
+
+	log.Printf("%s is busy, add the partitions with BLKPG", disk)
+	blockSize := LogicalBlockSize(disk)
+	hds, gptErr := GptPartitions(disk, blockSize)
+	if gptErr != nil {
+		return fmt.Errorf("BLKRRPART on %s failed: %v, and no GPT to add partitions: %v", disk, err, gptErr)
+	}
+	diskNode := DiskNode(disk)
+	for _, hd := range hds {
+		if _, found := sysfsPartition(diskNode, int(hd.PartitionNumber)); found {
+			continue
+		}
+		part := blkpgPartition{
+			start:  int64(hd.PartitionStart) * int64(blockSize),
+			length: int64(hd.PartitionSize) * int64(blockSize),
+			pno:    int32(hd.PartitionNumber),
+		}
+		arg := blkpgIoctlArg{
+			op:      _BLKPG_ADD_PARTITION,
+			datalen: int32(unsafe.Sizeof(part)),
+			data:    uintptr(unsafe.Pointer(&part)),
+		}
+		if _, err = ioctl(f.Fd(), _BLKPG, uintptr(unsafe.Pointer(&arg))); err != nil {
+			return fmt.Errorf("BLKPG add partition %d of %s failed: %v", hd.PartitionNumber, disk, err)
+		}
+	}
+	return nil
+}
+
+// WaitPartition() waits until the partition nr of the disk is in sysfs and
+// its device node is created, polling with backoff. It returns the partition
+// device path, or an error after the timeout.
+func WaitPartition(disk string, nr int, timeout time.Duration) (string, error) {
+	diskNode := DiskNode(disk)
+	deadline := time.Now().Add(timeout)
+	interval := waitPollMin
+	for {
+		if node, found := sysfsPartition(diskNode, nr); found {
+			path := filepath.Join(DevDir, node)
+			if _, err := os.Stat(path); err == nil {
+				return path, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("Partition %d of %s not ready after %v", nr, disk, timeout)
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > waitPollMax {
+			interval = waitPollMax
+		}
+	}
+}
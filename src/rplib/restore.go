@@ -0,0 +1,55 @@
+package rplib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// the seconds to confirm the factory restore if restore-confirm-timeout is not set,
+// an unattended restore is cancelled instead of waiting forever
+const RESTORE_CONFIRM_TIMEOUT_DEFAULT = 60
+
+// RESTORE_DECISION, the operator decision of factory restore, passed to the posthook
+const (
+	RESTORE_CONFIRMED = "confirmed"
+	RESTORE_CANCELLED = "cancelled"
+)
+
+// the kernel command line of the recovery type, set by the recovery boot entry
+const RECOVERY_TYPE_CMDLINE = "recovery_type"
+
+// RestoreRecord is the outcome of the factory restore confirmation
+type RestoreRecord struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Prehook  string    `json:"prehook,omitempty"` // the error of the prehook
+	Decision string    `json:"decision"`
+	Posthook string    `json:"posthook,omitempty"` // the error of the posthook
+}
+
+func (record *RestoreRecord) Save(file string) error {
+	dat, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(dat, '\n'), 0644)
+}
+
+// RunHook() runs the hook with the args on the console, the operator can
+// interact with it.
+func RunHook(hook string, args ...string) error {
+	log.Printf("run hook %s %v", hook, args)
+	cmd := exec.Command(hook, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %s failed: %v", hook, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package rplib_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type RestoreSuite struct{}
+
+var _ = Suite(&RestoreSuite{})
+
+func (s *RestoreSuite) TestRunHook(c *C) {
+	dir := c.MkDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "posthook.sh")
+	c.Assert(ioutil.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" > "+out+"\n"), 0755), IsNil)
+
+	c.Assert(rplib.RunHook(hook, rplib.RESTORE_CONFIRMED), IsNil)
+	dat, err := ioutil.ReadFile(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(dat), Equals, "confirmed\n")
+
+	failing := filepath.Join(dir, "prehook.sh")
+	c.Assert(ioutil.WriteFile(failing, []byte("#!/bin/sh\nexit 3\n"), 0755), IsNil)
+	c.Assert(rplib.RunHook(failing), ErrorMatches, "hook .*/prehook.sh failed: exit status 3")
+	c.Assert(rplib.RunHook(filepath.Join(dir, "missing.sh")), NotNil)
+}
+
+func (s *RestoreSuite) TestRestoreRecordSave(c *C) {
+	start := time.Date(2017, 3, 1, 8, 0, 0, 0, time.UTC)
+	record := rplib.RestoreRecord{Start: start, End: start.Add(30 * time.Second), Decision: rplib.RESTORE_CANCELLED, Posthook: "hook failed"}
+	file := filepath.Join(c.MkDir(), "restore.json")
+	c.Assert(record.Save(file), IsNil)
+
+	dat, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	var got map[string]interface{}
+	c.Assert(json.Unmarshal(dat, &got), IsNil)
+	c.Assert(got, DeepEquals, map[string]interface{}{
+		"start":    "2017-03-01T08:00:00Z",
+		"end":      "2017-03-01T08:00:30Z",
+		"decision": "cancelled",
+		"posthook": "hook failed",
+	})
+}
@@ -0,0 +1,133 @@
+package rplib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// the snaps and their assertions on the payload
+	SEED_SNAPS_DIR      = "recovery/snaps"
+	SEED_ASSERTIONS_DIR = "recovery/assertions"
+	// the seed on the ubuntu core writable partition
+	SEED_DIR  = "system-data/var/lib/snapd/seed"
+	SEED_YAML = "seed.yaml"
+)
+
+// SeedSnap is a snap in seed.yaml
+type SeedSnap struct {
+	Name       string `yaml:"name"`
+	Channel    string `yaml:"channel,omitempty"`
+	File       string `yaml:"file"`
+	Unasserted bool   `yaml:"unasserted,omitempty"`
+}
+
+// Seed is seed.yaml of snapd
+type Seed struct {
+	Snaps []*SeedSnap `yaml:"snaps"`
+}
+
+// FindSeedSnaps() finds the snap files in the dir for the snaps in
+// config.yaml. A snap is the snap name, or the <name>_<revision>.snap file
+// name. It fails on the first snap missing, found in more than one
+// revision, or not a squashfs file.
+func FindSeedSnaps(dir string, snaps []string) ([]*SeedSnap, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.snap"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	byName := map[string][]string{}
+	for _, file := range files {
+		if name := FindSnapName(file); name != "" {
+			byName[name] = append(byName[name], filepath.Base(file))
+		}
+	}
+
+	found := []*SeedSnap{}
+	seen := map[string]bool{}
+	for _, snap := range snaps {
+		var name, file string
+		if strings.HasSuffix(snap, ".snap") {
+			file = filepath.Base(snap)
+			if name = FindSnapName(file); name == "" {
+				return nil, fmt.Errorf("Snap file %s is not <name>_<revision>.snap", file)
+			}
+			if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+				return nil, fmt.Errorf("Snap file %s not found in %s", file, dir)
+			}
+		} else {
+			name = snap
+			switch len(byName[name]) {
+			case 0:
+				names := []string{}
+				for n := range byName {
+					names = append(names, n)
+				}
+				sort.Strings(names)
+				return nil, fmt.Errorf("Snap %q not found in %s, the snaps found: %s", name, dir, strings.Join(names, ", "))
+			case 1:
+				file = byName[name][0]
+			default:
+				return nil, fmt.Errorf("Snap %q found in more than one revision: %s", name, strings.Join(byName[name], ", "))
+			}
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Snap %q listed more than once", name)
+		}
+		seen[name] = true
+
+		info, err := ProbeFilesystem(filepath.Join(dir, file))
+		if err != nil || info.Type != FS_TYPE_SQUASHFS {
+			return nil, fmt.Errorf("Snap file %s is not a squashfs", file)
+		}
+		log.Printf("seed snap %s: %s", name, file)
+		found = append(found, &SeedSnap{Name: name, Channel: "stable", File: file})
+	}
+	return found, nil
+}
+
+// WriteSeed() copies the snaps from snapsDir and the assertions from
+// assertionsDir to the seed dir, and writes seed.yaml. The snaps are
+// unasserted if there are no assertions.
+func WriteSeed(seedDir string, snaps []*SeedSnap, snapsDir string, assertionsDir string) error {
+	for _, dir := range []string{"snaps", "assertions"} {
+		if err := os.MkdirAll(filepath.Join(seedDir, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	assertions, _ := filepath.Glob(filepath.Join(assertionsDir, "*.assert"))
+	for _, file := range assertions {
+		if err := FileCopy(file, filepath.Join(seedDir, "assertions")); err != nil {
+			return err
+		}
+	}
+	if len(assertions) == 0 {
+		log.Printf("no assertions in %s, the seed snaps are unasserted", assertionsDir)
+	}
+
+	seed := Seed{Snaps: []*SeedSnap{}}
+	for _, snap := range snaps {
+		log.Printf("copy %s to %s", snap.File, seedDir)
+		if err := FileCopy(filepath.Join(snapsDir, snap.File), filepath.Join(seedDir, "snaps", snap.File)); err != nil {
+			return err
+		}
+		s := *snap
+		s.Unasserted = len(assertions) == 0
+		seed.Snaps = append(seed.Snaps, &s)
+	}
+
+	dat, err := yaml.Marshal(&seed)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(seedDir, SEED_YAML), dat, 0644)
+}
@@ -0,0 +1,104 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v2"
+)
+
+type SeedSuite struct {
+	dir string
+}
+
+var _ = Suite(&SeedSuite{})
+
+func (s *SeedSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	for _, file := range []string{"pi2-kernel_22.snap", "ubuntu-core_1689.snap", "pi3_30.snap", "htop_12.snap"} {
+		s.writeSnap(c, file)
+	}
+}
+
+// writeSnap() writes a fake snap with the squashfs magic
+func (s *SeedSuite) writeSnap(c *C, file string) {
+	dat := make([]byte, 4096)
+	copy(dat, "hsqs")
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, file), dat, 0644), IsNil)
+}
+
+func (s *SeedSuite) TestFindSeedSnaps(c *C) {
+	snaps, err := rplib.FindSeedSnaps(s.dir, []string{"pi2-kernel", "ubuntu-core_1689.snap", "pi3", "htop"})
+	c.Assert(err, IsNil)
+	c.Assert(snaps, DeepEquals, []*rplib.SeedSnap{
+		{Name: "pi2-kernel", Channel: "stable", File: "pi2-kernel_22.snap"},
+		{Name: "ubuntu-core", Channel: "stable", File: "ubuntu-core_1689.snap"},
+		{Name: "pi3", Channel: "stable", File: "pi3_30.snap"},
+		{Name: "htop", Channel: "stable", File: "htop_12.snap"},
+	})
+}
+
+func (s *SeedSuite) TestFindSeedSnapsFail(c *C) {
+	_, err := rplib.FindSeedSnaps(s.dir, []string{"pi2-kernel", "core"})
+	c.Assert(err, ErrorMatches, `Snap "core" not found in .*, the snaps found: htop, pi2-kernel, pi3, ubuntu-core`)
+
+	_, err = rplib.FindSeedSnaps(s.dir, []string{"ubuntu-core_1690.snap"})
+	c.Assert(err, ErrorMatches, `Snap file ubuntu-core_1690.snap not found in .*`)
+
+	_, err = rplib.FindSeedSnaps(s.dir, []string{"pi3", "pi3_30.snap"})
+	c.Assert(err, ErrorMatches, `Snap "pi3" listed more than once`)
+
+	s.writeSnap(c, "pi3_31.snap")
+	_, err = rplib.FindSeedSnaps(s.dir, []string{"pi3"})
+	c.Assert(err, ErrorMatches, `Snap "pi3" found in more than one revision: pi3_30.snap, pi3_31.snap`)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "bad_1.snap"), make([]byte, 4096), 0644), IsNil)
+	_, err = rplib.FindSeedSnaps(s.dir, []string{"bad"})
+	c.Assert(err, ErrorMatches, `Snap file bad_1.snap is not a squashfs`)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(s.dir, "noname.snap"), make([]byte, 4096), 0644), IsNil)
+	_, err = rplib.FindSeedSnaps(s.dir, []string{"noname.snap"})
+	c.Assert(err, ErrorMatches, `Snap file noname.snap is not <name>_<revision>.snap`)
+}
+
+func (s *SeedSuite) readSeed(c *C, seedDir string) rplib.Seed {
+	dat, err := ioutil.ReadFile(filepath.Join(seedDir, rplib.SEED_YAML))
+	c.Assert(err, IsNil)
+	var seed rplib.Seed
+	c.Assert(yaml.Unmarshal(dat, &seed), IsNil)
+	return seed
+}
+
+func (s *SeedSuite) TestWriteSeed(c *C) {
+	snaps, err := rplib.FindSeedSnaps(s.dir, []string{"pi2-kernel", "ubuntu-core", "pi3"})
+	c.Assert(err, IsNil)
+	assertions := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(assertions, "model.assert"), []byte("type: model\n"), 0644), IsNil)
+
+	seedDir := filepath.Join(c.MkDir(), rplib.SEED_DIR)
+	c.Assert(rplib.WriteSeed(seedDir, snaps, s.dir, assertions), IsNil)
+
+	for _, snap := range snaps {
+		_, err = os.Stat(filepath.Join(seedDir, "snaps", snap.File))
+		c.Assert(err, IsNil)
+	}
+	_, err = os.Stat(filepath.Join(seedDir, "assertions", "model.assert"))
+	c.Assert(err, IsNil)
+	c.Assert(s.readSeed(c, seedDir), DeepEquals, rplib.Seed{Snaps: snaps})
+}
+
+func (s *SeedSuite) TestWriteSeedUnasserted(c *C) {
+	snaps, err := rplib.FindSeedSnaps(s.dir, []string{"htop"})
+	c.Assert(err, IsNil)
+	seedDir := c.MkDir()
+	c.Assert(rplib.WriteSeed(seedDir, snaps, s.dir, filepath.Join(s.dir, "assertions")), IsNil)
+
+	seed := s.readSeed(c, seedDir)
+	c.Assert(seed.Snaps, DeepEquals, []*rplib.SeedSnap{{Name: "htop", Channel: "stable", File: "htop_12.snap", Unasserted: true}})
+	// the found snaps are not changed
+	c.Assert(snaps[0].Unasserted, Equals, false)
+}
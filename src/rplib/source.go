@@ -0,0 +1,161 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SOURCE_MARKER_FILE is on the installer media or in its payload, to find the
+// media without the label or volume id
+const SOURCE_MARKER_FILE = "recovery/config.yaml"
+
+// SOURCE_FOUND_BY, how the installer media was found
+const (
+	SOURCE_FOUND_BY_LABEL     = "label"
+	SOURCE_FOUND_BY_VOLUME_ID = "volume-id"
+	SOURCE_FOUND_BY_MARKER    = "marker"
+)
+
+// the file of the ubuntu classic installer ISO
+const UBUNTU_DISK_INFO = ".disk/info"
+
+// the file with the mounts of the process, changed in tests
+var ProcSelfMounts = "/proc/self/mounts"
+
+// SourceMedia is the installer media. For the cdrom or the iso hybrid disk,
+// the whole disk is the media and Nr is 0.
+type SourceMedia struct {
+	PartInfo
+	FoundBy string
+}
+
+// MountedAt() returns the first mount point of the device, or "" if not mounted
+func MountedAt(device string) string {
+	if real, err := filepath.EvalSymlinks(device); err == nil {
+		device = real
+	}
+	f, err := os.Open(ProcSelfMounts)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		source := fields[0]
+		if real, err := filepath.EvalSymlinks(source); err == nil {
+			source = real
+		}
+		if source == device {
+			// the spaces in mount points are escaped as \040
+			return strings.Replace(fields[1], "\\040", " ", -1)
+		}
+	}
+	return ""
+}
+
+// pickSource() picks the only media of the candidates. The iso hybrid disk
+// has the same filesystem on the disk and on its first partition, the disk is
+// picked. It fails if found on more than one disk.
+func pickSource(candidates []PartInfo, foundBy string) (*SourceMedia, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	picked := candidates[0]
+	for _, dev := range candidates[1:] {
+		if dev.DiskNode != picked.DiskNode {
+			return nil, fmt.Errorf("Installer media found on more than one disk: %s, %s", picked.Path, dev.Path)
+		}
+		if dev.Nr < picked.Nr {
+			picked = dev
+		}
+	}
+	log.Printf("Installer media found by %s: %s (%s, label: %q)", foundBy, picked.Path, picked.Type, picked.Label)
+	return &SourceMedia{picked, foundBy}, nil
+}
+
+// hasMarker() mounts the device read-only to check the marker file or payload
+func hasMarker(dev PartInfo, mounts *MountManager) bool {
+	mnt := MountedAt(dev.Path)
+	if mnt == "" {
+		var err error
+		if mnt, err = mounts.MountTemp(dev.Path, dev.Type, syscall.MS_RDONLY, ""); err != nil {
+			log.Println(err)
+			return false
+		}
+		defer mounts.Unmount(mnt)
+	}
+	_, err := os.Stat(filepath.Join(mnt, SOURCE_MARKER_FILE))
+	return err == nil || FindPayload(mnt) != ""
+}
+
+// FindSourceMedia() finds the installer media by the filesystem label, then by
+// the ISO9660 volume id, then by the marker file. It returns nil if not found.
+func FindSourceMedia(label string, mounts *MountManager) (*SourceMedia, error) {
+	devs, err := ScanBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	byLabel, byVolumeId, others := []PartInfo{}, []PartInfo{}, []PartInfo{}
+	for _, dev := range devs {
+		switch {
+		case dev.Type == "" || dev.Type == FS_TYPE_SWAP:
+		case label != "" && dev.Label == label && dev.Type == FS_TYPE_ISO9660:
+			byVolumeId = append(byVolumeId, dev)
+		case label != "" && dev.Label == label:
+			byLabel = append(byLabel, dev)
+		default:
+			others = append(others, dev)
+		}
+	}
+
+	if len(byLabel) > 0 {
+		return pickSource(byLabel, SOURCE_FOUND_BY_LABEL)
+	}
+	if len(byVolumeId) > 0 {
+		return pickSource(byVolumeId, SOURCE_FOUND_BY_VOLUME_ID)
+	}
+
+	byMarker := []PartInfo{}
+	for _, dev := range others {
+		if hasMarker(dev, mounts) {
+			byMarker = append(byMarker, dev)
+		}
+	}
+	return pickSource(byMarker, SOURCE_FOUND_BY_MARKER)
+}
+
+// SourceOsType() returns the RECOVERY_OS_* type of the installer media mounted
+// on root: the ubuntu classic installer ISO for curtin, or the recovery with
+// config.yaml which has the core snaps for ubuntu core.
+func SourceOsType(root string) (string, error) {
+	if _, err := os.Stat(filepath.Join(root, UBUNTU_DISK_INFO)); err == nil {
+		return RECOVERY_OS_UBUNTU_CLASSIC_CURTIN, nil
+	}
+
+	dat, err := ioutil.ReadFile(filepath.Join(root, SOURCE_MARKER_FILE))
+	if err != nil {
+		return "", fmt.Errorf("Unknown installer media in %s: %v", root, err)
+	}
+	var config ConfigRecovery
+	if err = yaml.Unmarshal(dat, &config); err != nil {
+		return "", fmt.Errorf("Parse %s failed: %v", SOURCE_MARKER_FILE, err)
+	}
+	if config.Snaps.Os != "" {
+		return RECOVERY_OS_UBUNTU_CORE, nil
+	}
+	return RECOVERY_OS_UBUNTU_CLASSIC, nil
+}
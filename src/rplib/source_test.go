@@ -0,0 +1,115 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+// isoImage() returns the image with the ISO9660 primary volume descriptor
+func isoImage(volumeId string) []byte {
+	img := make([]byte, rplib.ISO9660_PVD_OFFSET+rplib.ISO9660_PVD_SIZE)
+	pvd := img[rplib.ISO9660_PVD_OFFSET:]
+	pvd[0] = 1
+	copy(pvd[1:], "CD001")
+	copy(pvd[40:72], volumeId+"                                "[len(volumeId):])
+	copy(pvd[813:], "2017032910203000")
+	return img
+}
+
+func (s *BlockdevSuite) TestProbeIso9660(c *C) {
+	dev := filepath.Join(c.MkDir(), "sr0")
+	c.Assert(ioutil.WriteFile(dev, isoImage("Ubuntu-Server 16.04.2 LTS amd64"), 0644), IsNil)
+
+	info, err := rplib.ProbeFilesystem(dev)
+	c.Assert(err, IsNil)
+	c.Assert(*info, DeepEquals, rplib.FsInfo{Type: "iso9660", Label: "Ubuntu-Server 16.04.2 LTS amd64", UUID: "2017-03-29-10-20-30-00"})
+}
+
+func (s *BlockdevSuite) TestFindSourceMediaByLabel(c *C) {
+	s.addBlock(c, "sda", "sda", 0, "", 0)
+	s.addBlock(c, "sda", "sda1", 1, "SYSBOOT", 0x11112222)
+	s.addBlock(c, "sdb", "sdb", 0, "", 0)
+	s.addBlock(c, "sdb", "sdb1", 1, "INSTALLER", 0x33334444)
+
+	media, err := rplib.FindSourceMedia("INSTALLER", nil)
+	c.Assert(err, IsNil)
+	c.Assert(media.FoundBy, Equals, rplib.SOURCE_FOUND_BY_LABEL)
+	c.Assert(media.Path, Equals, filepath.Join(rplib.DevDir, "sdb1"))
+	c.Assert(media.DiskNode, Equals, "sdb")
+	c.Assert(media.Nr, Equals, 1)
+
+	// on two disks
+	s.addBlock(c, "sdc", "sdc", 0, "", 0)
+	s.addBlock(c, "sdc", "sdc1", 1, "INSTALLER", 0x55556666)
+	_, err = rplib.FindSourceMedia("INSTALLER", nil)
+	c.Assert(err, ErrorMatches, "Installer media found on more than one disk: .*")
+}
+
+func (s *BlockdevSuite) TestFindSourceMediaByVolumeId(c *C) {
+	// iso hybrid disk, the first partition starts at 0
+	s.addBlock(c, "sdb", "sdb", 0, "", 0)
+	s.addBlock(c, "sdb", "sdb1", 1, "", 0)
+	s.addBlock(c, "sr0", "sr0", 0, "", 0)
+	for _, node := range []string{"sdb", "sdb1"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(rplib.DevDir, node), isoImage("INSTALLER"), 0644), IsNil)
+	}
+
+	media, err := rplib.FindSourceMedia("INSTALLER", nil)
+	c.Assert(err, IsNil)
+	c.Assert(media.FoundBy, Equals, rplib.SOURCE_FOUND_BY_VOLUME_ID)
+	c.Assert(media.Path, Equals, filepath.Join(rplib.DevDir, "sdb"))
+	c.Assert(media.Type, Equals, "iso9660")
+	c.Assert(media.Nr, Equals, 0)
+}
+
+func (s *BlockdevSuite) TestFindSourceMediaNotFound(c *C) {
+	s.addBlock(c, "sda", "sda", 0, "", 0)
+	s.addBlock(c, "sda", "sda1", 1, "", 0)
+
+	media, err := rplib.FindSourceMedia("INSTALLER", nil)
+	c.Assert(err, IsNil)
+	c.Assert(media, IsNil)
+}
+
+func (s *BlockdevSuite) TestMountedAt(c *C) {
+	s.addBlock(c, "sr0", "sr0", 0, "", 0)
+	mounts := filepath.Join(s.root, "mounts")
+	c.Assert(ioutil.WriteFile(mounts, []byte(
+		"sysfs /sys sysfs rw,nosuid,nodev,noexec,relatime 0 0\n"+
+			filepath.Join(rplib.DevDir, "sr0")+" /media/Ubuntu\\040Server iso9660 ro,relatime 0 0\n"), 0644), IsNil)
+	old := rplib.ProcSelfMounts
+	rplib.ProcSelfMounts = mounts
+	defer func() { rplib.ProcSelfMounts = old }()
+
+	c.Assert(rplib.MountedAt(filepath.Join(rplib.DevDir, "sr0")), Equals, "/media/Ubuntu Server")
+	c.Assert(rplib.MountedAt(filepath.Join(rplib.DevDir, "sr1")), Equals, "")
+}
+
+func (s *BlockdevSuite) TestSourceOsType(c *C) {
+	root := c.MkDir()
+	_, err := rplib.SourceOsType(root)
+	c.Assert(err, NotNil)
+
+	c.Assert(os.MkdirAll(filepath.Join(root, "recovery"), 0755), IsNil)
+	config := filepath.Join(root, rplib.SOURCE_MARKER_FILE)
+	c.Assert(ioutil.WriteFile(config, []byte("project: pc\nsnaps:\n  os: ubuntu-core\n"), 0644), IsNil)
+	osType, err := rplib.SourceOsType(root)
+	c.Assert(err, IsNil)
+	c.Assert(osType, Equals, rplib.RECOVERY_OS_UBUNTU_CORE)
+
+	c.Assert(ioutil.WriteFile(config, []byte("project: pc\nconfigs:\n  kernelpackage: linux-generic\n"), 0644), IsNil)
+	osType, err = rplib.SourceOsType(root)
+	c.Assert(err, IsNil)
+	c.Assert(osType, Equals, rplib.RECOVERY_OS_UBUNTU_CLASSIC)
+
+	c.Assert(os.MkdirAll(filepath.Join(root, ".disk"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(root, rplib.UBUNTU_DISK_INFO), []byte("Ubuntu-Server 16.04.2 LTS"), 0644), IsNil)
+	osType, err = rplib.SourceOsType(root)
+	c.Assert(err, IsNil)
+	c.Assert(osType, Equals, rplib.RECOVERY_OS_UBUNTU_CLASSIC_CURTIN)
+}
@@ -0,0 +1,256 @@
+package rplib
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/linuxtpm"
+)
+
+// the kernel TPM2 resource manager, changed in tests
+var TpmDevice = "/dev/tpmrm0"
+
+// the PCRs sealed to if not set in config.yaml: the secure boot policy
+var TPM_DEFAULT_PCRS = []int{7}
+
+// the size of the secret sealed in the TPM
+const TPM_SECRET_SIZE = 32
+
+// SealedKey is the secret sealed in the TPM against the sha256 PCRs,
+// it can be unsealed only by the same TPM with the same PCR values.
+type SealedKey struct {
+	Private      []byte // TPM2B_PRIVATE
+	Public       []byte // TPM2B_PUBLIC
+	Pcrs         []int
+	PolicyDigest []byte
+}
+
+// OpenTpm() opens the TPM through the kernel resource manager
+func OpenTpm() (transport.TPMCloser, error) {
+	return linuxtpm.Open(TpmDevice)
+}
+
+func pcrSelection(pcrs []int) tpm2.TPMLPCRSelection {
+	sel := []uint{}
+	for _, pcr := range pcrs {
+		sel = append(sel, uint(pcr))
+	}
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{Hash: tpm2.TPMAlgSHA256, PCRSelect: tpm2.PCClientCompatible.PCRs(sel...)},
+		},
+	}
+}
+
+// the storage root key template of systemd-cryptsetup for the tokens
+// without tpm2_srk and with tpm2-primary-alg ecc (tpm2_get_legacy_template()
+// in systemd): the TCG SRK template without NoDA and with an empty unique.
+var tpmSrkTemplate = tpm2.TPMTPublic{
+	Type:    tpm2.TPMAlgECC,
+	NameAlg: tpm2.TPMAlgSHA256,
+	ObjectAttributes: tpm2.TPMAObject{
+		FixedTPM:            true,
+		FixedParent:         true,
+		SensitiveDataOrigin: true,
+		UserWithAuth:        true,
+		Restricted:          true,
+		Decrypt:             true,
+	},
+	Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+		Symmetric: tpm2.TPMTSymDefObject{
+			Algorithm: tpm2.TPMAlgAES,
+			KeyBits:   tpm2.NewTPMUSymKeyBits(tpm2.TPMAlgAES, tpm2.TPMKeyBits(128)),
+			Mode:      tpm2.NewTPMUSymMode(tpm2.TPMAlgAES, tpm2.TPMAlgCFB),
+		},
+		Scheme:  tpm2.TPMTECCScheme{Scheme: tpm2.TPMAlgNull},
+		CurveID: tpm2.TPMECCNistP256,
+		KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+	}),
+	Unique: tpm2.NewTPMUPublicID(tpm2.TPMAlgECC, &tpm2.TPMSECCPoint{}),
+}
+
+// createSrk() creates the storage root key from the systemd template, the
+// same key is derived from the owner seed every time, also by systemd at boot.
+func createSrk(tpm transport.TPM) (*tpm2.CreatePrimaryResponse, error) {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic:      tpm2.New2B(tpmSrkTemplate),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("Create SRK failed: %v", err)
+	}
+	return rsp, nil
+}
+
+func flush(tpm transport.TPM, handle tpm2.TPMHandle) {
+	tpm2.FlushContext{FlushHandle: handle}.Execute(tpm)
+}
+
+// policyPcr() runs PolicyPCR of the current PCR values in the session
+func policyPcr(tpm transport.TPM, sess tpm2.Session, pcrs []int) error {
+	_, err := tpm2.PolicyPCR{
+		PolicySession: sess.Handle(),
+		Pcrs:          pcrSelection(pcrs),
+	}.Execute(tpm)
+	return err
+}
+
+// SealKey() seals the secret in the TPM against the current values of the
+// sha256 PCRs. The sealed object has no auth value, only the PCR policy.
+func SealKey(tpm transport.TPM, secret []byte, pcrs []int) (*SealedKey, error) {
+	log.Printf("seal key to TPM PCRs %v", pcrs)
+	srk, err := createSrk(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	// the policy digest of the current PCR values
+	sess, closeSess, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16, tpm2.Trial())
+	if err != nil {
+		return nil, err
+	}
+	defer closeSess()
+	if err = policyPcr(tpm, sess, pcrs); err != nil {
+		return nil, fmt.Errorf("PolicyPCR failed: %v", err)
+	}
+	digest, err := tpm2.PolicyGetDigest{PolicySession: sess.Handle()}.Execute(tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := tpm2.Create{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{Buffer: secret}),
+			},
+		},
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgKeyedHash,
+			NameAlg: tpm2.TPMAlgSHA256,
+			ObjectAttributes: tpm2.TPMAObject{
+				FixedTPM:    true,
+				FixedParent: true,
+			},
+			AuthPolicy: digest.PolicyDigest,
+		}),
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("Seal key failed: %v", err)
+	}
+
+	return &SealedKey{
+		Private:      tpm2.Marshal(rsp.OutPrivate),
+		Public:       tpm2.Marshal(rsp.OutPublic),
+		Pcrs:         pcrs,
+		PolicyDigest: digest.PolicyDigest.Buffer,
+	}, nil
+}
+
+// UnsealKey() loads the sealed key in the TPM and unseals the secret, it
+// fails if the PCR values changed since sealed.
+func UnsealKey(tpm transport.TPM, sealed *SealedKey) ([]byte, error) {
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](sealed.Private)
+	if err != nil {
+		return nil, err
+	}
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](sealed.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	srk, err := createSrk(tpm)
+	if err != nil {
+		return nil, err
+	}
+	defer flush(tpm, srk.ObjectHandle)
+
+	obj, err := tpm2.Load{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InPrivate:    *private,
+		InPublic:     *public,
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("Load sealed key failed: %v", err)
+	}
+	defer flush(tpm, obj.ObjectHandle)
+
+	sess, closeSess, err := tpm2.PolicySession(tpm, tpm2.TPMAlgSHA256, 16)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSess()
+	if err = policyPcr(tpm, sess, sealed.Pcrs); err != nil {
+		return nil, fmt.Errorf("PolicyPCR failed: %v", err)
+	}
+
+	rsp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{Handle: obj.ObjectHandle, Name: obj.Name, Auth: sess},
+	}.Execute(tpm)
+	if err != nil {
+		return nil, fmt.Errorf("Unseal key failed: %v", err)
+	}
+	return rsp.OutData.Buffer, nil
+}
+
+// TpmPassphrase() returns the LUKS passphrase of the sealed secret. It is
+// base64 encoded, the same as systemd-cryptenroll.
+func TpmPassphrase(secret []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(secret))
+}
+
+// LuksTpm2Token() returns the systemd-tpm2 LUKS2 token of the sealed key
+// for the keyslot, systemd-cryptsetup unlocks the device with it when
+// tpm2-device=auto is in crypttab.
+func LuksTpm2Token(sealed *SealedKey, keyslot int) ([]byte, error) {
+	pcrs := sealed.Pcrs
+	if pcrs == nil {
+		pcrs = []int{}
+	}
+	token := struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Blob       string   `json:"tpm2-blob"`
+		Pcrs       []int    `json:"tpm2-pcrs"`
+		PcrBank    string   `json:"tpm2-pcr-bank"`
+		PrimaryAlg string   `json:"tpm2-primary-alg"`
+		PolicyHash string   `json:"tpm2-policy-hash"`
+		Pin        bool     `json:"tpm2-pin"`
+	}{
+		Type:       "systemd-tpm2",
+		Keyslots:   []string{fmt.Sprintf("%d", keyslot)},
+		Blob:       base64.StdEncoding.EncodeToString(append(append([]byte{}, sealed.Private...), sealed.Public...)),
+		Pcrs:       pcrs,
+		PcrBank:    "sha256",
+		PrimaryAlg: "ecc",
+		PolicyHash: hex.EncodeToString(sealed.PolicyDigest),
+	}
+	return json.Marshal(token)
+}
+
+// EnrollTpm() seals the secret of the LUKS keyslot in the TPM against the
+// PCRs, and imports the token of the sealed key into the LUKS2 header.
+func EnrollTpm(device string, secret []byte, keyslot int, pcrs []int) error {
+	tpm, err := OpenTpm()
+	if err != nil {
+		return fmt.Errorf("Open TPM %s failed: %v", TpmDevice, err)
+	}
+	defer tpm.Close()
+
+	sealed, err := SealKey(tpm, secret, pcrs)
+	if err != nil {
+		return err
+	}
+	token, err := LuksTpm2Token(sealed, keyslot)
+	if err != nil {
+		return err
+	}
+	_, err = cryptsetup(token, "token", "import", "--json-file", "-", device)
+	return err
+}
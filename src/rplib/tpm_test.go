@@ -0,0 +1,194 @@
+package rplib_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+// the debug PCR, resettable and extendable without affecting the platform
+const debugPcr = 16
+
+type TpmSuite struct {
+	tpm transport.TPMCloser
+}
+
+var _ = Suite(&TpmSuite{})
+
+// SetUpTest() starts the in-process TPM simulator, a new TPM for each test
+func (s *TpmSuite) SetUpTest(c *C) {
+	var err error
+	s.tpm, err = simulator.OpenSimulator()
+	c.Assert(err, IsNil)
+}
+
+func (s *TpmSuite) TearDownTest(c *C) {
+	s.tpm.Close()
+}
+
+func (s *TpmSuite) extendPcr(c *C, pcr int) {
+	_, err := tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{Handle: tpm2.TPMHandle(pcr), Auth: tpm2.PasswordAuth(nil)},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{{HashAlg: tpm2.TPMAlgSHA256, Digest: make([]byte, 32)}},
+		},
+	}.Execute(s.tpm)
+	c.Assert(err, IsNil)
+}
+
+func (s *TpmSuite) TestSealUnseal(c *C) {
+	secret, err := rplib.GenerateKey(rplib.TPM_SECRET_SIZE)
+	c.Assert(err, IsNil)
+
+	sealed, err := rplib.SealKey(s.tpm, secret, []int{debugPcr})
+	c.Assert(err, IsNil)
+	c.Assert(sealed.PolicyDigest, HasLen, 32)
+
+	unsealed, err := rplib.UnsealKey(s.tpm, sealed)
+	c.Assert(err, IsNil)
+	c.Assert(unsealed, DeepEquals, secret)
+
+	// the key is not released after the PCR changed
+	s.extendPcr(c, debugPcr)
+	_, err = rplib.UnsealKey(s.tpm, sealed)
+	c.Assert(err, NotNil)
+}
+
+// systemdSrk() creates the SRK the same as systemd-cryptsetup for a token
+// without tpm2_srk and with tpm2-primary-alg ecc, from tpm2_get_legacy_template()
+// of systemd.
+func (s *TpmSuite) systemdSrk(c *C) *tpm2.CreatePrimaryResponse {
+	rsp, err := tpm2.CreatePrimary{
+		PrimaryHandle: tpm2.TPMRHOwner,
+		InPublic: tpm2.New2B(tpm2.TPMTPublic{
+			Type:    tpm2.TPMAlgECC,
+			NameAlg: tpm2.TPMAlgSHA256,
+			// TPMA_OBJECT_RESTRICTED|DECRYPT|FIXEDTPM|FIXEDPARENT|SENSITIVEDATAORIGIN|USERWITHAUTH
+			ObjectAttributes: tpm2.TPMAObject{Restricted: true, Decrypt: true, FixedTPM: true, FixedParent: true, SensitiveDataOrigin: true, UserWithAuth: true},
+			Parameters: tpm2.NewTPMUPublicParms(tpm2.TPMAlgECC, &tpm2.TPMSECCParms{
+				Symmetric: tpm2.TPMTSymDefObject{
+					Algorithm: tpm2.TPMAlgAES,
+					KeyBits:   tpm2.NewTPMUSymKeyBits(tpm2.TPMAlgAES, tpm2.TPMKeyBits(128)),
+					Mode:      tpm2.NewTPMUSymMode(tpm2.TPMAlgAES, tpm2.TPMAlgCFB),
+				},
+				Scheme:  tpm2.TPMTECCScheme{Scheme: tpm2.TPMAlgNull},
+				CurveID: tpm2.TPMECCNistP256,
+				KDF:     tpm2.TPMTKDFScheme{Scheme: tpm2.TPMAlgNull},
+			}),
+		}),
+	}.Execute(s.tpm)
+	c.Assert(err, IsNil)
+	return rsp
+}
+
+// The token has the fields systemd-cryptsetup requires, and its blob is
+// unsealed under the SRK systemd creates at boot.
+func (s *TpmSuite) TestLuksTpm2TokenSystemd(c *C) {
+	secret, err := rplib.GenerateKey(rplib.TPM_SECRET_SIZE)
+	c.Assert(err, IsNil)
+	sealed, err := rplib.SealKey(s.tpm, secret, []int{7, debugPcr})
+	c.Assert(err, IsNil)
+	dat, err := rplib.LuksTpm2Token(sealed, 0)
+	c.Assert(err, IsNil)
+
+	var token struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Blob       *string  `json:"tpm2-blob"`
+		Pcrs       []int    `json:"tpm2-pcrs"`
+		PcrBank    string   `json:"tpm2-pcr-bank"`
+		PrimaryAlg string   `json:"tpm2-primary-alg"`
+		PolicyHash *string  `json:"tpm2-policy-hash"`
+		Pin        bool     `json:"tpm2-pin"`
+		Srk        *string  `json:"tpm2_srk"`
+	}
+	c.Assert(json.Unmarshal(dat, &token), IsNil)
+	c.Assert(token.Type, Equals, "systemd-tpm2")
+	c.Assert(token.Keyslots, DeepEquals, []string{"0"})
+	c.Assert(token.Pcrs, DeepEquals, []int{7, debugPcr})
+	c.Assert(token.PcrBank, Equals, "sha256")
+	c.Assert(token.PrimaryAlg, Equals, "ecc")
+	c.Assert(token.Pin, Equals, false)
+	// the legacy SRK template is used without tpm2_srk
+	c.Assert(token.Srk, IsNil)
+	c.Assert(token.PolicyHash, NotNil)
+	policy, err := hex.DecodeString(*token.PolicyHash)
+	c.Assert(err, IsNil)
+	c.Assert(policy, HasLen, 32)
+
+	// the blob is TPM2B_PRIVATE followed by TPM2B_PUBLIC
+	c.Assert(token.Blob, NotNil)
+	blob, err := base64.StdEncoding.DecodeString(*token.Blob)
+	c.Assert(err, IsNil)
+	n := 2 + int(binary.BigEndian.Uint16(blob))
+	private, err := tpm2.Unmarshal[tpm2.TPM2BPrivate](blob[:n])
+	c.Assert(err, IsNil)
+	public, err := tpm2.Unmarshal[tpm2.TPM2BPublic](blob[n:])
+	c.Assert(err, IsNil)
+	pub, err := public.Contents()
+	c.Assert(err, IsNil)
+	c.Assert(pub.AuthPolicy.Buffer, DeepEquals, policy)
+
+	srk := s.systemdSrk(c)
+	defer tpm2.FlushContext{FlushHandle: srk.ObjectHandle}.Execute(s.tpm)
+	obj, err := tpm2.Load{
+		ParentHandle: tpm2.NamedHandle{Handle: srk.ObjectHandle, Name: srk.Name},
+		InPrivate:    *private,
+		InPublic:     *public,
+	}.Execute(s.tpm)
+	c.Assert(err, IsNil)
+	defer tpm2.FlushContext{FlushHandle: obj.ObjectHandle}.Execute(s.tpm)
+
+	sess, closeSess, err := tpm2.PolicySession(s.tpm, tpm2.TPMAlgSHA256, 16)
+	c.Assert(err, IsNil)
+	defer closeSess()
+	_, err = tpm2.PolicyPCR{
+		PolicySession: sess.Handle(),
+		Pcrs: tpm2.TPMLPCRSelection{PCRSelections: []tpm2.TPMSPCRSelection{
+			{Hash: tpm2.TPMAlgSHA256, PCRSelect: tpm2.PCClientCompatible.PCRs(7, debugPcr)},
+		}},
+	}.Execute(s.tpm)
+	c.Assert(err, IsNil)
+	rsp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{Handle: obj.ObjectHandle, Name: obj.Name, Auth: sess},
+	}.Execute(s.tpm)
+	c.Assert(err, IsNil)
+	c.Assert(rsp.OutData.Buffer, DeepEquals, secret)
+}
+
+func (s *TpmSuite) TestLuksTpm2Token(c *C) {
+	sealed := &rplib.SealedKey{
+		Private:      []byte{0, 2, 0xaa, 0xbb},
+		Public:       []byte{0, 1, 0xcc},
+		Pcrs:         []int{0, 7},
+		PolicyDigest: []byte{0x12, 0x34},
+	}
+	token, err := rplib.LuksTpm2Token(sealed, 1)
+	c.Assert(err, IsNil)
+
+	var got map[string]interface{}
+	c.Assert(json.Unmarshal(token, &got), IsNil)
+	c.Assert(got, DeepEquals, map[string]interface{}{
+		"type":             "systemd-tpm2",
+		"keyslots":         []interface{}{"1"},
+		"tpm2-blob":        "AAKquwABzA==",
+		"tpm2-pcrs":        []interface{}{0.0, 7.0},
+		"tpm2-pcr-bank":    "sha256",
+		"tpm2-primary-alg": "ecc",
+		"tpm2-policy-hash": "1234",
+		"tpm2-pin":         false,
+	})
+}
+
+func (s *TpmSuite) TestTpmPassphrase(c *C) {
+	c.Assert(string(rplib.TpmPassphrase([]byte{0, 1, 2, 3})), Equals, "AAECAw==")
+}
@@ -0,0 +1,269 @@
+package rplib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The u-boot environment: a CRC32 header (little endian, of the data),
+// a flags byte only if the environment is redundant, then "name=value\0"
+// strings ended with an empty string and padded with '\0' to the size.
+// With redundant environment, there are two copies, the active one is the
+// valid one with the newer flags, and saving goes to the other one.
+const (
+	UBOOTENV_FILE          = "uboot.env"
+	UBOOTENV_REDUND_FILE   = "uboot-redund.env"
+	UBOOTENV_DEFAULT_SIZE  = 0x20000
+	UBOOTENV_RECOVERY_TYPE = "recovery_type"
+	ubootenvCrcSize        = 4
+	ubootenvFlagsSize      = 1
+)
+
+type UbootEnv struct {
+	envVars
+	File       string
+	RedundFile string // empty if the environment is not redundant
+	Size       int
+	flags      byte
+	active     string
+}
+
+func NewUbootEnv(file string, redundFile string, size int) *UbootEnv {
+	return &UbootEnv{
+		envVars:    envVars{values: map[string]string{}},
+		File:       file,
+		RedundFile: redundFile,
+		Size:       size,
+		active:     redundFile,
+	}
+}
+
+func (env *UbootEnv) headerSize() int {
+	if env.RedundFile != "" {
+		return ubootenvCrcSize + ubootenvFlagsSize
+	}
+	return ubootenvCrcSize
+}
+
+// parse() parses one copy of the environment, returns its flags
+func (env *UbootEnv) parse(block []byte) (byte, error) {
+	if len(block) != env.Size || env.Size <= env.headerSize() {
+		return 0, fmt.Errorf("Invalid uboot env size: %d, must be %d", len(block), env.Size)
+	}
+	data := block[env.headerSize():]
+	crc := binary.LittleEndian.Uint32(block[:ubootenvCrcSize])
+	if crc32.ChecksumIEEE(data) != crc {
+		return 0, errors.New("Invalid uboot env crc")
+	}
+
+	var flags byte
+	if env.RedundFile != "" {
+		flags = block[ubootenvCrcSize]
+	}
+
+	env.reset()
+	for len(data) > 0 && data[0] != 0 {
+		end := bytes.IndexByte(data, 0)
+		if end == -1 {
+			return 0, errors.New("Invalid uboot env, unterminated variable")
+		}
+		line := string(data[:end])
+		data = data[end+1:]
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return 0, fmt.Errorf("Invalid uboot env variable: %q", line)
+		}
+		env.set(line[:eq], line[eq+1:])
+	}
+	return flags, nil
+}
+
+// Bytes() returns one copy of the environment with the flags
+func (env *UbootEnv) Bytes(flags byte) ([]byte, error) {
+	var data bytes.Buffer
+	for _, name := range env.names {
+		fmt.Fprintf(&data, "%s=%s\x00", name, env.values[name])
+	}
+	data.WriteByte(0)
+
+	dataSize := env.Size - env.headerSize()
+	if dataSize <= 0 {
+		return nil, fmt.Errorf("Invalid uboot env size: %d", env.Size)
+	}
+	if data.Len() > dataSize {
+		return nil, fmt.Errorf("uboot env too large: %d bytes, must be less than %d", data.Len(), dataSize)
+	}
+	data.Write(make([]byte, dataSize-data.Len()))
+
+	block := make([]byte, env.headerSize(), env.Size)
+	binary.LittleEndian.PutUint32(block, crc32.ChecksumIEEE(data.Bytes()))
+	if env.RedundFile != "" {
+		block[ubootenvCrcSize] = flags
+	}
+	return append(block, data.Bytes()...), nil
+}
+
+// ubootenvNewer() is the same as u-boot to decide which copy is active,
+// the primary copy wins if the flags are equal
+func ubootenvNewer(flags, other byte) bool {
+	if flags == 0 && other == 0xff {
+		return true
+	}
+	if flags == 0xff && other == 0 {
+		return false
+	}
+	return flags > other
+}
+
+func (env *UbootEnv) Load() error {
+	files := []string{env.File}
+	if env.RedundFile != "" {
+		files = append(files, env.RedundFile)
+	}
+
+	var errs []string
+	loaded := false
+	for _, file := range files {
+		block, err := ioutil.ReadFile(file)
+		if err == nil {
+			c := NewUbootEnv(env.File, env.RedundFile, env.Size)
+			var flags byte
+			if flags, err = c.parse(block); err == nil {
+				if !loaded || ubootenvNewer(flags, env.flags) {
+					env.envVars = c.envVars
+					env.flags = flags
+					env.active = file
+				}
+				loaded = true
+				continue
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", file, err))
+	}
+
+	if !loaded {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	if len(errs) > 0 {
+		log.Printf("uboot env copy ignored: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Save() writes the environment. With redundant environment, it writes to
+// the inactive copy with the flags increased, so that copy becomes active.
+func (env *UbootEnv) Save() error {
+	file := env.File
+	flags := env.flags
+	if env.RedundFile != "" {
+		flags++
+		if env.active == env.File {
+			file = env.RedundFile
+		}
+	}
+
+	block, err := env.Bytes(flags)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(file, block, 0644); err != nil {
+		return err
+	}
+	env.flags = flags
+	env.active = file
+	return nil
+}
+
+func (env *UbootEnv) Set(name, value string) error {
+	if name == "" || strings.ContainsAny(name, "=\x00") || strings.Contains(value, "\x00") {
+		return fmt.Errorf("Invalid uboot env variable: %q", name)
+	}
+	env.set(name, value)
+	return nil
+}
+
+// UbootenvCreate() creates empty environment files
+func UbootenvCreate(file string, redundFile string, size int) error {
+	env := NewUbootEnv(file, redundFile, size)
+	if err := env.Save(); err != nil {
+		return err
+	}
+	if redundFile != "" {
+		return env.Save()
+	}
+	return nil
+}
+
+// UbootenvSize() returns the size of an existing environment file,
+// or UBOOTENV_DEFAULT_SIZE if it doesn't exist.
+func UbootenvSize(file string) int {
+	if info, err := os.Stat(file); err == nil && info.Size() > 0 {
+		return int(info.Size())
+	}
+	return UBOOTENV_DEFAULT_SIZE
+}
+
+// UbootenvGadget() returns the u-boot environment in the content of the
+// structure with the filesystem label in gadget.yaml: the size of the content
+// with the uboot.env target, or of its source file in the gadget, and if
+// there is also the uboot-redund.env target. The size is 0 if not found.
+func UbootenvGadget(gadgetInfo *GadgetInfo, label string, gadgetDir string) (size int, redundant bool, err error) {
+	st, err := gadgetInfo.GetStructurebyLabel(label)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, content := range st.Content {
+		switch filepath.Base(content.Target) {
+		case UBOOTENV_FILE:
+			if content.Size != "" {
+				n, err := ParseGadgetSize(content.Size)
+				if err != nil {
+					return 0, false, fmt.Errorf("uboot env size: %v", err)
+				}
+				size = int(n)
+			} else {
+				info, err := os.Stat(filepath.Join(gadgetDir, content.Source))
+				if err != nil {
+					return 0, false, err
+				}
+				size = int(info.Size())
+			}
+		case UBOOTENV_REDUND_FILE:
+			redundant = true
+		}
+	}
+	return size, redundant, nil
+}
+
+// UbootenvSet() sets the variables in existing environment files
+func UbootenvSet(file string, redundFile string, size int, vars map[string]string) error {
+	env := NewUbootEnv(file, redundFile, size)
+	if err := env.Load(); err != nil {
+		return err
+	}
+	for name, value := range vars {
+		log.Printf("uboot env %s: set %s=%s", env.active, name, value)
+		if err := env.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return env.Save()
+}
+
+// UbootenvSetRecoveryType() sets recovery_type to one of the RECOVERY_TYPE
+func UbootenvSetRecoveryType(file string, redundFile string, size int, recoveryType string) error {
+	switch recoveryType {
+	case HEADLESS_INSTALLER, FACTORY_INSTALL, FACTORY_RESTORE:
+	default:
+		return fmt.Errorf("Invalid recovery type: %q", recoveryType)
+	}
+	return UbootenvSet(file, redundFile, size, map[string]string{UBOOTENV_RECOVERY_TYPE: recoveryType})
+}
@@ -0,0 +1,194 @@
+package rplib_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+const ubootenvTestSize = 4096
+
+type UbootenvSuite struct {
+	envFile    string
+	redundFile string
+}
+
+var _ = Suite(&UbootenvSuite{})
+
+func (s *UbootenvSuite) SetUpTest(c *C) {
+	tmpdir := c.MkDir()
+	s.envFile = filepath.Join(tmpdir, rplib.UBOOTENV_FILE)
+	s.redundFile = filepath.Join(tmpdir, rplib.UBOOTENV_REDUND_FILE)
+}
+
+func (s *UbootenvSuite) assertGolden(c *C, file string, name string) {
+	golden, err := ioutil.ReadFile(filepath.Join("test_data", name))
+	c.Assert(err, IsNil)
+	dat, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(dat, DeepEquals, golden)
+}
+
+func (s *UbootenvSuite) TestCreate(c *C) {
+	err := rplib.UbootenvCreate(s.envFile, "", ubootenvTestSize)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, s.envFile, "uboot.env")
+	c.Assert(rplib.UbootenvSize(s.envFile), Equals, ubootenvTestSize)
+}
+
+func (s *UbootenvSuite) TestSetRecoveryType(c *C) {
+	err := rplib.UbootenvCreate(s.envFile, "", ubootenvTestSize)
+	c.Assert(err, IsNil)
+	err = rplib.UbootenvSetRecoveryType(s.envFile, "", ubootenvTestSize, rplib.FACTORY_INSTALL)
+	c.Assert(err, IsNil)
+	s.assertGolden(c, s.envFile, "uboot.env.factory_install")
+
+	err = rplib.UbootenvSetRecoveryType(s.envFile, "", ubootenvTestSize, "unknown")
+	c.Assert(err, NotNil)
+}
+
+func (s *UbootenvSuite) TestLoad(c *C) {
+	env := rplib.NewUbootEnv("test_data/uboot.env.factory_install", "", ubootenvTestSize)
+	err := env.Load()
+	c.Assert(err, IsNil)
+	c.Assert(env.Get("recovery_type"), Equals, rplib.FACTORY_INSTALL)
+	c.Assert(env.List(), DeepEquals, []string{"recovery_type=factory_install"})
+
+	// size mismatch
+	env = rplib.NewUbootEnv("test_data/uboot.env.factory_install", "", ubootenvTestSize*2)
+	c.Assert(env.Load(), NotNil)
+}
+
+func (s *UbootenvSuite) TestBadCrc(c *C) {
+	dat, err := ioutil.ReadFile("test_data/uboot.env.factory_install")
+	c.Assert(err, IsNil)
+	dat[0] ^= 0xff
+	err = ioutil.WriteFile(s.envFile, dat, 0644)
+	c.Assert(err, IsNil)
+
+	env := rplib.NewUbootEnv(s.envFile, "", ubootenvTestSize)
+	c.Assert(env.Load(), NotNil)
+}
+
+func (s *UbootenvSuite) TestRedundant(c *C) {
+	err := rplib.UbootenvCreate(s.envFile, s.redundFile, ubootenvTestSize)
+	c.Assert(err, IsNil)
+
+	err = rplib.UbootenvSetRecoveryType(s.envFile, s.redundFile, ubootenvTestSize, rplib.FACTORY_INSTALL)
+	c.Assert(err, IsNil)
+	err = rplib.UbootenvSet(s.envFile, s.redundFile, ubootenvTestSize, map[string]string{"bootcmd": "run recovery"})
+	c.Assert(err, IsNil)
+
+	env := rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	err = env.Load()
+	c.Assert(err, IsNil)
+	c.Assert(env.List(), DeepEquals, []string{"bootcmd=run recovery", "recovery_type=factory_install"})
+
+	// the last write goes to the redundant copy, corrupt it and
+	// the previous copy is used
+	dat, err := ioutil.ReadFile(s.redundFile)
+	c.Assert(err, IsNil)
+	dat[len(dat)-1] = 0xff
+	err = ioutil.WriteFile(s.redundFile, dat, 0644)
+	c.Assert(err, IsNil)
+
+	env = rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	err = env.Load()
+	c.Assert(err, IsNil)
+	c.Assert(env.List(), DeepEquals, []string{"recovery_type=factory_install"})
+}
+
+func (s *UbootenvSuite) TestRedundantFlagsWrap(c *C) {
+	env := rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	c.Assert(env.Set("recovery_type", rplib.FACTORY_INSTALL), IsNil)
+	dat, err := env.Bytes(0xff)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.envFile, dat, 0644), IsNil)
+
+	c.Assert(env.Set("recovery_type", rplib.FACTORY_RESTORE), IsNil)
+	dat, err = env.Bytes(0)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.redundFile, dat, 0644), IsNil)
+
+	env = rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	c.Assert(env.Load(), IsNil)
+	c.Assert(env.Get("recovery_type"), Equals, rplib.FACTORY_RESTORE)
+}
+
+func (s *UbootenvSuite) TestRedundantFlagsEqual(c *C) {
+	env := rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	c.Assert(env.Set("recovery_type", rplib.FACTORY_INSTALL), IsNil)
+	dat, err := env.Bytes(3)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.envFile, dat, 0644), IsNil)
+
+	c.Assert(env.Set("recovery_type", rplib.FACTORY_RESTORE), IsNil)
+	dat, err = env.Bytes(3)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(s.redundFile, dat, 0644), IsNil)
+
+	// the primary copy is active, the same as u-boot
+	env = rplib.NewUbootEnv(s.envFile, s.redundFile, ubootenvTestSize)
+	c.Assert(env.Load(), IsNil)
+	c.Assert(env.Get("recovery_type"), Equals, rplib.FACTORY_INSTALL)
+
+	// and saving goes to the redundant copy with the flags increased
+	c.Assert(env.Set("recovery_type", rplib.HEADLESS_INSTALLER), IsNil)
+	c.Assert(env.Save(), IsNil)
+	dat, err = ioutil.ReadFile(s.redundFile)
+	c.Assert(err, IsNil)
+	c.Assert(dat[4], Equals, byte(4))
+}
+
+func (s *UbootenvSuite) TestUbootenvGadget(c *C) {
+	gadgetDir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(gadgetDir, "uboot.env.in"), make([]byte, 8192), 0644), IsNil)
+	gadgetYaml := filepath.Join(gadgetDir, "gadget.yaml")
+	c.Assert(ioutil.WriteFile(gadgetYaml, []byte(`volumes:
+  pi3:
+    bootloader: u-boot
+    structure:
+      - name: recovery
+        type: 0C
+        filesystem: vfat
+        filesystem-label: recovery
+        size: 768M
+        content:
+          - source: uboot.env.in
+            target: uboot.env
+      - name: system-boot
+        type: 0C
+        filesystem: vfat
+        filesystem-label: system-boot
+        size: 128M
+        content:
+          - source: boot-assets/
+            target: /
+          - source: uboot.env.in
+            target: /uboot.env
+            size: 16K
+          - source: uboot.env.in
+            target: /uboot-redund.env
+            size: 16K
+`), 0644), IsNil)
+	var gi rplib.GadgetInfo
+	c.Assert(gi.Load(gadgetYaml), IsNil)
+
+	// the size of the source
+	size, redundant, err := rplib.UbootenvGadget(&gi, "recovery", gadgetDir)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, 8192)
+	c.Assert(redundant, Equals, false)
+
+	// the size in the content
+	size, redundant, err = rplib.UbootenvGadget(&gi, "system-boot", gadgetDir)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, 16*1024)
+	c.Assert(redundant, Equals, true)
+
+	_, _, err = rplib.UbootenvGadget(&gi, "writable", gadgetDir)
+	c.Assert(err, NotNil)
+}
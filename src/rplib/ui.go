@@ -0,0 +1,334 @@
+package rplib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// STAGE_STATE, the state of an install stage
+const (
+	STAGE_PENDING = "pending"
+	STAGE_RUNNING = "running"
+	STAGE_DONE    = "done"
+	STAGE_FAILED  = "failed"
+)
+
+// the ANSI escape sequences of the full-screen UI
+const (
+	_ANSI_CLEAR = "\033[2J\033[H"
+	_ANSI_BOLD  = "\033[1m"
+	_ANSI_RED   = "\033[1;37;41m"
+	_ANSI_GREEN = "\033[1;37;42m"
+	_ANSI_RESET = "\033[0m"
+)
+
+// the width of the progress bars
+const UI_BAR_WIDTH = 40
+
+// the serial console tty names, the UI is plain text on them
+var serialTtyPrefixes = []string{"ttyS", "ttyAMA", "ttyUSB", "ttyACM", "ttymxc", "ttyO", "ttySAC", "ttyMSM", "hvc"}
+
+type uiStage struct {
+	name        string
+	state       string
+	done, total int64
+	percent     int64 // the last percent printed in plain text
+}
+
+// UI is the operator interface on the console. It is a full-screen UI with
+// progress bars and colors on a terminal, or plain text lines on a serial
+// console. All the methods of a nil UI do nothing, for the headless install.
+type UI struct {
+	Title string
+	Fancy bool
+
+	out    io.Writer
+	lines  chan string
+	lock   sync.Mutex
+	stages []*uiStage
+}
+
+// NewUI() returns the UI reading the operator input from in and drawing
+// on out, in full-screen if fancy.
+func NewUI(in io.Reader, out io.Writer, fancy bool) *UI {
+	ui := &UI{out: out, Fancy: fancy, lines: make(chan string)}
+	// the only reader of the input, the answer of a timed out prompt
+	// is not taken by the next one
+	go func() {
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			ui.lines <- scanner.Text()
+		}
+		close(ui.lines)
+	}()
+	return ui
+}
+
+// ConsoleUI() returns the UI on stdin and stdout, or nil if stdin is not
+// a terminal. It is plain text on a serial console or a dumb terminal.
+func ConsoleUI() *UI {
+	if !IsTerminal(os.Stdin) {
+		return nil
+	}
+	fancy := IsTerminal(os.Stdout) && !IsSerialConsole(os.Stdout) && os.Getenv("TERM") != "dumb"
+	return NewUI(os.Stdin, os.Stdout, fancy)
+}
+
+// IsTerminal() returns true if the file is a terminal
+func IsTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+// consoleTty() returns the tty name of the last console= in the kernel
+// command line, which is /dev/console.
+func consoleTty() string {
+	dat, err := ioutil.ReadFile(ProcCmdline)
+	if err != nil {
+		return ""
+	}
+	tty := ""
+	for _, field := range strings.Fields(string(dat)) {
+		if strings.HasPrefix(field, "console=") {
+			tty = strings.SplitN(field[len("console="):], ",", 2)[0]
+		}
+	}
+	return tty
+}
+
+// IsSerialConsole() returns true if the file is a serial tty, or
+// /dev/console on a serial tty.
+func IsSerialConsole(f *os.File) bool {
+	name, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	if err != nil {
+		return false
+	}
+	tty := filepath.Base(name)
+	if tty == "console" {
+		tty = consoleTty()
+	}
+	for _, prefix := range serialTtyPrefixes {
+		if strings.HasPrefix(tty, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetStages() sets the stages shown with progress bars, all pending
+func (ui *UI) SetStages(names ...string) {
+	if ui == nil {
+		return
+	}
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	ui.stages = []*uiStage{}
+	for _, name := range names {
+		ui.stages = append(ui.stages, &uiStage{name: name, state: STAGE_PENDING, percent: -1})
+	}
+	ui.draw()
+}
+
+func (ui *UI) stage(name string) *uiStage {
+	for _, st := range ui.stages {
+		if st.name == name {
+			return st
+		}
+	}
+	st := &uiStage{name: name, state: STAGE_PENDING, percent: -1}
+	ui.stages = append(ui.stages, st)
+	return st
+}
+
+func (ui *UI) update(name, state string, done, total int64) {
+	if ui == nil {
+		return
+	}
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+	st := ui.stage(name)
+	changed := st.state != state
+	st.state, st.done, st.total = state, done, total
+
+	if ui.Fancy {
+		ui.draw()
+		return
+	}
+	// plain text: a line for the state change, and every 10 percent
+	if changed {
+		fmt.Fprintf(ui.out, "%s: %s\n", st.name, st.state)
+	}
+	if state == STAGE_RUNNING && total > 0 {
+		percent := done * 100 / total
+		if st.percent < 0 || percent/10 != st.percent/10 {
+			st.percent = percent
+			fmt.Fprintf(ui.out, "%s: %d%%\n", st.name, percent)
+		}
+	}
+}
+
+// Start() marks the stage running
+func (ui *UI) Start(name string) {
+	ui.update(name, STAGE_RUNNING, 0, 0)
+}
+
+// Progress() updates the progress of the running stage, total is the
+// amount of work, e.g. bytes to copy.
+func (ui *UI) Progress(name string, done, total int64) {
+	ui.update(name, STAGE_RUNNING, done, total)
+}
+
+// DownloadProgress() returns the download progress callback of the stage
+func (ui *UI) DownloadProgress(name string) DownloadProgress {
+	return func(done, total int64) {
+		ui.Progress(name, done, total)
+	}
+}
+
+// Done() marks the stage done, or failed if err is not nil
+func (ui *UI) Done(name string, err error) {
+	if err != nil {
+		ui.update(name, STAGE_FAILED, 0, 0)
+		return
+	}
+	ui.update(name, STAGE_DONE, 1, 1)
+}
+
+// bar() returns the progress bar of the stage
+func bar(st *uiStage) string {
+	filled := 0
+	switch {
+	case st.state == STAGE_DONE:
+		filled = UI_BAR_WIDTH
+	case st.total > 0:
+		filled = int(st.done * UI_BAR_WIDTH / st.total)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", UI_BAR_WIDTH-filled) + "]"
+}
+
+// draw() redraws the full screen: the title and the stages
+func (ui *UI) draw() {
+	if !ui.Fancy {
+		return
+	}
+	fmt.Fprintf(ui.out, "%s%s%s%s\n\n", _ANSI_CLEAR, _ANSI_BOLD, ui.Title, _ANSI_RESET)
+	for _, st := range ui.stages {
+		state := st.state
+		switch st.state {
+		case STAGE_DONE:
+			state = _ANSI_GREEN + " DONE " + _ANSI_RESET
+		case STAGE_FAILED:
+			state = _ANSI_RED + " FAIL " + _ANSI_RESET
+		}
+		fmt.Fprintf(ui.out, "  %-20s %s %s\n", st.name, bar(st), state)
+	}
+	fmt.Fprintln(ui.out)
+}
+
+// Confirm() shows the message and asks the operator to confirm. It returns
+// def if the operator only presses enter, or no answer in the timeout; no
+// timeout if it is 0.
+func (ui *UI) Confirm(message []string, question string, timeout time.Duration, def bool) bool {
+	if ui == nil {
+		return def
+	}
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	ui.draw()
+	for _, line := range message {
+		fmt.Fprintln(ui.out, line)
+	}
+	choices := "[y/N]"
+	if def {
+		choices = "[Y/n]"
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	end := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	prompt := func() {
+		if timeout > 0 {
+			left := (time.Until(end) + time.Second - 1) / time.Second
+			fmt.Fprintf(ui.out, "\r%s %s (%ds) ", question, choices, left)
+		} else {
+			fmt.Fprintf(ui.out, "\r%s %s ", question, choices)
+		}
+	}
+	prompt()
+	for {
+		select {
+		case line, ok := <-ui.lines:
+			if !ok {
+				fmt.Fprintln(ui.out)
+				return def
+			}
+			switch strings.ToLower(strings.TrimSpace(line)) {
+			case "":
+				return def
+			case "y", "yes":
+				return true
+			case "n", "no":
+				return false
+			}
+			prompt()
+		case <-ticker.C:
+			// the countdown is updated in place only on a terminal
+			if ui.Fancy {
+				prompt()
+			}
+		case <-deadline:
+			fmt.Fprintln(ui.out, "\ntimeout")
+			return def
+		}
+	}
+}
+
+// ConfirmDisks() shows the disks to wipe and asks the operator to confirm,
+// it is cancelled if no answer in the timeout.
+func (ui *UI) ConfirmDisks(disks []DiskInfo, timeout time.Duration) bool {
+	message := []string{"All data on the disks will be erased:", ""}
+	for _, disk := range disks {
+		message = append(message, fmt.Sprintf("  /dev/%-10s %-24s serial: %-20s %s", disk.Node, disk.Model, disk.Serial, HumanSize(disk.Size)))
+	}
+	message = append(message, "")
+	return ui.Confirm(message, "Continue?", timeout, false)
+}
+
+// Result() shows the final PASS or FAIL screen with the errors
+func (ui *UI) Result(errs []error) {
+	if ui == nil {
+		return
+	}
+	ui.lock.Lock()
+	defer ui.lock.Unlock()
+
+	ui.draw()
+	result, color := "PASS", _ANSI_GREEN
+	if len(errs) > 0 {
+		result, color = "FAIL", _ANSI_RED
+	}
+	if ui.Fancy {
+		fmt.Fprintf(ui.out, "%s%s%s%s\n", color, strings.Repeat(" ", 8), result, strings.Repeat(" ", 8)+_ANSI_RESET)
+	} else {
+		fmt.Fprintf(ui.out, "RESULT: %s\n", result)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(ui.out, "  %v\n", err)
+	}
+}
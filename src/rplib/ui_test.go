@@ -0,0 +1,95 @@
+package rplib_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+
+	. "gopkg.in/check.v1"
+)
+
+type UISuite struct{}
+
+var _ = Suite(&UISuite{})
+
+func (s *UISuite) TestConfirm(c *C) {
+	for _, t := range []struct {
+		input string
+		def   bool
+		want  bool
+	}{
+		{"y\n", false, true},
+		{"YES\n", false, true},
+		{"n\n", true, false},
+		{"\n", false, false},
+		{"\n", true, true},
+		{"maybe\nyes\n", false, true},
+		{"", true, true}, // EOF
+	} {
+		var out bytes.Buffer
+		ui := rplib.NewUI(strings.NewReader(t.input), &out, false)
+		c.Check(ui.Confirm([]string{"message"}, "Continue?", 0, t.def), Equals, t.want, Commentf("%q", t.input))
+		c.Check(strings.HasPrefix(out.String(), "message\n\rContinue? "), Equals, true, Commentf("%q", out.String()))
+	}
+}
+
+func (s *UISuite) TestConfirmTimeout(c *C) {
+	r, w := io.Pipe()
+	defer w.Close()
+	var out bytes.Buffer
+	ui := rplib.NewUI(r, &out, false)
+
+	start := time.Now()
+	c.Assert(ui.ConfirmDisks([]rplib.DiskInfo{{Node: "sda", Model: "SanDisk SSD", Serial: "AB1234567890", Size: 32017047552}}, 100*time.Millisecond), Equals, false)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	c.Assert(out.String(), Matches, "(?s)All data on the disks will be erased.*/dev/sda +SanDisk SSD +serial: AB1234567890 +32.0 GB.*Continue\\? \\[y/N\\] \\(1s\\) \ntimeout\n")
+}
+
+func (s *UISuite) TestPlainProgress(c *C) {
+	var out bytes.Buffer
+	ui := rplib.NewUI(strings.NewReader(""), &out, false)
+	ui.SetStages("Erase", "Recovery partition")
+	ui.Start("Erase")
+	ui.Done("Erase", nil)
+	for done := int64(0); done <= 100; done += 5 {
+		ui.Progress("Recovery partition", done, 100)
+	}
+	ui.Done("Recovery partition", errors.New("copy failed"))
+	ui.Result([]error{errors.New("Recovery partition: copy failed")})
+
+	want := "Erase: running\nErase: done\nRecovery partition: running\n"
+	for p := 0; p <= 100; p += 10 {
+		want += "Recovery partition: " + strconv.Itoa(p) + "%\n"
+	}
+	want += "Recovery partition: failed\nRESULT: FAIL\n  Recovery partition: copy failed\n"
+	c.Assert(out.String(), Equals, want)
+}
+
+func (s *UISuite) TestFancy(c *C) {
+	var out bytes.Buffer
+	ui := rplib.NewUI(strings.NewReader(""), &out, true)
+	ui.Title = "pc installer"
+	ui.SetStages("Erase")
+	ui.Progress("Erase", 1, 4)
+	c.Assert(strings.Contains(out.String(), "\033[2J\033[H\033[1mpc installer"), Equals, true)
+	c.Assert(strings.Contains(out.String(), "  Erase                [##########------------------------------] running\n"), Equals, true, Commentf("%q", out.String()))
+
+	ui.Result(nil)
+	c.Assert(strings.Contains(out.String(), "PASS"), Equals, true)
+}
+
+func (s *UISuite) TestNilUI(c *C) {
+	var ui *rplib.UI
+	ui.SetStages("Erase")
+	ui.Start("Erase")
+	ui.Progress("Erase", 1, 2)
+	ui.Done("Erase", nil)
+	ui.Result(nil)
+	c.Assert(ui.Confirm(nil, "Continue?", time.Second, true), Equals, true)
+	c.Assert(ui.ConfirmDisks(nil, time.Second), Equals, false)
+}
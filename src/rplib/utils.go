@@ -96,19 +96,21 @@ func GetPartitionBeginEnd64(device string, nr int) (begin, end int64) {
 }
 
 func GetBootEntries(keyword string) (entries []string) {
-	entryStr := Shellcmdoutput(fmt.Sprintf("efibootmgr -v | grep \"%s\" | cut -f 1 | sed 's/[^0-9]*//g'", keyword))
-	log.Printf("entryStr: [%s]\n", entryStr)
-	if "" == entryStr {
-		entries = []string{}
-	} else {
-		entries = strings.Split(entryStr, "\n")
+	nums, err := NewEfivars().FindBootEntries(keyword)
+	Checkerr(err)
+	entries = []string{}
+	for _, num := range nums {
+		entries = append(entries, fmt.Sprintf("%04X", num))
 	}
-	log.Printf("entries:", entries)
+	log.Printf("entries: %v", entries)
 	return
 }
 
 func CreateBootEntry(device string, partition int, loader string, label string) {
-	Shellexec("efibootmgr", "-c", "-d", device, "-p", fmt.Sprintf("%v", partition), "-l", loader, "-L", label)
+	hd, err := GptPartition(device, partition, LogicalBlockSize(device))
+	Checkerr(err)
+	_, err = NewEfivars().CreateBootEntry(NewEfiLoadOption(label, hd, loader))
+	Checkerr(err)
 }
 
 func ReadKernelCmdline() string {
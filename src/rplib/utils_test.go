@@ -6,7 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 
-	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
 
 	. "gopkg.in/check.v1"
 )
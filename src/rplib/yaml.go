@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -17,6 +19,7 @@ type ConfigRecovery struct {
 		Kernel string
 		Os     string
 		Gadget string
+		Extra  []string `yaml:"extra,omitempty"`
 	}
 	Configs struct {
 		Arch          string
@@ -30,6 +33,23 @@ type ConfigRecovery struct {
 		BootSize      int    `yaml:"bootsize"`
 		RootfsSize    int    `yaml:"rootfssize,omitempty"`
 		KernelPackage string `yaml:"kernelpackage,omitempty"`
+		BootMode      string `yaml:"boot-mode,omitempty"` // one of "uefi", "legacy", "hybrid", detected if not set
+		// u-boot environment, from the uboot.env content in gadget.yaml if not set
+		UbootEnvSize      int  `yaml:"uboot-env-size,omitempty"`
+		UbootEnvRedundant bool `yaml:"uboot-env-redundant,omitempty"`
+		// assemble the md arrays not running yet: "never" (default), "scan" or "firmware"
+		RaidAssemble string `yaml:"raid-assemble,omitempty"`
+		// the writable partition after the recovery partition, not created if no layout
+		Writable struct {
+			Layout  string // one of "ext4", "luks", "luks-lvm"
+			Size    int    // in MiB, the rest of the disk if 0
+			Key     string // the LUKS key: one of "config", "tpm", "passphrase"
+			KeyFile string `yaml:"key-file,omitempty"` // the key file on the installer media for "config"
+			VgName  string `yaml:"vg-name,omitempty"`  // default "ubuntu-vg"
+			LvName  string `yaml:"lv-name,omitempty"`  // default "writable"
+			// the PCRs the key is sealed to for "tpm", default [7]
+			TpmPcrs []int `yaml:"tpm-pcrs,omitempty"`
+		}
 	}
 	Recovery struct {
 		Type                       string // one of "field_transition", "factory_install"
@@ -45,6 +65,33 @@ type ConfigRecovery struct {
 		RestoreConfirmPrehookFile  string `yaml:"restore-confirm-prehook-file"`
 		RestoreConfirmPosthookFile string `yaml:"restore-confirm-posthook-file"`
 		RestoreConfirmTimeoutSec   int64  `yaml:"restore-confirm-timeout"`
+		// squashfs or ISO payload over http(s) to copy instead of the installer media,
+		// the checksum is from <payload-url>.sha256 if not set
+		PayloadUrl    string `yaml:"payload-url,omitempty"`
+		PayloadSha256 string `yaml:"payload-sha256,omitempty"`
+		// the download cache dir on the installer media, no cache if not set
+		PayloadCacheDir string `yaml:"payload-cache-dir,omitempty"`
+		// the factory diagnostics result gating the install, a file on the installer
+		// media or efivar:<name>-<guid>, in "json" (default) or "ini" format
+		FactoryDiagResult       string `yaml:"factory-diag-result,omitempty"`
+		FactoryDiagResultFormat string `yaml:"factory-diag-result-format,omitempty"`
+	}
+	Boot struct {
+		First       string // the boot entry first in BootOrder after install
+		Next        string // one-shot BootNext after install
+		RemoveStale bool   `yaml:"remove-stale"`
+	}
+	// install to multiple target disks at once, single target if no policy
+	Targets struct {
+		Policy  string   // one of "all", "list"
+		Count   int      // the number of target disks required for "all"
+		Devices []string // the target disks for "list"
+	}
+	Erase struct {
+		Enable     bool
+		Method     string // one of "auto", "nvme", "ata", "emmc", "overwrite"
+		Passes     int    // overwrite passes
+		SigningKey string `yaml:"signing-key"`
 	}
 }
 
@@ -85,6 +132,72 @@ func (config *ConfigRecovery) checkConfigs() (err error) {
 		log.Printf(err.Error())
 	}
 
+	switch config.Configs.BootMode {
+	case "", BOOT_MODE_UEFI:
+	case BOOT_MODE_LEGACY, BOOT_MODE_HYBRID:
+		if config.Configs.Arch != "amd64" || config.Configs.Bootloader != "grub" {
+			err = fmt.Errorf("'configs -> boot-mode' %q only for amd64 with grub", config.Configs.BootMode)
+			log.Printf(err.Error())
+		}
+	default:
+		err = fmt.Errorf("'configs -> boot-mode' only accept %q, %q or %q", BOOT_MODE_UEFI, BOOT_MODE_LEGACY, BOOT_MODE_HYBRID)
+		log.Printf(err.Error())
+	}
+
+	if config.Configs.UbootEnvSize < 0 {
+		err = errors.New("'configs -> uboot-env-size' must larger than 0")
+		log.Printf(err.Error())
+	}
+
+	switch config.Configs.RaidAssemble {
+	case "", RAID_ASSEMBLE_NEVER, RAID_ASSEMBLE_SCAN, RAID_ASSEMBLE_FIRMWARE:
+	default:
+		err = fmt.Errorf("'configs -> raid-assemble' only accept %q, %q or %q", RAID_ASSEMBLE_NEVER, RAID_ASSEMBLE_SCAN, RAID_ASSEMBLE_FIRMWARE)
+		log.Printf(err.Error())
+	}
+
+	switch config.Configs.Writable.Layout {
+	case "", WRITABLE_LAYOUT_EXT4:
+	case WRITABLE_LAYOUT_LUKS, WRITABLE_LAYOUT_LUKS_LVM:
+		switch config.Configs.Writable.Key {
+		case KEY_SOURCE_CONFIG:
+			if config.Configs.Writable.KeyFile == "" {
+				err = errors.New("'configs -> writable -> key-file' field not presented")
+				log.Printf(err.Error())
+			}
+		case KEY_SOURCE_TPM:
+			if len(config.Configs.Writable.TpmPcrs) == 0 {
+				config.Configs.Writable.TpmPcrs = TPM_DEFAULT_PCRS
+			}
+			for _, pcr := range config.Configs.Writable.TpmPcrs {
+				if pcr < 0 || pcr > 23 {
+					err = fmt.Errorf("'configs -> writable -> tpm-pcrs' %d not in 0-23", pcr)
+					log.Printf(err.Error())
+				}
+			}
+		case KEY_SOURCE_PASSPHRASE:
+		default:
+			err = fmt.Errorf("'configs -> writable -> key' only accept %q, %q or %q", KEY_SOURCE_CONFIG, KEY_SOURCE_TPM, KEY_SOURCE_PASSPHRASE)
+			log.Printf(err.Error())
+		}
+		if config.Configs.Writable.Layout == WRITABLE_LAYOUT_LUKS_LVM {
+			if config.Configs.Writable.VgName == "" {
+				config.Configs.Writable.VgName = "ubuntu-vg"
+			}
+			if config.Configs.Writable.LvName == "" {
+				config.Configs.Writable.LvName = "writable"
+			}
+		}
+	default:
+		err = fmt.Errorf("'configs -> writable -> layout' only accept %q, %q or %q", WRITABLE_LAYOUT_EXT4, WRITABLE_LAYOUT_LUKS, WRITABLE_LAYOUT_LUKS_LVM)
+		log.Printf(err.Error())
+	}
+
+	if config.Configs.Writable.Size < 0 {
+		err = errors.New("'configs -> writable -> size' must larger than 0")
+		log.Printf(err.Error())
+	}
+
 	if config.Configs.Swap != true && config.Configs.Swap != false {
 		err = errors.New("'configs -> swap' field not presented")
 		log.Printf(err.Error())
@@ -110,9 +223,95 @@ func (config *ConfigRecovery) checkConfigs() (err error) {
 		log.Printf(err.Error())
 	}
 
+	// the recovery partition is formatted with the label in upper-case
 	if config.Recovery.FsLabel == "" {
 		err = errors.New("'recovery -> filesystem-label' field not presented")
 		log.Printf(err.Error())
+	} else if lerr := ValidateLabel(FS_TYPE_VFAT, strings.ToUpper(config.Recovery.FsLabel)); lerr != nil {
+		err = fmt.Errorf("'recovery -> filesystem-label' invalid: %v", lerr)
+		log.Printf(err.Error())
+	}
+
+	if config.Recovery.SkipFactoryDiagResult != "" {
+		if _, perr := strconv.ParseBool(config.Recovery.SkipFactoryDiagResult); perr != nil {
+			err = errors.New("'recovery -> skip-factory-diag-result' only accept \"true\" or \"false\"")
+			log.Printf(err.Error())
+		}
+	}
+
+	if config.Recovery.RestoreConfirmTimeoutSec == 0 {
+		config.Recovery.RestoreConfirmTimeoutSec = RESTORE_CONFIRM_TIMEOUT_DEFAULT
+	} else if config.Recovery.RestoreConfirmTimeoutSec < 0 {
+		err = errors.New("'recovery -> restore-confirm-timeout' must larger than 0")
+		log.Printf(err.Error())
+	}
+
+	switch config.Recovery.FactoryDiagResultFormat {
+	case "":
+		config.Recovery.FactoryDiagResultFormat = DIAG_FORMAT_JSON
+	case DIAG_FORMAT_JSON, DIAG_FORMAT_INI:
+	default:
+		err = fmt.Errorf("'recovery -> factory-diag-result-format' only accept %q or %q", DIAG_FORMAT_JSON, DIAG_FORMAT_INI)
+		log.Printf(err.Error())
+	}
+
+	if config.Recovery.PayloadUrl != "" && !strings.HasPrefix(config.Recovery.PayloadUrl, "http://") && !strings.HasPrefix(config.Recovery.PayloadUrl, "https://") {
+		err = errors.New("'recovery -> payload-url' only accept http:// or https:// url")
+		log.Printf(err.Error())
+	}
+
+	if config.Recovery.PayloadSha256 != "" && !sha256Regex.MatchString(strings.ToLower(config.Recovery.PayloadSha256)) {
+		err = errors.New("'recovery -> payload-sha256' must be 64 hex digits")
+		log.Printf(err.Error())
+	}
+
+	for _, entry := range []struct{ key, value string }{{"first", config.Boot.First}, {"next", config.Boot.Next}} {
+		switch entry.value {
+		case "", BOOT_ENTRY_RECOVERY, BOOT_ENTRY_SNAPPY, BOOT_ENTRY_UBUNTU_CLASSIC:
+		default:
+			err = fmt.Errorf("'boot -> %s' only accept %q, %q or %q", entry.key, BOOT_ENTRY_RECOVERY, BOOT_ENTRY_SNAPPY, BOOT_ENTRY_UBUNTU_CLASSIC)
+			log.Printf(err.Error())
+		}
+	}
+
+	switch config.Targets.Policy {
+	case "":
+	case TARGET_POLICY_ALL:
+		if config.Targets.Count < 0 {
+			err = errors.New("'targets -> count' must larger than 0")
+			log.Printf(err.Error())
+		}
+	case TARGET_POLICY_LIST:
+		if len(config.Targets.Devices) == 0 {
+			err = errors.New("'targets -> devices' field not presented")
+			log.Printf(err.Error())
+		}
+	default:
+		err = fmt.Errorf("'targets -> policy' only accept %q or %q", TARGET_POLICY_ALL, TARGET_POLICY_LIST)
+		log.Printf(err.Error())
+	}
+
+	if config.Erase.Enable == true {
+		switch config.Erase.Method {
+		case "":
+			config.Erase.Method = ERASE_METHOD_AUTO
+		case ERASE_METHOD_AUTO, ERASE_METHOD_NVME, ERASE_METHOD_ATA, ERASE_METHOD_EMMC, ERASE_METHOD_OVERWRITE:
+		default:
+			err = fmt.Errorf("'erase -> method' only accept %q, %q, %q, %q or %q", ERASE_METHOD_AUTO, ERASE_METHOD_NVME, ERASE_METHOD_ATA, ERASE_METHOD_EMMC, ERASE_METHOD_OVERWRITE)
+			log.Printf(err.Error())
+		}
+
+		if config.Erase.Passes == 0 {
+			config.Erase.Passes = 3
+		} else if config.Erase.Passes < 0 {
+			err = errors.New("'erase -> passes' must larger than 0")
+			log.Printf(err.Error())
+		}
+
+		if config.Erase.SigningKey == "" {
+			err = errors.New("'erase -> signing-key' field not presented")
+			log.Printf(err.Error())
+		}
 	}
 
 	return err
@@ -230,3 +429,78 @@ func (gadgetInfo *GadgetInfo) GetVolumeSizebyLabel(FsLabel string) (sizeMB int,
 	}
 	return
 }
+
+// GetStructurebyLabel() returns the structure with the filesystem label
+func (gadgetInfo *GadgetInfo) GetStructurebyLabel(FsLabel string) (*VolumeStructure, error) {
+	if gadgetInfo == nil {
+		return nil, fmt.Errorf("nil gadgetInfo")
+	}
+
+	for _, v := range gadgetInfo.Volumes {
+		for i := range v.Structure {
+			if v.Structure[i].Label == FsLabel {
+				return &v.Structure[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Structure with filesystem-label %q not found", FsLabel)
+}
+
+// CheckContent() checks all the content sources exist in gadgetDir
+func (st *VolumeStructure) CheckContent(gadgetDir string) error {
+	missing := []string{}
+	for _, content := range st.Content {
+		if content.Source == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(gadgetDir, content.Source)); err != nil {
+			missing = append(missing, content.Source)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing content of %q: %s", st.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// PopulateContent() copies the content sources from gadgetDir to the
+// filesystem mounted on dst. A source with trailing '/' copies the directory
+// content into the target, or the directory itself is copied into the target.
+// All the sources are checked before anything is written.
+func (st *VolumeStructure) PopulateContent(gadgetDir string, dst string) error {
+	if err := st.CheckContent(gadgetDir); err != nil {
+		return err
+	}
+
+	for _, content := range st.Content {
+		if content.Source == "" {
+			continue
+		}
+		src := filepath.Join(gadgetDir, content.Source)
+		target := filepath.Join(dst, content.Target)
+		log.Printf("copy %s to %s", content.Source, target)
+
+		srcStat, err := os.Stat(src)
+		if err != nil {
+			return err
+		}
+		if srcStat.IsDir() {
+			if !strings.HasSuffix(content.Source, "/") {
+				target = filepath.Join(target, filepath.Base(src))
+			}
+			err = CopyTree(src, target)
+		} else {
+			if strings.HasSuffix(content.Target, "/") {
+				target = filepath.Join(target, filepath.Base(src))
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			err = FileCopy(src, target)
+		}
+		if err != nil {
+			return fmt.Errorf("Copy %s to %s failed: %v", content.Source, target, err)
+		}
+	}
+	return nil
+}
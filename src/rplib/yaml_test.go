@@ -1,9 +1,13 @@
 package rplib_test
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
-	rplib "github.com/Lyoncore/ubuntu-recovery/src/rplib"
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
 	. "gopkg.in/check.v1"
 )
 
@@ -19,6 +23,37 @@ func (s *YamlSuite) TestLoad(c *C) {
 	c.Assert(err, IsNil)
 }
 
+// A lower-case recovery label is valid, formatted in upper-case
+func (s *YamlSuite) TestLoadLowerCaseRecoveryLabel(c *C) {
+	dat, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	file := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(file, []byte(strings.Replace(string(dat), "filesystem-label: ESP", "filesystem-label: recovery", 1)), 0644), IsNil)
+
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load(file), IsNil)
+	c.Assert(configs.Recovery.FsLabel, Equals, "recovery")
+
+	c.Assert(ioutil.WriteFile(file, []byte(strings.Replace(string(dat), "filesystem-label: ESP", "filesystem-label: recovery.data", 1)), 0644), IsNil)
+	configs = rplib.ConfigRecovery{}
+	c.Assert(configs.Load(file), ErrorMatches, "'recovery -> filesystem-label' invalid: .*")
+}
+
+// The factory restore confirmation doesn't wait forever
+func (s *YamlSuite) TestLoadRestoreConfirmTimeout(c *C) {
+	dat, err := ioutil.ReadFile("test_data/config.yaml")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(dat), "restore-confirm-timeout"), Equals, false)
+	var configs rplib.ConfigRecovery
+	c.Assert(configs.Load("test_data/config.yaml"), IsNil)
+	c.Assert(configs.Recovery.RestoreConfirmTimeoutSec, Equals, int64(rplib.RESTORE_CONFIRM_TIMEOUT_DEFAULT))
+
+	file := filepath.Join(c.MkDir(), "config.yaml")
+	c.Assert(ioutil.WriteFile(file, []byte(strings.Replace(string(dat), "recovery:\n", "recovery:\n  restore-confirm-timeout: -1\n", 1)), 0644), IsNil)
+	configs = rplib.ConfigRecovery{}
+	c.Assert(configs.Load(file), ErrorMatches, "'recovery -> restore-confirm-timeout' must larger than 0")
+}
+
 func (s *YamlSuite) TestGetVolumeSizebyLabel(c *C) {
 	var gi rplib.GadgetInfo
 	err := gi.Load("test_data/gadget.yaml")
@@ -28,3 +63,54 @@ func (s *YamlSuite) TestGetVolumeSizebyLabel(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(sizeMB, Equals, 50)
 }
+
+func (s *YamlSuite) TestGetStructurebyLabel(c *C) {
+	var gi rplib.GadgetInfo
+	err := gi.Load("test_data/gadget.yaml")
+	c.Assert(err, IsNil)
+
+	st, err := gi.GetStructurebyLabel("ESP")
+	c.Assert(err, IsNil)
+	c.Assert(st.Name, Equals, "recovery")
+	c.Assert(st.Content, HasLen, 4)
+
+	_, err = gi.GetStructurebyLabel("not-exist")
+	c.Assert(err, NotNil)
+}
+
+func (s *YamlSuite) TestPopulateContent(c *C) {
+	var gi rplib.GadgetInfo
+	err := gi.Load("test_data/gadget.yaml")
+	c.Assert(err, IsNil)
+	st, err := gi.GetStructurebyLabel("ESP")
+	c.Assert(err, IsNil)
+
+	gadgetDir := c.MkDir()
+	dst := c.MkDir()
+	os.MkdirAll(filepath.Join(gadgetDir, "recovery-assets/recovery"), 0755)
+	ioutil.WriteFile(filepath.Join(gadgetDir, "recovery-assets/recovery/config.yaml"), []byte("config"), 0644)
+	ioutil.WriteFile(filepath.Join(gadgetDir, "grubx64.efi"), []byte("grub"), 0644)
+	ioutil.WriteFile(filepath.Join(gadgetDir, "shim.efi.signed"), []byte("shim"), 0644)
+
+	// grub_recovery.cfg missing, nothing is written
+	err = st.PopulateContent(gadgetDir, dst)
+	c.Assert(err, ErrorMatches, ".*grub_recovery.cfg.*")
+	files, err := ioutil.ReadDir(dst)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+
+	ioutil.WriteFile(filepath.Join(gadgetDir, "grub_recovery.cfg"), []byte("grub.cfg"), 0644)
+	err = st.PopulateContent(gadgetDir, dst)
+	c.Assert(err, IsNil)
+
+	for file, content := range map[string]string{
+		"recovery/config.yaml": "config",
+		"efi/boot/grubx64.efi": "grub",
+		"efi/boot/bootx64.efi": "shim",
+		"efi/ubuntu/grub.cfg":  "grub.cfg",
+	} {
+		dat, err := ioutil.ReadFile(filepath.Join(dst, file))
+		c.Assert(err, IsNil)
+		c.Assert(string(dat), Equals, content)
+	}
+}
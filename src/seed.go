@@ -0,0 +1,71 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the snaps to seed on the writable partition, found by checkSeedSnaps()
+var seedSnaps []*rplib.SeedSnap
+
+// seedSnapNames() returns the snaps in config.yaml: the kernel, os, gadget
+// and the extra snaps.
+func seedSnapNames() []string {
+	s := configs.Snaps
+	names := []string{}
+	for _, name := range append([]string{s.Kernel, s.Os, s.Gadget}, s.Extra...) {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// checkSeedSnaps() finds the snaps in config.yaml on the payload before
+// touching the target disk. Only ubuntu core with the writable partition
+// created by the installer is seeded.
+func checkSeedSnaps() error {
+	if recoveryOs != rplib.RECOVERY_OS_UBUNTU_CORE || configs.Configs.Writable.Layout == "" {
+		return nil
+	}
+	var err error
+	seedSnaps, err = rplib.FindSeedSnaps(filepath.Join(RECO_ROOT_DIR, rplib.SEED_SNAPS_DIR), seedSnapNames())
+	if err != nil {
+		return fmt.Errorf("Seed snaps: %v", err)
+	}
+	return nil
+}
+
+// writeSeed() writes the snaps and seed.yaml to the mounted writable partition
+func writeSeed(mnt string) error {
+	if len(seedSnaps) == 0 {
+		return nil
+	}
+	seedDir := filepath.Join(mnt, rplib.SEED_DIR)
+	log.Printf("seed %d snaps to %s", len(seedSnaps), seedDir)
+	return rplib.WriteSeed(seedDir, seedSnaps,
+		filepath.Join(RECO_ROOT_DIR, rplib.SEED_SNAPS_DIR),
+		filepath.Join(RECO_ROOT_DIR, rplib.SEED_ASSERTIONS_DIR))
+}
@@ -0,0 +1,93 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the installer media, nil if it was mounted on RECO_ROOT_DIR before the installer
+var source *rplib.SourceMedia
+
+// the writable mount point of the installer media, for the OEM logs
+var sourceRwDir = RECO_ROOT_DIR
+
+// RECOVERY_OS_* of the installer media
+var recoveryOs string
+
+// mountSource() finds the installer media, mounts it read-only on
+// RECO_ROOT_DIR, and detects the recovery OS type of it.
+func mountSource(label string) error {
+	var err error
+	if _, err = os.Stat(filepath.Join(RECO_ROOT_DIR, rplib.SOURCE_MARKER_FILE)); err == nil {
+		log.Printf("Installer media already mounted on %s", RECO_ROOT_DIR)
+	} else {
+		source, err = rplib.FindSourceMedia(label, mounts)
+		if err != nil {
+			return err
+		}
+		if source == nil {
+			return fmt.Errorf("Installer media (LABEL=%s) not found", label)
+		}
+		if err = mountSourceReadOnly(); err != nil {
+			return err
+		}
+	}
+
+	recoveryOs, err = rplib.SourceOsType(RECO_ROOT_DIR)
+	if err != nil {
+		return err
+	}
+	log.Printf("Recovery OS: %s", recoveryOs)
+	return nil
+}
+
+// mountSourceReadOnly() mounts the installer media read-only on RECO_ROOT_DIR.
+// The media is mounted on a temporary mount point first (writable unless
+// iso9660), or reused if it's mounted already (e.g. /cdrom). If the media has
+// a squashfs or ISO payload, the payload is verified and mounted, otherwise
+// the media is bind mounted read-only.
+func mountSourceReadOnly() error {
+	mnt := rplib.MountedAt(source.Path)
+	if mnt == "" {
+		var flags uintptr
+		if source.Type == rplib.FS_TYPE_ISO9660 {
+			flags = syscall.MS_RDONLY
+		}
+		var err error
+		mnt, err = mounts.MountTemp(source.Path, source.Type, flags, "")
+		if err != nil {
+			return err
+		}
+	}
+	sourceRwDir = mnt
+
+	if payload := rplib.FindPayload(mnt); payload != "" {
+		log.Printf("Installer payload found: %s", payload)
+		return rplib.MountPayload(payload, RECO_ROOT_DIR, mounts)
+	}
+	return mounts.BindReadOnly(mnt, RECO_ROOT_DIR)
+}
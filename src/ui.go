@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the install stages shown in the UI
+const (
+	UI_STAGE_ERASE    = "Erase"
+	UI_STAGE_RECOVERY = "Recovery partition"
+	UI_STAGE_WRITABLE = "Writable partition"
+	UI_STAGE_BOOT     = "Boot entries"
+)
+
+// the operator UI, nil for the headless install
+var ui *rplib.UI
+
+// the errors of the failed stages, shown in the result screen
+var stageErrors []error
+
+// the start time of the install, in the result report
+var installStart = time.Now()
+
+// the factory restore is confirmed already, no more confirmation of the disks
+var restoreConfirmed bool
+
+// startUI() starts the operator UI on the console if not headless. The log
+// goes to a file in the OEM log dir not to break the full-screen UI.
+func startUI() {
+	if recoveryType() == rplib.HEADLESS_INSTALLER || *targetImage != "" {
+		return
+	}
+	usbhid()
+	ui = rplib.ConsoleUI()
+	if ui == nil {
+		log.Println("No terminal on stdin, the operator UI is disabled")
+		return
+	}
+	ui.Title = fmt.Sprintf("%s installer %s", configs.Project, version)
+	if !ui.Fancy {
+		return
+	}
+
+	logDir := filepath.Join(sourceRwDir, configs.Recovery.OemLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Println("Create log dir failed:", err)
+		return
+	}
+	logFile := filepath.Join(logDir, fmt.Sprintf("installer-%s.log", time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println("Open log file failed:", err)
+		return
+	}
+	log.Printf("log to %s", logFile)
+	log.SetOutput(f)
+}
+
+// confirmTargets() shows the target disks and asks the operator to confirm
+// before wiping them. It is cancelled if no answer in restore-confirm-timeout.
+func confirmTargets(disks []string) bool {
+	if ui == nil || restoreConfirmed {
+		return true
+	}
+	infos := []rplib.DiskInfo{}
+	for _, disk := range disks {
+		infos = append(infos, rplib.GetDiskInfo(rplib.DiskNode(disk)))
+	}
+	timeout := time.Duration(configs.Recovery.RestoreConfirmTimeoutSec) * time.Second
+	if !ui.ConfirmDisks(infos, timeout) {
+		log.Println("Install cancelled by the operator")
+		return false
+	}
+	return true
+}
+
+// runStage() runs the install stage and shows its state in the UI
+func runStage(name string, step func() error) error {
+	ui.Start(name)
+	err := step()
+	ui.Done(name, err)
+	if err != nil {
+		stageErrors = append(stageErrors, fmt.Errorf("%s: %v", name, err))
+	}
+	return err
+}
+
+// reportResult() shows the PASS or FAIL screen of the exit code, and saves
+// the result report in the OEM log dir.
+func reportResult(code int) {
+	if code != 0 && len(stageErrors) == 0 {
+		stageErrors = append(stageErrors, fmt.Errorf("exit code %d, see the log", code))
+	}
+	ui.Result(stageErrors)
+
+	report := rplib.InstallReport{
+		Project: configs.Project,
+		Start:   installStart.UTC(),
+		End:     time.Now().UTC(),
+		Result:  "PASS",
+		Diag:    diagGate,
+	}
+	if code != 0 {
+		report.Result = "FAIL"
+	}
+	for _, err := range stageErrors {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	logDir := filepath.Join(sourceRwDir, configs.Recovery.OemLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Println("Create log dir failed:", err)
+		return
+	}
+	file := filepath.Join(logDir, fmt.Sprintf("report-%s.json", report.Start.Format("20060102T150405Z")))
+	if err := report.Save(file); err != nil {
+		log.Println("Save result report failed:", err)
+		return
+	}
+	log.Printf("Result report saved: %s", file)
+}
@@ -0,0 +1,218 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2017 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	rplib "github.com/Lyoncore/ubuntu-oem-installer/src/rplib"
+)
+
+// the LUKS label of the encrypted writable partition
+const WRITABLE_LUKS_LABEL = "writable-luks"
+
+// saveRecoveryKey() saves the recovery passphrase of the writable partition
+// in the OEM log dir
+func saveRecoveryKey(parts *Partitions, passphrase string) error {
+	logDir := filepath.Join(sourceRwDir, configs.Recovery.OemLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	keyFile := filepath.Join(logDir, fmt.Sprintf("writable-key-%s-%s.txt", parts.TargetDevNode, time.Now().UTC().Format("20060102T150405Z")))
+	if err := ioutil.WriteFile(keyFile, []byte(passphrase+"\n"), 0600); err != nil {
+		return err
+	}
+	log.Printf("Recovery passphrase of writable partition saved: %s", keyFile)
+	return nil
+}
+
+// writableKey() returns the LUKS key of the writable partition from the
+// key source in config.yaml, and the secret to seal in the TPM for "tpm".
+// The random passphrase is saved in the OEM log dir as the recovery key.
+func writableKey(parts *Partitions) (key []byte, tpmSecret []byte, err error) {
+	w := configs.Configs.Writable
+	switch w.Key {
+	case rplib.KEY_SOURCE_CONFIG:
+		key, err = ioutil.ReadFile(filepath.Join(RECO_ROOT_DIR, w.KeyFile))
+		return key, nil, err
+	case rplib.KEY_SOURCE_TPM:
+		tpmSecret, err = rplib.GenerateKey(rplib.TPM_SECRET_SIZE)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rplib.TpmPassphrase(tpmSecret), tpmSecret, nil
+	case rplib.KEY_SOURCE_PASSPHRASE:
+		passphrase, err := rplib.GeneratePassphrase()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = saveRecoveryKey(parts, passphrase); err != nil {
+			return nil, nil, err
+		}
+		return []byte(passphrase), nil, nil
+	}
+	return nil, nil, fmt.Errorf("Unknown writable key source: %q", w.Key)
+}
+
+// enrollTpm() seals the key of the writable partition in the TPM, and adds
+// a recovery passphrase saved in the OEM log dir, to unlock the partition
+// when the PCRs change.
+func enrollTpm(parts *Partitions, partPath string, key []byte, tpmSecret []byte) error {
+	err := rplib.EnrollTpm(partPath, tpmSecret, rplib.LUKS_FORMAT_KEYSLOT, configs.Configs.Writable.TpmPcrs)
+	if err != nil {
+		return err
+	}
+	passphrase, err := rplib.GeneratePassphrase()
+	if err != nil {
+		return err
+	}
+	if err = rplib.LuksAddKey(partPath, key, []byte(passphrase)); err != nil {
+		return err
+	}
+	return saveRecoveryKey(parts, passphrase)
+}
+
+// appendFile() appends the line to the file, the file is created if not exist
+func appendFile(file string, line string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CreateWritable() creates the writable partition after the recovery
+// partition with the layout in config.yaml: plain ext4, ext4 on LUKS2, or
+// ext4 on a logical volume on LUKS2. The crypttab and fstab entries are
+// written to the new filesystem.
+func CreateWritable(parts *Partitions) error {
+	w := configs.Configs.Writable
+	if w.Layout == "" {
+		return nil
+	}
+
+	parts.Writable_nr = parts.Recovery_nr + 1
+	begin := parts.Recovery_end / (1024 * 1024)
+	end := "100%"
+	if w.Size > 0 {
+		end = fmt.Sprintf("%d", begin+int64(w.Size))
+	}
+	rplib.Shellexec("parted", "-ms", "-a", "optimal", parts.TargetDevPath,
+		"unit", "MiB",
+		"mkpart", "primary", "ext4", fmt.Sprintf("%d", begin), end,
+		"name", fmt.Sprintf("%v", parts.Writable_nr), WritableLabel,
+		"print")
+
+	err := rplib.RereadPartitions(parts.TargetDevPath)
+	if err != nil {
+		return err
+	}
+	partPath, err := rplib.WaitPartition(parts.TargetDevPath, parts.Writable_nr, PART_WAIT_TIMEOUT)
+	if err != nil {
+		return err
+	}
+
+	// the device of the filesystem, and the crypttab entry
+	fsDev := partPath
+	crypttab := ""
+	if w.Layout == rplib.WRITABLE_LAYOUT_LUKS || w.Layout == rplib.WRITABLE_LAYOUT_LUKS_LVM {
+		key, tpmSecret, err := writableKey(parts)
+		if err != nil {
+			return err
+		}
+		if err = rplib.LuksFormat(partPath, key, WRITABLE_LUKS_LABEL); err != nil {
+			return err
+		}
+		uuid, err := rplib.LuksUUID(partPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(partPath) + "_crypt"
+		if err = rplib.LuksOpen(partPath, name, key); err != nil {
+			return err
+		}
+		defer rplib.LuksClose(name)
+		fsDev = filepath.Join("/dev/mapper", name)
+		crypttab = rplib.CrypttabLine(name, uuid, w.Key)
+
+		if w.Layout == rplib.WRITABLE_LAYOUT_LUKS_LVM {
+			if fsDev, err = rplib.LvmCreate(fsDev, w.VgName, w.LvName); err != nil {
+				return err
+			}
+			defer rplib.LvmDeactivate(w.VgName)
+		}
+
+		if tpmSecret != nil {
+			if err = enrollTpm(parts, partPath, key, tpmSecret); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = rplib.Format(fsDev, rplib.FS_TYPE_EXT4, WritableLabel, rplib.FormatOptions{}); err != nil {
+		return err
+	}
+	mnt, err := mounts.MountTemp(fsDev, rplib.FS_TYPE_EXT4, 0, "")
+	if err != nil {
+		return err
+	}
+	// only its own mount, the writable of the other targets are created at once
+	defer mounts.UnmountOnly(mnt)
+
+	// the root of ubuntu core is in system-data of writable
+	etcDir := filepath.Join(mnt, "etc")
+	mountPoint := "/"
+	if recoveryOs == rplib.RECOVERY_OS_UBUNTU_CORE {
+		etcDir = filepath.Join(mnt, "system-data", "etc")
+		mountPoint = "/writable"
+	}
+	if crypttab != "" {
+		if err = appendFile(filepath.Join(etcDir, "crypttab"), crypttab); err != nil {
+			return err
+		}
+	}
+	// the plain partition is found by label, the device node can change
+	fsSpec := fsDev
+	if crypttab == "" {
+		fsSpec = "LABEL=" + WritableLabel
+	}
+	fstab := fmt.Sprintf("%s %s ext4 defaults 0 1\n", fsSpec, mountPoint)
+	if err = appendFile(filepath.Join(etcDir, "fstab"), fstab); err != nil {
+		return err
+	}
+	if err = writeSeed(mnt); err != nil {
+		return err
+	}
+	rplib.Shellexec("sync")
+	log.Printf("writable partition created: %s (%s)", partPath, w.Layout)
+	return nil
+}